@@ -4,6 +4,7 @@ go 1.12
 
 require (
 	github.com/gorilla/mux v1.7.3
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 var apiInvocationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -18,73 +22,703 @@ var apiInvocationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	"status",
 })
 
+//BackupResponse backup as listed by GET /backups
+type BackupResponse struct {
+	ID         string            `json:"id"`
+	DataID     string            `json:"data_id"`
+	Status     string            `json:"status"`
+	StartTime  string            `json:"start_time"`
+	EndTime    string            `json:"end_time"`
+	Size       string            `json:"size"`
+	CustomData string            `json:"custom_data"`
+	Tags       []string          `json:"tags"`
+	Labels     map[string]string `json:"labels"`
+}
+
 func startRestAPI() {
 	prometheus.MustRegister(apiInvocationsCounter)
 
-	router := mux.NewRouter()
-	router.HandleFunc("/backups", GetBackups).Methods("GET")
-	router.HandleFunc("/backups", TriggerBackup).Methods("POST")
-	router.Handle("/metrics", promhttp.Handler())
 	listen := fmt.Sprintf("%s:%d", options.listenIP, options.listenPort)
 	logrus.Infof("Listening at %s", listen)
-	err := http.ListenAndServe(listen, router)
+	err := http.ListenAndServe(listen, newRouter())
 	if err != nil {
 		logrus.Errorf("Error while listening requests: %s", err)
 		os.Exit(1)
 	}
 }
 
-//GetBackups get currently tracked backups
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/backups", GetBackups).Methods("GET")
+	router.HandleFunc("/backups", TriggerBackup).Methods("POST")
+	router.HandleFunc("/maintenance", GetMaintenanceWindows).Methods("GET")
+	router.HandleFunc("/maintenance", CreateMaintenanceWindow).Methods("POST")
+	router.HandleFunc("/maintenance/{id}", EndMaintenanceWindow).Methods("DELETE")
+	router.HandleFunc("/backups/{id}", PatchBackup).Methods("PATCH")
+	router.HandleFunc("/backups/{id}/restore-from-trash", RestoreBackupFromTrash).Methods("POST")
+	router.HandleFunc("/backups/{id}/hooks", GetBackupHooks).Methods("GET")
+	router.HandleFunc("/backups/{id}/members", GetBackupMembers).Methods("GET")
+	router.HandleFunc("/chains/{id}", GetChain).Methods("GET")
+	router.HandleFunc("/status", GetStatus).Methods("GET")
+	router.HandleFunc("/schedule", GetSchedule).Methods("GET")
+	router.HandleFunc("/schedule/pause", PauseSchedule).Methods("POST")
+	router.HandleFunc("/schedule/resume", ResumeSchedule).Methods("POST")
+	router.HandleFunc("/admin/catalog/export", ExportCatalog).Methods("GET")
+	router.HandleFunc("/admin/catalog/import", ImportCatalog).Methods("POST")
+	router.HandleFunc("/admin/catalog/stats", GetCatalogStats).Methods("GET")
+	router.HandleFunc("/audit", GetAudit).Methods("GET")
+	router.HandleFunc("/retention/plan", GetRetentionPlan).Methods("GET")
+	router.HandleFunc("/retention/run", RunRetention).Methods("POST")
+	router.HandleFunc("/trash", GetTrash).Methods("GET")
+	router.HandleFunc("/holds", GetHolds).Methods("GET")
+	router.HandleFunc("/holds", CreateHold).Methods("POST")
+	router.HandleFunc("/holds/{id}", ReleaseHold).Methods("DELETE")
+	router.Handle("/metrics", promhttp.Handler())
+	router.Use(followerReadOnly)
+	return router
+}
+
+//GetBackups get currently tracked backups. Query params: tag, status, selector (labels. ex.: env=prod,reason!=manual)
 func GetBackups(w http.ResponseWriter, r *http.Request) {
-	logrus.Debugf("GetBackups r=%s", r)
+	logrus.Debugf("GetBackups r=%v", r)
 	tag := r.URL.Query().Get("tag")
 	status := r.URL.Query().Get("status")
+	err0 := validateTag(tag, true)
+	if err0 != nil {
+		http.Error(w, err0.Error(), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	selector, err0 := parseLabelSelector(r.URL.Query().Get("selector"))
+	if err0 != nil {
+		http.Error(w, err0.Error(), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
 	backups, err := getMaterializedBackups(0, tag, status, false)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		apiInvocationsCounter.WithLabelValues("error").Inc()
 		return
 	}
+	labels, err := getAllBackupLabels()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
 
-	rjson := ""
+	result := make([]BackupResponse, 0)
 	for _, b := range backups {
-		tags := ""
-
-		bt := getTags(b)
-		for _, tag := range bt {
-			if tags != "" {
-				tags = tags + ","
-			}
-			tags = tags + "\"" + tag + "\""
+		if !matchesLabelSelector(labels[b.ID], selector) {
+			continue
 		}
+		result = append(result, backupResponse(b, labels[b.ID]))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func backupResponse(b MaterializedBackup, labels map[string]string) BackupResponse {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return BackupResponse{
+		ID:         b.ID,
+		DataID:     b.DataID,
+		Status:     b.Status,
+		StartTime:  fmt.Sprintf("%s", localTime(b.StartTime)),
+		EndTime:    fmt.Sprintf("%s", localTime(b.EndTime)),
+		Size:       fmt.Sprintf("%f", b.SizeMB),
+		CustomData: b.CustomData,
+		Tags:       getTags(b),
+		Labels:     labels,
+	}
+}
+
+//PatchBackup change labels of a backup. Body: {"labels":{"name":"value", "removed-name":null}}
+func PatchBackup(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("PatchBackup r=%v", r)
+	backupID := mux.Vars(r)["id"]
+	var req struct {
+		Labels map[string]*string `json:"labels"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid json body. err=%s", err), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	err = validateLabels(req.Labels, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
 
-		if rjson != "" {
-			rjson = rjson + ","
+	//the backup being created is not in the catalog yet but can be labeled
+	b, err := getMaterializedBackup(backupID)
+	if err != nil {
+		runningID, runningStatus, _, _ := getCurrentTaskStatus()
+		if runningID != backupID || runningStatus != "running" {
+			http.Error(w, "Backup not found", http.StatusNotFound)
+			apiInvocationsCounter.WithLabelValues("error").Inc()
+			return
 		}
-		rjson = rjson + "{\"id\":\"" + b.ID + "\", \"data_id\":\"" + b.DataID + "\", \"status\":\"" + b.Status + "\", \"start_time\":\"" + fmt.Sprintf("%s", b.StartTime) + "\", \"end_time\":\"" + fmt.Sprintf("%s", b.EndTime) + "\", \"size\":\"" + fmt.Sprintf("%f", b.SizeMB) + "\", \"custom_data\":\"" + b.CustomData + "\", \"tags\":[" + tags + "]}"
+		b = MaterializedBackup{ID: backupID, Status: runningStatus}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte("[" + rjson + "]"))
-	logrus.Debugf("result: %s", "["+rjson+"]")
-	apiInvocationsCounter.WithLabelValues("success").Inc()
+	labels, err := setBackupLabels(backupID, req.Labels, true, apiActor(r), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	logrus.Infof("Labels of backup %s changed. labels=%v", backupID, labels)
+	writeJSON(w, http.StatusOK, backupResponse(b, labels))
+}
+
+//RestoreBackupFromTrash cancel the deletion of a backup with status 'pending-delete'. Query params: reason
+func RestoreBackupFromTrash(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("RestoreBackupFromTrash r=%v", r)
+	backupID := mux.Vars(r)["id"]
+	b, err := getMaterializedBackup(backupID)
+	if err != nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	ok, err := restoreFromTrash(backupID, apiActor(r), r.URL.Query().Get("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Backup is not in the trash. status=%s", b.Status), http.StatusConflict)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	b.Status = "available"
+	labels, _ := getBackupLabels(backupID)
+	writeJSON(w, http.StatusOK, backupResponse(b, labels))
 }
 
-//TriggerBackup get currently tracked backups
+//TriggerBackup trigger a new backup now. Body (optional): {"labels":{"name":"value"}, "expires_in":"72h", "exclude_from_tiers":true}. When called by an upstream Schelly, the body also has the chain the backup is part of: {"chain_id":"...", "upstream":"..."}
 func TriggerBackup(w http.ResponseWriter, r *http.Request) {
-	logrus.Debugf("TriggerBackup r=%s", r)
-	result, err := triggerNewBackup()
+	logrus.Debugf("TriggerBackup r=%v", r)
+	var req struct {
+		ChainID  string            `json:"chain_id"`
+		Upstream string            `json:"upstream"`
+		Labels   map[string]string `json:"labels"`
+		//ad hoc backups can expire independently of the retention tiers
+		ExpiresIn        string `json:"expires_in"`
+		ExcludeFromTiers bool   `json:"exclude_from_tiers"`
+	}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid json body. err=%s", err), http.StatusBadRequest)
+			apiInvocationsCounter.WithLabelValues("error").Inc()
+			return
+		}
+	}
+
+	labels := labelValues(req.Labels)
+	err := validateLabels(labels, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+
+	expiresIn := time.Duration(0)
+	if req.ExpiresIn != "" {
+		expiresIn, err = parseAge(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			http.Error(w, "expires_in must be a positive duration (ex.: 72h or 3d)", http.StatusBadRequest)
+			apiInvocationsCounter.WithLabelValues("error").Inc()
+			return
+		}
+	}
+
+	actor := apiActor(r)
+	if req.ChainID != "" {
+		actor = "callback:" + req.Upstream + "@" + clientAddress(r)
+	}
+	result, err := triggerNewBackup(actor)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		apiInvocationsCounter.WithLabelValues("error").Inc()
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	rs := "{}"
-	if result.ID != "" {
-		rs = "{id:'" + result.ID + "',status:'" + result.Status + "',message:'" + result.Message + "'}"
+
+	if req.ChainID != "" {
+		joinChainWithTrigger(req.ChainID, req.Upstream, result)
+	}
+
+	//on overlap, result is the backup that is still running. labels, expiry and chain go to the queued follow-up backup instead
+	if result.Status == "queued" && (len(labels) > 0 || expiresIn > 0 || req.ExcludeFromTiers || req.ChainID != "") {
+		err = saveQueuedBackup(QueuedBackup{QueuedAt: time.Now(), Actor: actor, Labels: labels, ExpiresIn: expiresIn, ExcludeFromTiers: req.ExcludeFromTiers, ChainID: req.ChainID, Upstream: req.Upstream})
+		if err != nil {
+			logrus.Errorf("Couldn't save labels, expiry and chain of queued backup. err=%s", err)
+		}
+	}
+
+	if result.Status == "running" && len(labels) > 0 {
+		result.Labels, err = setBackupLabels(result.ID, labels, true, actor, "labels from backup trigger")
+		if err != nil {
+			logrus.Errorf("Couldn't save labels of backup %s. err=%s", result.ID, err)
+		}
+	}
+
+	if result.Status == "running" && (expiresIn > 0 || req.ExcludeFromTiers) {
+		x, err := setExpiry(result.ID, expiresIn, req.ExcludeFromTiers, actor)
+		if err != nil {
+			logrus.Errorf("Couldn't save expiry of backup %s. err=%s", result.ID, err)
+		} else if x.ExpiresAt != nil {
+			expiresAt := localTime(*x.ExpiresAt)
+			result.ExpiresAt = &expiresAt
+		}
+	}
+
+	if result.Status == "aborted" {
+		writeJSON(w, http.StatusConflict, result)
+		return
+	}
+	if result.Status == "" {
+		writeJSON(w, http.StatusOK, map[string]string{})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+//GetBackupHooks get results of the pre and post backup hooks run for a backup
+func GetBackupHooks(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetBackupHooks r=%v", r)
+	hes, err := getHookExecutions(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	for i := range hes {
+		hes[i].StartTime = localTime(hes[i].StartTime)
+		hes[i].EndTime = localTime(hes[i].EndTime)
+	}
+	writeJSON(w, http.StatusOK, hes)
+}
+
+//GetBackupMembers get the backups made by each provider of a consistency group backup
+func GetBackupMembers(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetBackupMembers r=%v", r)
+	members, err := getGroupMembers(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+//GetChain get a backup chain and the status of its backups
+func GetChain(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetChain r=%v", r)
+	chain, err := getChain(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	chain.StartTime = localTime(chain.StartTime)
+	chain.EndTime = localTime(chain.EndTime)
+	for i := range chain.Members {
+		chain.Members[i].StartTime = localTime(chain.Members[i].StartTime)
+		chain.Members[i].EndTime = localTime(chain.Members[i].EndTime)
 	}
-	w.Write([]byte(rs))
-	logrus.Debugf("result: %s", rs)
+	writeJSON(w, http.StatusOK, chain)
+}
+
+//GetMaintenanceWindows get currently active ad hoc maintenance windows
+func GetMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetMaintenanceWindows r=%v", r)
+	windows, err := getActiveMaintenanceWindows(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	for i := range windows {
+		windows[i].StartTime = localTime(windows[i].StartTime)
+		windows[i].EndTime = localTime(windows[i].EndTime)
+	}
+	writeJSON(w, http.StatusOK, windows)
+}
+
+//CreateMaintenanceWindow open an ad hoc maintenance window starting now. Body: {"scope":"all|backup|retention", "duration":"2h", "reason":"..."}
+func CreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("CreateMaintenanceWindow r=%v", r)
+	var req struct {
+		Scope    string `json:"scope"`
+		Duration string `json:"duration"`
+		Reason   string `json:"reason"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid json body. err=%s", err), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = "all"
+	}
+	if req.Scope != "all" && req.Scope != "backup" && req.Scope != "retention" {
+		http.Error(w, "scope must be 'all', 'backup' or 'retention'", http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		http.Error(w, "duration must be a positive duration (ex.: 2h)", http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+
+	start := time.Now()
+	id, err := createMaintenanceWindow(req.Scope, start, start.Add(d), req.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	logrus.Infof("Maintenance window %d opened for %s. scope=%s reason=%s", id, d, req.Scope, req.Reason)
+	recordAudit(AuditEvent{Actor: apiActor(r), Action: "open", ObjectType: "maintenance", ObjectID: strconv.Itoa(id), After: auditValue(map[string]string{"scope": req.Scope, "duration": d.String()}), Reason: req.Reason})
+	writeJSON(w, http.StatusCreated, MaintenanceWindow{ID: id, Scope: req.Scope, StartTime: localTime(start), EndTime: localTime(start.Add(d)), Reason: req.Reason})
+}
+
+//EndMaintenanceWindow close an active ad hoc maintenance window now
+func EndMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("EndMaintenanceWindow r=%v", r)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid maintenance window id", http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	count, err := endMaintenanceWindow(id, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if count == 0 {
+		http.Error(w, "Active maintenance window not found", http.StatusNotFound)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	logrus.Infof("Maintenance window %d closed", id)
+	recordAudit(AuditEvent{Actor: apiActor(r), Action: "close", ObjectType: "maintenance", ObjectID: strconv.Itoa(id)})
+	w.WriteHeader(http.StatusOK)
+	apiInvocationsCounter.WithLabelValues("success").Inc()
+}
+
+//GetStatus get runtime status of schedules and of the current backup task
+func GetStatus(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetStatus r=%v", r)
+	status := make(map[string]interface{})
+	status["version"] = VERSION
+	status["backup_name"] = options.backupName
+	status["timezone"] = fmt.Sprintf("%s", options.location)
+
+	schedules := make(map[string]ScheduleStatus)
+	for _, name := range []string{"backup", "retention"} {
+		ss, ok := getScheduleStatus(name)
+		if ok {
+			schedules[name] = ss
+		}
+	}
+	status["schedules"] = schedules
+
+	backupID, backupStatus, backupDate, err := getCurrentTaskStatus()
+	if err == nil {
+		status["current_backup"] = map[string]interface{}{"id": backupID, "status": backupStatus, "start_time": localTime(backupDate)}
+	}
+	status["backup_queued"] = isBackupQueued()
+	status["deferred"] = map[string]bool{"backup": isTaskDeferred("backup"), "retention": isTaskDeferred("retention")}
+	status["leader"] = getLeaderStatus()
+	writeJSON(w, http.StatusOK, status)
+}
+
+//GetSchedule get pause state of backup triggering and retention
+func GetSchedule(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetSchedule r=%v", r)
+	pauses, err := getSchedulePauses()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	result := make(map[string]SchedulePause)
+	for _, scope := range []string{"backup", "retention"} {
+		p := pauses[scope]
+		if p.Paused {
+			p.PausedAt = localTime(p.PausedAt)
+		}
+		result[scope] = p
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+//PauseSchedule pause scheduled backup triggering and/or retention. Query params: scope=all|backup|retention, reason
+func PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("PauseSchedule r=%v", r)
+	changeSchedulePause(w, r, true)
+}
+
+//ResumeSchedule resume scheduled backup triggering and/or retention. Query params: scope=all|backup|retention
+func ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("ResumeSchedule r=%v", r)
+	changeSchedulePause(w, r, false)
+}
+
+func changeSchedulePause(w http.ResponseWriter, r *http.Request, paused bool) {
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = "all"
+	}
+	if scope != "all" && scope != "backup" && scope != "retention" {
+		http.Error(w, "scope must be 'all', 'backup' or 'retention'", http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	err := setSchedulePaused(scope, paused, reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if paused {
+		logrus.Infof("Scheduling paused. scope=%s reason=%s", scope, reason)
+		recordAudit(AuditEvent{Actor: apiActor(r), Action: "pause", ObjectType: "schedule", ObjectID: scope, Reason: reason})
+	} else {
+		logrus.Infof("Scheduling resumed. scope=%s", scope)
+		recordAudit(AuditEvent{Actor: apiActor(r), Action: "resume", ObjectType: "schedule", ObjectID: scope, Reason: reason})
+	}
+	GetSchedule(w, r)
+}
+
+//ExportCatalog export the backup catalog. use ?format=ndjson for one row per line
+func ExportCatalog(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("ExportCatalog r=%v", r)
+	ndjson := r.URL.Query().Get("format") == "ndjson"
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	err := exportCatalog(w, ndjson)
+	if err != nil {
+		logrus.Errorf("Error exporting catalog. err=%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	apiInvocationsCounter.WithLabelValues("success").Inc()
+}
+
+//ImportCatalog import rows of a catalog exported by another instance. existing rows are kept
+func ImportCatalog(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("ImportCatalog r=%v", r)
+	ndjson := r.URL.Query().Get("format") == "ndjson" || strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson")
+	imported, err := importCatalog(r.Body, ndjson)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	logrus.Infof("Catalog imported. rows=%v", imported)
+	recordAudit(AuditEvent{Actor: apiActor(r), Action: "import", ObjectType: "catalog", After: auditValue(imported)})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"imported": imported})
+}
+
+//GetCatalogStats get the number and size of backups in the catalog by status and of the deleted backups purged from it by month
+func GetCatalogStats(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetCatalogStats r=%v", r)
+	backups, err := getBackupStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	purged, err := getPurgedBackupStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"backups": backups, "purged": purged})
+}
+
+//GetRetentionPlan get what the next retention run would do with each available backup and the rule behind it
+func GetRetentionPlan(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetRetentionPlan r=%v", r)
+	plan, err := getRetentionPlan()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+//RunRetention run retention now. Query params: confirm=true allows deleting more than --retention-max-delete-percent of the available backups
+func RunRetention(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("RunRetention r=%v", r)
+	if desc, blocked := activeWindow("retention", time.Now()); blocked {
+		http.Error(w, fmt.Sprintf("Retention is blocked by %s", desc), http.StatusConflict)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if runningTask {
+		http.Error(w, "Retention is already running", http.StatusConflict)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	runningTask = true
+	result := triggerRetentionTask(apiActor(r), r.URL.Query().Get("confirm") == "true")
+	runningTask = false
+	writeJSON(w, http.StatusOK, result)
+}
+
+//GetTrash get the backups with status 'pending-delete' and when they will be deleted
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetTrash r=%v", r)
+	trash, err := getBackupTrash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	for i := range trash {
+		trash[i].DeleteAfter = localTime(trash[i].DeleteAfter)
+	}
+	writeJSON(w, http.StatusOK, trash)
+}
+
+//GetHolds get the legal holds in place
+func GetHolds(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetHolds r=%v", r)
+	holds, err := getBackupHolds()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	for i := range holds {
+		holds[i].CreatedAt = localTime(holds[i].CreatedAt)
+	}
+	writeJSON(w, http.StatusOK, holds)
+}
+
+//CreateHold place a legal hold on a backup or on the backups matching a label selector. Body: {"backup_id":"..."|"selector":"env=prod", "reason":"..."}
+func CreateHold(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("CreateHold r=%v", r)
+	var h BackupHold
+	err := json.NewDecoder(r.Body).Decode(&h)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid json body. err=%s", err), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	err = validateHold(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	h.ID = 0
+	h.CreatedBy = apiActor(r)
+	h, err = placeHold(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	h.CreatedAt = localTime(h.CreatedAt)
+	writeJSON(w, http.StatusCreated, h)
+}
+
+//ReleaseHold remove a legal hold. Query params: reason
+func ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("ReleaseHold r=%v", r)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid hold id", http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	ok, err := releaseHold(id, apiActor(r), r.URL.Query().Get("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if !ok {
+		http.Error(w, "Hold not found", http.StatusNotFound)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	apiInvocationsCounter.WithLabelValues("success").Inc()
+}
+
+//GetAudit get events of the audit log, newest first. Query params: actor, action, object_type, object_id, since, until (RFC3339), limit
+func GetAudit(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("GetAudit r=%v", r)
+	q := r.URL.Query()
+	filter := AuditFilter{Actor: q.Get("actor"), Action: q.Get("action"), ObjectType: q.Get("object_type"), ObjectID: q.Get("object_id"), Limit: 100}
+	var err error
+	if q.Get("since") != "" {
+		filter.Since, err = time.Parse(time.RFC3339, q.Get("since"))
+	}
+	if err == nil && q.Get("until") != "" {
+		filter.Until, err = time.Parse(time.RFC3339, q.Get("until"))
+	}
+	if err != nil {
+		http.Error(w, "since and until must be RFC3339 times (ex.: 2019-05-01T10:00:00Z)", http.StatusBadRequest)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	if q.Get("limit") != "" {
+		filter.Limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || filter.Limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			apiInvocationsCounter.WithLabelValues("error").Inc()
+			return
+		}
+	}
+	events, err := getAuditEvents(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	for i := range events {
+		events[i].Time = localTime(events[i].Time)
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiInvocationsCounter.WithLabelValues("error").Inc()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	logrus.Debugf("result: %s", b)
 	apiInvocationsCounter.WithLabelValues("success").Inc()
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//uses an empty database for tests that would leave rows affecting other tests
+func initTestDB(t *testing.T) {
+	dir, err := ioutil.TempDir(options.dataDir, "db")
+	assert.Nil(t, err, "err")
+	options.dataDir = dir
+	initDB()
+}
+
+func getBackupsAPI(t *testing.T, query url.Values) (int, []BackupResponse) {
+	req := httptest.NewRequest("GET", "/backups?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	backups := make([]BackupResponse, 0)
+	if rec.Code == http.StatusOK {
+		err := json.Unmarshal(rec.Body.Bytes(), &backups)
+		assert.Nilf(t, err, "invalid json %s", rec.Body.String())
+	}
+	return rec.Code, backups
+}
+
+func TestGetBackupsHostileInput(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	_, err := createMaterializedBackup("hostile-1", "d1", "hostile", time.Now(), time.Now(), `"},{"injected":"`, 0)
+	assert.Nil(t, err, "err")
+	_, err = createMaterializedBackup("x' OR '1'='1", "d2", "hostile", time.Now(), time.Now(), "", 0)
+	assert.Nil(t, err, "err")
+
+	code, _ := getBackupsAPI(t, url.Values{"tag": {"1=1 OR 1"}})
+	assert.Equal(t, http.StatusBadRequest, code, "tag injection rejected")
+	code, _ = getBackupsAPI(t, url.Values{"tag": {"daily=1; DROP TABLE materialized_backup; --"}})
+	assert.Equal(t, http.StatusBadRequest, code, "tag injection rejected")
+
+	code, backups := getBackupsAPI(t, url.Values{"status": {"x' OR '1'='1"}})
+	assert.Equal(t, http.StatusOK, code, "status")
+	assert.Equal(t, 0, len(backups), "status injection matches nothing")
+
+	code, backups = getBackupsAPI(t, url.Values{"status": {"hostile"}})
+	assert.Equal(t, http.StatusOK, code, "status")
+	assert.Equal(t, 2, len(backups), "table still there")
+	ids := []string{backups[0].ID, backups[1].ID}
+	assert.Contains(t, ids, "x' OR '1'='1", "hostile id returned as data")
+	for _, b := range backups {
+		if b.ID == "hostile-1" {
+			assert.Equal(t, `"},{"injected":"`, b.CustomData, "custom data escaped")
+		}
+	}
+
+	code, backups = getBackupsAPI(t, url.Values{"status": {"hostile"}, "tag": {"daily"}})
+	assert.Equal(t, http.StatusOK, code, "valid tag")
+	assert.Equal(t, 0, len(backups), "no daily backups")
+}
+
+func TestGetMaterializedBackupHostileID(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	_, err := createMaterializedBackup("safe-1", "d1", "available", time.Now(), time.Now(), "", 0)
+	assert.Nil(t, err, "err")
+	_, err = getMaterializedBackup("x' OR '1'='1")
+	assert.NotNil(t, err, "hostile id not found")
+	b, err := getMaterializedBackup("safe-1")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "safe-1", b.ID, "id")
+
+	_, err = getExclusiveTagAvailableMaterializedBackups("daily=1 OR 1", 0, 10)
+	assert.NotNil(t, err, "invalid tag")
+	_, err = getMaterializedBackups(0, "status", "", false)
+	assert.NotNil(t, err, "invalid tag")
+}
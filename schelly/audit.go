@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//actors of audit events that are not API clients
+const (
+	actorCron   = "cron"
+	actorSystem = "system"
+)
+
+//METRICS
+var auditEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_audit_event_total",
+	Help: "Total events recorded in the audit log",
+}, []string{
+	"action",
+	"status",
+})
+
+//AuditEvent a state-changing action recorded in the append-only audit log
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	ObjectType string    `json:"object_type"`
+	ObjectID   string    `json:"object_id"`
+	Before     string    `json:"before"`
+	After      string    `json:"after"`
+	Reason     string    `json:"reason"`
+}
+
+//AuditFilter filters for querying the audit log. empty fields match anything
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	ObjectType string
+	ObjectID   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+func initAudit() {
+	prometheus.MustRegister(auditEventCounter)
+}
+
+//recordAudit appends an event to the audit log. failures are logged and don't stop the audited action
+func recordAudit(e AuditEvent) {
+	err := createAuditEvent(nil, e)
+	if err != nil {
+		logrus.Errorf("Couldn't record audit event. event=%v err=%s", e, err)
+		auditEventCounter.WithLabelValues(e.Action, "error").Inc()
+		return
+	}
+	auditEventCounter.WithLabelValues(e.Action, "success").Inc()
+}
+
+//apiActor identifies the client of an API request for the audit log: the basic auth user, the X-Schelly-Actor header
+//or, when none is sent, the client address. Schelly doesn't authenticate the user or the header, so the client address
+//is recorded with them as 'api:{user}@{address}'
+func apiActor(r *http.Request) string {
+	address := clientAddress(r)
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return "api:" + user + "@" + address
+	}
+	if actor := strings.TrimSpace(r.Header.Get("X-Schelly-Actor")); actor != "" {
+		return "api:" + actor + "@" + address
+	}
+	return "api:" + address
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//auditValue encodes a before/after value of an audit event as json
+func auditValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+//auditedConfig the options whose changes are recorded in the audit log
+func auditedConfig() string {
+	config := map[string]interface{}{
+		"backup_cron":                  options.backupCron,
+		"retention_cron":               options.retentionCron,
+		"webhook_url":                  strings.Join(options.webhookURLs, ","),
+		"grace_time_seconds":           options.graceTimeSeconds,
+		"purge_deleted_days":           options.purgeDeletedDays,
+		"purge_mode":                   options.purgeMode,
+		"retention_keep_within":        options.retentionKeepWithin.String(),
+		"retention_quota_mb":           options.retentionQuotaMB,
+		"retention_min_available":      options.retentionMinAvailable,
+		"retention_max_backup_age":     options.retentionMaxBackupAge.String(),
+		"retention_max_deletes":        options.retentionMaxDeletes,
+		"retention_max_delete_percent": options.retentionMaxDeletePercent,
+		"retention_delete_concurrency": options.retentionDeleteConcurrency,
+		"retention_delete_rate":        options.retentionDeleteRate,
+		"retention_trash_period":       options.retentionTrashPeriod.String(),
+		"worm_period":                  options.wormPeriod.String(),
+	}
+	for _, t := range retentionTiers() {
+		config["retention_"+t.name] = strings.Join(t.params, "@")
+	}
+	return auditValue(config)
+}
+
+//auditConfigChange records the configuration Schelly started with when it differs from the last one recorded
+func auditConfigChange() {
+	config := auditedConfig()
+	events, err := getAuditEvents(AuditFilter{Action: "config", ObjectType: "config", Limit: 1})
+	if err != nil {
+		logrus.Warnf("Couldn't get last configuration from audit log. err=%s", err)
+		return
+	}
+	before := ""
+	if len(events) > 0 {
+		before = events[0].After
+	}
+	if before == config {
+		return
+	}
+	logrus.Infof("Configuration changed since last start. Recording it in the audit log")
+	recordAudit(AuditEvent{Actor: actorSystem, Action: "config", ObjectType: "config", ObjectID: options.backupName, Before: before, After: config, Reason: "started with new configuration"})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getAuditAPI(t *testing.T, query url.Values) (int, []AuditEvent) {
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/audit?"+query.Encode(), nil))
+	events := make([]AuditEvent, 0)
+	if rec.Code == http.StatusOK {
+		err := json.Unmarshal(rec.Body.Bytes(), &events)
+		assert.Nilf(t, err, "invalid json %s", rec.Body.String())
+	}
+	return rec.Code, events
+}
+
+func TestAuditStatusChange(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	_, err := createMaterializedBackup("audit-1", "d1", "available", time.Now(), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+	_, err = createMaterializedBackup("audit-2", "d2", "available", time.Now(), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+
+	_, err = setStatusMaterializedBackup("audit-1", "deleting", actorCron, "retention: backup has no retention tags")
+	assert.Nil(t, err, "err")
+	_, err = setStatusMaterializedBackup("audit-1", "deleted", actorCron, "deleted on provider")
+	assert.Nil(t, err, "err")
+	_, err = setStatusMaterializedBackup("audit-2", "deleting", "api:alice", "")
+	assert.Nil(t, err, "err")
+	_, err = setStatusMaterializedBackup("unknown", "deleting", actorCron, "")
+	assert.Nil(t, err, "err")
+
+	code, events := getAuditAPI(t, url.Values{"object_id": {"audit-1"}})
+	assert.Equal(t, http.StatusOK, code, "status")
+	assert.Equal(t, 2, len(events), "events of backup")
+	assert.Equal(t, "deleting", events[0].Before, "newest first")
+	assert.Equal(t, "deleted", events[0].After, "after")
+	assert.Equal(t, "available", events[1].Before, "before")
+	assert.Equal(t, "retention: backup has no retention tags", events[1].Reason, "reason")
+	assert.Equal(t, actorCron, events[1].Actor, "actor")
+
+	_, events = getAuditAPI(t, url.Values{"actor": {"api:alice"}})
+	assert.Equal(t, 1, len(events), "events of actor")
+	assert.Equal(t, "audit-2", events[0].ObjectID, "object")
+
+	_, events = getAuditAPI(t, url.Values{"action": {"status"}, "limit": {"1"}})
+	assert.Equal(t, 1, len(events), "limit")
+	_, events = getAuditAPI(t, url.Values{"since": {time.Now().Add(time.Hour).Format(time.RFC3339)}})
+	assert.Equal(t, 0, len(events), "since")
+	_, events = getAuditAPI(t, url.Values{"until": {time.Now().Add(-time.Hour).Format(time.RFC3339)}})
+	assert.Equal(t, 0, len(events), "until")
+
+	code, _ = getAuditAPI(t, url.Values{"since": {"yesterday"}})
+	assert.Equal(t, http.StatusBadRequest, code, "invalid since")
+	code, _ = getAuditAPI(t, url.Values{"limit": {"0"}})
+	assert.Equal(t, http.StatusBadRequest, code, "invalid limit")
+}
+
+func TestAuditTagChanges(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "0@0", "hourly": "0@0", "daily": "0@0", "weekly": "0@0", "monthly": "0@1", "yearly": "0@1"}, "")
+	ti := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+	_, err := createMaterializedBackup("tags-1", "d1", "available", ti, ti, "", 1)
+	assert.Nil(t, err, "err")
+	err = tagAllBackups()
+	assert.Nil(t, err, "err")
+	events, _ := getAuditEvents(AuditFilter{Action: "tags"})
+	assert.Equal(t, 1, len(events), "tag change recorded")
+	assert.Equal(t, "", events[0].Before, "before")
+	assert.Equal(t, "minutely,hourly,daily,weekly,monthly,yearly", events[0].After, "after")
+
+	err = tagAllBackups()
+	assert.Nil(t, err, "err")
+	events, _ = getAuditEvents(AuditFilter{Action: "tags"})
+	assert.Equal(t, 1, len(events), "unchanged tags not recorded")
+}
+
+func TestAuditAPIActor(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+
+	req := httptest.NewRequest("POST", "/schedule/pause?scope=backup&reason=upgrade", nil)
+	req.Header.Set("X-Schelly-Actor", "deploy-bot")
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("POST", "/schedule/resume?scope=backup", nil)
+	req.SetBasicAuth("alice", "secret")
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+	events, _ := getAuditEvents(AuditFilter{ObjectType: "schedule"})
+	assert.Equal(t, 2, len(events), "events")
+	assert.Equal(t, "api:alice@192.0.2.1", events[0].Actor, "basic auth user with the client address")
+	assert.Equal(t, "resume", events[0].Action, "action")
+	assert.Equal(t, "api:deploy-bot@192.0.2.1", events[1].Actor, "header actor with the client address")
+	assert.Equal(t, "upgrade", events[1].Reason, "reason")
+	events, _ = getAuditEvents(AuditFilter{Actor: "api:alice"})
+	assert.Equal(t, 1, len(events), "filter by the claimed actor")
+
+	req = httptest.NewRequest("GET", "/audit", nil)
+	req.RemoteAddr = "10.1.2.3:4567"
+	assert.Equal(t, "api:10.1.2.3", apiActor(req), "client address")
+}
+
+func TestAuditConfigChange(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"daily": "4@L"}, "")
+	auditConfigChange()
+	auditConfigChange()
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"daily": "7@L"}, "")
+	auditConfigChange()
+
+	events, _ := getAuditEvents(AuditFilter{ObjectType: "config"})
+	assert.Equal(t, 2, len(events), "only changes recorded")
+	assert.Equal(t, events[1].After, events[0].Before, "before is the previous config")
+	assert.Contains(t, events[0].After, `"retention_daily":"7@23"`, "after")
+	assert.Equal(t, actorSystem, events[0].Actor, "actor")
+}
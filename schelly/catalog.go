@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var catalogSnapshotCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_catalog_snapshot_total",
+	Help: "Total catalog snapshots taken",
+}, []string{
+	"status",
+})
+
+type catalogTable struct {
+	name        string
+	timeColumns []string
+}
+
+//tables exported and imported with the catalog. rows are identified by their primary keys, so importing a row that already exists keeps the existing one
+var catalogTables = []catalogTable{
+	{"materialized_backup", []string{"start_time", "end_time"}},
+	{"backup_group_member", []string{}},
+	{"backup_chain", []string{"start_time", "end_time"}},
+	{"backup_chain_member", []string{"start_time", "end_time"}},
+	{"materialized_backup_archive", []string{"start_time", "end_time", "archived_at"}},
+	{"purged_backup_stats", []string{}},
+	{"backup_label", []string{}},
+	{"backup_tag", []string{}},
+	{"backup_expiry", []string{"expires_at"}},
+	{"backup_trash", []string{"delete_after"}},
+}
+
+//CatalogExport catalog contents exported by GET /admin/catalog/export
+type CatalogExport struct {
+	SchemaVersion int                                 `json:"schema_version"`
+	ExportedAt    time.Time                           `json:"exported_at"`
+	Tables        map[string][]map[string]interface{} `json:"tables"`
+}
+
+//catalogRow a line of the NDJSON catalog export
+type catalogRow struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+func initCatalog() {
+	prometheus.MustRegister(catalogSnapshotCounter)
+}
+
+//snapshotCatalog takes a consistent snapshot of the catalog into the snapshot dir and removes snapshots beyond the configured retention
+func snapshotCatalog() {
+	dir := options.catalogSnapshotDir
+	if dir == "" {
+		dir = fmt.Sprintf("%s/snapshots", options.dataDir)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		logrus.Errorf("Couldn't create catalog snapshot dir %s. err=%s", dir, err)
+		catalogSnapshotCounter.WithLabelValues("error").Inc()
+		return
+	}
+
+	file, err := storage.snapshot(db, fmt.Sprintf("%s/catalog-%s", dir, time.Now().UTC().Format("20060102T150405.000")))
+	if err != nil {
+		logrus.Errorf("Couldn't take catalog snapshot. err=%s", err)
+		catalogSnapshotCounter.WithLabelValues("error").Inc()
+		return
+	}
+	logrus.Infof("Catalog snapshot saved to %s", file)
+	catalogSnapshotCounter.WithLabelValues("success").Inc()
+
+	files, err := filepath.Glob(fmt.Sprintf("%s/catalog-*", dir))
+	if err != nil {
+		logrus.Warnf("Couldn't list catalog snapshots. err=%s", err)
+		return
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	for i, f := range files {
+		if i < options.catalogSnapshotRetention {
+			continue
+		}
+		logrus.Debugf("Removing old catalog snapshot %s", f)
+		err = os.Remove(f)
+		if err != nil {
+			logrus.Warnf("Couldn't remove old catalog snapshot %s. err=%s", f, err)
+		}
+	}
+}
+
+//exportCatalog writes the catalog tables as a single JSON document or as NDJSON, one row per line
+func exportCatalog(w io.Writer, ndjson bool) error {
+	version, err := storage.schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	export := CatalogExport{SchemaVersion: version, ExportedAt: time.Now().UTC(), Tables: make(map[string][]map[string]interface{})}
+	enc := json.NewEncoder(w)
+	if ndjson {
+		err = enc.Encode(map[string]interface{}{"schema_version": export.SchemaVersion, "exported_at": export.ExportedAt})
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range catalogTables {
+		export.Tables[t.name] = make([]map[string]interface{}, 0)
+		err = readCatalogTable(t, func(row map[string]interface{}) error {
+			if ndjson {
+				return enc.Encode(catalogRow{Table: t.name, Row: row})
+			}
+			export.Tables[t.name] = append(export.Tables[t.name], row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if ndjson {
+		return nil
+	}
+	return enc.Encode(export)
+}
+
+func readCatalogTable(t catalogTable, each func(row map[string]interface{}) error) error {
+	rows, err := stmts["exportCatalog."+t.name].Query()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return err
+		}
+		row := make(map[string]interface{})
+		for i, c := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[c] = values[i]
+		}
+		err = each(row)
+		if err != nil {
+			return err
+		}
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return rows.Err()
+}
+
+//importCatalog reads a catalog exported by exportCatalog (JSON or NDJSON) and inserts its rows in a single transaction.
+//rows that already exist are kept. returns the number of rows imported by table
+func importCatalog(r io.Reader, ndjson bool) (map[string]int, error) {
+	tables := make(map[string][]map[string]interface{})
+	if ndjson {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			row := catalogRow{}
+			dec := json.NewDecoder(strings.NewReader(line))
+			dec.UseNumber()
+			err := dec.Decode(&row)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid NDJSON line. err=%s", err)
+			}
+			if row.Table == "" {
+				continue
+			}
+			tables[row.Table] = append(tables[row.Table], row.Row)
+		}
+		err := scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		export := CatalogExport{}
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		err := dec.Decode(&export)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON. err=%s", err)
+		}
+		tables = export.Tables
+	}
+
+	known := make(map[string]catalogTable)
+	for _, t := range catalogTables {
+		known[t.name] = t
+	}
+	for name := range tables {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("Unknown catalog table '%s'", name)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	imported := make(map[string]int)
+	for _, t := range catalogTables {
+		n, err := importCatalogTable(tx, t, tables[t.name])
+		if err != nil {
+			tx.Rollback()
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, fmt.Errorf("Couldn't import %s. err=%s", t.name, err)
+		}
+		imported[t.name] = n
+	}
+	err = tx.Commit()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return imported, nil
+}
+
+func importCatalogTable(tx *sql.Tx, t catalogTable, rows []map[string]interface{}) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	cr, err := stmts["catalogColumns."+t.name].Query()
+	if err != nil {
+		return 0, err
+	}
+	columns, err := cr.Columns()
+	cr.Close()
+	if err != nil {
+		return 0, err
+	}
+	validColumns := make(map[string]bool)
+	for _, c := range columns {
+		validColumns[c] = true
+	}
+
+	count := 0
+	for _, row := range rows {
+		//column names are never taken from the input unless they exist in the table
+		cols := make([]string, 0)
+		for c := range row {
+			if !validColumns[c] {
+				return count, fmt.Errorf("Unknown column '%s'", c)
+			}
+			cols = append(cols, c)
+		}
+		sort.Strings(cols)
+		args := make([]interface{}, 0)
+		for _, c := range cols {
+			v, err := importValue(t, c, row[c])
+			if err != nil {
+				return count, err
+			}
+			args = append(args, v)
+		}
+		res, err := tx.Exec(storage.insertIgnore(t.name, cols), args...)
+		if err != nil {
+			return count, err
+		}
+		n, _ := res.RowsAffected()
+		count = count + int(n)
+	}
+	return count, nil
+}
+
+func importValue(t catalogTable, column string, value interface{}) (interface{}, error) {
+	if n, ok := value.(json.Number); ok {
+		i, err := n.Int64()
+		if err == nil {
+			return i, nil
+		}
+		return n.Float64()
+	}
+	s, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+	for _, tc := range t.timeColumns {
+		if tc == column {
+			ti, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid time '%s' for %s. err=%s", s, column, err)
+			}
+			return ti.UTC(), nil
+		}
+	}
+	return s, nil
+}
+
+//writes the catalog export to a file. used for snapshots of storages without a native backup
+func exportCatalogFile(file string) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = exportCatalog(w, true)
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
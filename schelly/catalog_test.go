@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogSnapshot(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	_, err := createMaterializedBackup("snap-1", "d1", "available", time.Now(), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+
+	options.catalogSnapshotRetention = 2
+	for i := 0; i < 3; i++ {
+		snapshotCatalog()
+		time.Sleep(5 * time.Millisecond)
+	}
+	files, _ := filepath.Glob(options.dataDir + "/snapshots/catalog-*.db")
+	assert.Equal(t, 2, len(files), "old snapshots removed")
+
+	snap, err := sql.Open("sqlite3", files[len(files)-1])
+	assert.Nil(t, err, "err")
+	defer snap.Close()
+	id := ""
+	err = snap.QueryRow("SELECT id FROM materialized_backup").Scan(&id)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "snap-1", id, "backup in snapshot")
+}
+
+func TestCatalogExportImport(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	ti := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{"json", "ndjson"} {
+		initTestDB(t)
+		_, err := createMaterializedBackup("exp-1", "d1", "available", ti, ti.Add(time.Minute), "x", 12.5)
+		assert.Nil(t, err, "err")
+		_, err = createMaterializedBackup("exp-2", "d2", "deleted", ti, ti, "", 1)
+		assert.Nil(t, err, "err")
+		err = saveGroupMember("exp-1", GroupMember{ProviderURL: "http://a", BackupID: "a1", Status: "available"})
+		assert.Nil(t, err, "err")
+		tx, _ := db.Begin()
+		_, err = setAllTagsMaterializedBackup(tx, "exp-1")
+		assert.Nil(t, err, "err")
+		tx.Commit()
+
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/admin/catalog/export?format="+format, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, format)
+		exported := rec.Body.Bytes()
+
+		//import into another instance that already has one of the backups
+		initTestDB(t)
+		_, err = createMaterializedBackup("exp-2", "d2", "available", ti, ti, "", 1)
+		assert.Nil(t, err, "err")
+		rec = httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/admin/catalog/import?format="+format, bytes.NewReader(exported)))
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		result := make(map[string]map[string]int)
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		assert.Equal(t, 1, result["imported"]["materialized_backup"], format+" imported")
+		assert.Equal(t, 1, result["imported"]["backup_group_member"], format+" imported")
+
+		b, err := getMaterializedBackup("exp-1")
+		assert.Nil(t, err, "err")
+		assert.Equal(t, 12.5, b.SizeMB, "size")
+		assert.Equal(t, "x", b.CustomData, "custom data")
+		assert.True(t, ti.Equal(b.StartTime), "start time")
+		b, _ = getMaterializedBackup("exp-2")
+		assert.Equal(t, "available", b.Status, "existing row kept")
+		members, _ := getGroupMembers("exp-1")
+		assert.Equal(t, 1, len(members), "group members")
+		tags, _ := getBackupTags("exp-1")
+		assert.Equal(t, len(retentionTiers()), len(tags), "tags")
+	}
+}
+
+func TestCatalogImportHostileInput(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	_, err := importCatalog(strings.NewReader(`{"tables":{"sqlite_master":[{"name":"x"}]}}`), false)
+	assert.NotNil(t, err, "unknown table")
+	_, err = importCatalog(strings.NewReader(`{"tables":{"materialized_backup":[{"id":"h","data_id":"h","status":"available","start_time":"2019-01-01T00:00:00Z","status) values('a','a','a','2019-01-01');--":"x"}]}}`), false)
+	assert.NotNil(t, err, "unknown column")
+	_, err = importCatalog(strings.NewReader(`{"tables":{"materialized_backup":[{"id":"h","data_id":"h","status":"available","start_time":"yesterday"}]}}`), false)
+	assert.NotNil(t, err, "invalid time")
+	backups, _ := getMaterializedBackups(0, "", "", false)
+	assert.Equal(t, 0, len(backups), "nothing imported")
+}
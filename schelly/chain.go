@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var chainMemberCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_chain_member_total",
+	Help: "Total chained backups by final status",
+}, []string{
+	// origin, self or downstream
+	"role",
+	"status",
+})
+
+//BackupChain group of backups from several Schelly instances triggered one after the other
+type BackupChain struct {
+	ID        string              `json:"chain_id"`
+	Status    string              `json:"status"`
+	StartTime time.Time           `json:"start_time"`
+	EndTime   time.Time           `json:"end_time"`
+	Members   []BackupChainMember `json:"members"`
+}
+
+//BackupChainMember a backup that is part of a chain. Member is the backup name for backups made by this instance
+//and the Schelly URL for downstream instances
+type BackupChainMember struct {
+	Member    string    `json:"member"`
+	Role      string    `json:"role"`
+	BackupID  string    `json:"backup_id"`
+	Status    string    `json:"status"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Message   string    `json:"message"`
+}
+
+func initChain() {
+	prometheus.MustRegister(chainMemberCounter)
+}
+
+//joinChain registers a backup triggered by an upstream Schelly instance as part of its chain
+func joinChain(chainID string, backupID string, status string) error {
+	err := createChain(chainID, time.Now())
+	if err != nil {
+		return err
+	}
+	return saveChainMember(chainID, BackupChainMember{Member: options.backupName, Role: "self", BackupID: backupID, Status: status, StartTime: time.Now()})
+}
+
+//joinChainWithTrigger registers the result of a backup triggered by upstream as part of chain. A skipped, queued or aborted
+//trigger didn't start a backup for the chain, so no backup is registered for it. A queued backup joins the chain when it starts
+func joinChainWithTrigger(chainID string, upstream string, result ResponseWebhook) {
+	backupID := result.ID
+	status := result.Status
+	if status == "skipped" || status == "queued" || status == "aborted" {
+		//the id of a skipped or queued trigger is the backup that was already running
+		backupID = ""
+	} else if status != "running" {
+		status = "error"
+	}
+	logrus.Infof("Backup %s triggered by upstream %s as part of chain %s. status=%s", backupID, upstream, chainID, result.Status)
+	err := joinChain(chainID, backupID, status)
+	if err != nil {
+		logrus.Errorf("Couldn't register backup %s in chain %s. err=%s", backupID, chainID, err)
+	}
+	if status != "running" && status != "queued" {
+		chainMemberCounter.WithLabelValues("self", status).Inc()
+		updateChainStatus(chainID)
+	}
+}
+
+//onChainBackupFinished updates the chain of a backup started by this instance when it is done and triggers downstream backups
+func onChainBackupFinished(backupID string, status string) {
+	chainID, role, found, err := getChainOfBackup(backupID)
+	if err != nil {
+		logrus.Errorf("Couldn't query chain of backup %s. err=%s", backupID, err)
+		return
+	}
+
+	if found {
+		logrus.Infof("Backup %s of chain %s finished. status=%s", backupID, chainID, status)
+		err = setChainMemberStatus(chainID, options.backupName, status, "", time.Now())
+		if err != nil {
+			logrus.Errorf("Couldn't update chain %s. err=%s", chainID, err)
+		}
+		chainMemberCounter.WithLabelValues(role, status).Inc()
+	} else if status == "available" && len(options.chainDownstreamURLs) > 0 {
+		chainID = fmt.Sprintf("%s-%s", options.backupName, backupID)
+		logrus.Infof("Starting backup chain %s", chainID)
+		err = createChain(chainID, time.Now())
+		if err == nil {
+			err = saveChainMember(chainID, BackupChainMember{Member: options.backupName, Role: "origin", BackupID: backupID, Status: status, StartTime: time.Now(), EndTime: time.Now()})
+		}
+		if err != nil {
+			logrus.Errorf("Couldn't create chain %s. err=%s", chainID, err)
+			return
+		}
+		chainMemberCounter.WithLabelValues("origin", status).Inc()
+		found = true
+	}
+
+	if found {
+		if status == "available" {
+			triggerDownstreams(chainID)
+		}
+		updateChainStatus(chainID)
+	}
+}
+
+//triggerDownstreams asks downstream Schelly instances to start their backups as part of chain
+func triggerDownstreams(chainID string) {
+	body, _ := json.Marshal(map[string]string{"chain_id": chainID, "upstream": options.backupName})
+	for _, url := range options.chainDownstreamURLs {
+		m := BackupChainMember{Member: url, Role: "downstream", StartTime: time.Now()}
+		resp, data, err := postHTTP(url+"/backups", string(body))
+		if err != nil {
+			m.Status = "error"
+			m.Message = fmt.Sprintf("Couldn't trigger downstream backup. err=%s", err)
+		} else if resp.StatusCode != 200 && resp.StatusCode != 202 {
+			m.Status = "error"
+			m.Message = fmt.Sprintf("Couldn't trigger downstream backup. status=%d", resp.StatusCode)
+		} else {
+			var r ResponseWebhook
+			err = json.Unmarshal(data, &r)
+			if err != nil {
+				m.Status = "error"
+				m.Message = fmt.Sprintf("Invalid downstream response. err=%s", err)
+			} else if r.Status != "running" {
+				m.Status = "error"
+				m.BackupID = r.ID
+				m.Message = fmt.Sprintf("Downstream backup not started. status=%s message=%s", r.Status, r.Message)
+			} else {
+				m.Status = "running"
+				m.BackupID = r.ID
+			}
+		}
+		if m.Status == "running" {
+			logrus.Infof("Downstream backup %s triggered on %s for chain %s", m.BackupID, url, chainID)
+		} else {
+			logrus.Warnf("Downstream backup on %s for chain %s failed. %s", url, chainID, m.Message)
+			m.EndTime = time.Now()
+			chainMemberCounter.WithLabelValues("downstream", m.Status).Inc()
+		}
+		err = saveChainMember(chainID, m)
+		if err != nil {
+			logrus.Errorf("Couldn't save downstream member %s of chain %s. err=%s", url, chainID, err)
+		}
+	}
+}
+
+//checkChains polls downstream Schelly instances for the status of chained backups that are still running
+func checkChains() {
+	members, err := getRunningDownstreamMembers()
+	if err != nil {
+		logrus.Errorf("Couldn't query running chain members. err=%s", err)
+		return
+	}
+	for chainID, ms := range members {
+		for _, m := range ms {
+			status, message := getDownstreamStatus(m.Member, chainID)
+			if status == "running" && time.Now().Sub(m.StartTime) > options.chainTimeout {
+				status = "timeout"
+				message = fmt.Sprintf("Downstream backup didn't finish in %s", options.chainTimeout)
+			}
+			if status == "running" {
+				continue
+			}
+			logrus.Infof("Downstream backup %s on %s for chain %s finished. status=%s %s", m.BackupID, m.Member, chainID, status, message)
+			chainMemberCounter.WithLabelValues("downstream", status).Inc()
+			err = setChainMemberStatus(chainID, m.Member, status, message, time.Now())
+			if err != nil {
+				logrus.Errorf("Couldn't update chain %s. err=%s", chainID, err)
+			}
+		}
+		updateChainStatus(chainID)
+	}
+}
+
+//returns status, message of the chained backup on a downstream Schelly
+func getDownstreamStatus(url string, chainID string) (string, string) {
+	resp, data, err := getHTTP(fmt.Sprintf("%s/chains/%s", url, chainID))
+	if err != nil {
+		logrus.Warnf("Couldn't get chain %s status from %s. err=%s", chainID, url, err)
+		return "running", ""
+	}
+	if resp.StatusCode != 200 {
+		logrus.Warnf("Couldn't get chain %s status from %s. status=%d", chainID, url, resp.StatusCode)
+		return "running", ""
+	}
+	var chain BackupChain
+	err = json.Unmarshal(data, &chain)
+	if err != nil {
+		logrus.Warnf("Invalid chain %s response from %s. err=%s", chainID, url, err)
+		return "running", ""
+	}
+	for _, m := range chain.Members {
+		if m.Role == "self" {
+			//a queued backup is started by the downstream when its running backup finishes
+			if m.Status == "queued" {
+				return "running", m.Message
+			}
+			return m.Status, m.Message
+		}
+	}
+	return "running", ""
+}
+
+//updateChainStatus sets chain status from its members. A chain is 'available' when all members are available. When a member fails,
+//the chain is 'failed' with the 'fail' policy, or 'partial' after all members finished with the 'ignore' policy
+func updateChainStatus(chainID string) {
+	chain, err := getChain(chainID)
+	if err != nil {
+		logrus.Errorf("Couldn't get chain %s. err=%s", chainID, err)
+		return
+	}
+	if chain.Status != "running" {
+		return
+	}
+	running := 0
+	failed := 0
+	for _, m := range chain.Members {
+		if m.Status == "running" || m.Status == "queued" {
+			running++
+		} else if m.Status != "available" {
+			failed++
+		}
+	}
+
+	status := "running"
+	if failed > 0 && options.chainFailurePolicy == "fail" {
+		status = "failed"
+	} else if running == 0 && failed > 0 {
+		status = "partial"
+	} else if running == 0 && failed == 0 {
+		status = "available"
+	}
+	if status == "running" {
+		return
+	}
+	if status == "available" {
+		logrus.Infof("Backup chain %s finished. status=%s", chainID, status)
+	} else {
+		logrus.Warnf("Backup chain %s finished. status=%s", chainID, status)
+		overallBackupWarnCounter.WithLabelValues("error").Inc()
+	}
+	err = setChainStatus(chainID, status, time.Now())
+	if err != nil {
+		logrus.Errorf("Couldn't update chain %s status. err=%s", chainID, err)
+	}
+}
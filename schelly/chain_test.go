@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainDownstream(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+
+	downstreamStatus := "running"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.WriteHeader(200)
+			w.Write([]byte(`{"id":"d1","status":"running"}`))
+			return
+		}
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/chains/db-b1"), "chain id")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"chain_id":"db-b1","members":[{"member":"files","role":"self","backup_id":"d1","status":"` + downstreamStatus + `"}]}`))
+	}))
+	defer server.Close()
+
+	options.backupName = "db"
+	options.chainDownstreamURLs = []string{server.URL}
+	options.chainTimeout = time.Hour
+	options.chainFailurePolicy = "fail"
+
+	onChainBackupFinished("b1", "available")
+	chain, err := getChain("db-b1")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "running", chain.Status, "chain running")
+	assert.Equal(t, 2, len(chain.Members), "members")
+	assert.Equal(t, "origin", chain.Members[0].Role, "origin")
+	assert.Equal(t, "d1", chain.Members[1].BackupID, "downstream backup")
+
+	checkChains()
+	chain, _ = getChain("db-b1")
+	assert.Equal(t, "running", chain.Status, "downstream still running")
+
+	downstreamStatus = "available"
+	checkChains()
+	chain, _ = getChain("db-b1")
+	assert.Equal(t, "available", chain.Status, "chain available")
+	assert.Equal(t, "available", chain.Members[1].Status, "downstream available")
+}
+
+func TestChainTimeout(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.Write([]byte(`{"id":"d2","status":"running"}`))
+			return
+		}
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	options.backupName = "db"
+	options.chainDownstreamURLs = []string{server.URL}
+	options.chainTimeout = 0
+	options.chainFailurePolicy = "fail"
+
+	onChainBackupFinished("b2", "available")
+	checkChains()
+	chain, _ := getChain("db-b2")
+	assert.Equal(t, "failed", chain.Status, "chain failed")
+	assert.Equal(t, "timeout", chain.Members[1].Status, "downstream timeout")
+}
+
+func TestChainJoin(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+	options.backupName = "files"
+	options.chainDownstreamURLs = []string{}
+
+	err := joinChain("db-b3", "f1", "running")
+	assert.Nil(t, err, "err")
+	onChainBackupFinished("f1", "available")
+	chain, _ := getChain("db-b3")
+	assert.Equal(t, "available", chain.Status, "chain available")
+	assert.Equal(t, "self", chain.Members[0].Role, "self")
+	assert.Equal(t, "available", chain.Members[0].Status, "self available")
+}
+
+func TestChainJoinOnOverlap(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"f-queued","status":"running"}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.webhookURLs = []string{server.URL}
+	options.backupName = "files"
+	options.chainDownstreamURLs = []string{}
+	options.chainFailurePolicy = "fail"
+	setBackupQueued(false)
+	setCurrentTaskStatus("f-running", "running", time.Now())
+
+	trigger := func(chainID string) {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"chain_id":"`+chainID+`","upstream":"db"}`)))
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	options.overlapPolicy = "skip"
+	trigger("db-s1")
+	chain, _ := getChain("db-s1")
+	assert.Equal(t, "", chain.Members[0].BackupID, "running backup not registered in the chain")
+	assert.Equal(t, "skipped", chain.Members[0].Status, "skipped")
+	assert.Equal(t, "failed", chain.Status, "chain failed")
+
+	options.overlapPolicy = "queue"
+	trigger("db-q1")
+	chain, _ = getChain("db-q1")
+	assert.Equal(t, "", chain.Members[0].BackupID, "running backup not registered in the chain")
+	assert.Equal(t, "queued", chain.Members[0].Status, "queued")
+	assert.Equal(t, "running", chain.Status, "chain waits for the queued backup")
+
+	setCurrentTaskStatus("f-running", "available", time.Now())
+	checkQueuedBackup()
+	for i := 0; i < 50 && chain.Members[0].BackupID == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+		chain, _ = getChain("db-q1")
+	}
+	assert.Equal(t, "f-queued", chain.Members[0].BackupID, "queued backup joined the chain when it started")
+	assert.Equal(t, "running", chain.Members[0].Status, "running")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var compactionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_catalog_compaction_total",
+	Help: "Total catalog compaction runs",
+}, []string{
+	"status",
+})
+
+var purgedRowsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_catalog_purged_rows_total",
+	Help: "Total deleted backup rows removed from the catalog by compaction",
+}, []string{
+	"mode",
+})
+
+//PurgedBackupStats aggregated statistics of deleted backups purged from the catalog, by month of backup start
+type PurgedBackupStats struct {
+	Month  string  `json:"month"`
+	Count  int     `json:"count"`
+	SizeMB float64 `json:"size_mb"`
+}
+
+//BackupStats backups in the catalog by status
+type BackupStats struct {
+	Status string  `json:"status"`
+	Count  int     `json:"count"`
+	SizeMB float64 `json:"size_mb"`
+}
+
+func initCompaction() {
+	prometheus.MustRegister(compactionCounter)
+	prometheus.MustRegister(purgedRowsCounter)
+}
+
+//compactCatalog purges deleted backups older than the configured days and vacuums the catalog
+func compactCatalog() {
+	logrus.Info("")
+	logrus.Info(">>>> CATALOG COMPACTION")
+	if options.purgeDeletedDays > 0 {
+		cutoff := time.Now().Add(-time.Duration(options.purgeDeletedDays) * 24 * time.Hour)
+		n, err := purgeDeletedBackups(cutoff, options.purgeMode == "archive")
+		if err != nil {
+			logrus.Errorf("Couldn't purge deleted backups. err=%s", err)
+			compactionCounter.WithLabelValues("error").Inc()
+			return
+		}
+		logrus.Infof("%d deleted backups started before %s purged from the catalog (%s)", n, cutoff.Format(time.RFC3339), options.purgeMode)
+		purgedRowsCounter.WithLabelValues(options.purgeMode).Add(float64(n))
+		if n > 0 {
+			recordAudit(AuditEvent{Actor: actorCron, Action: "purge", ObjectType: "catalog", After: auditValue(map[string]interface{}{"purged": n, "mode": options.purgeMode}), Reason: fmt.Sprintf("deleted backups started before %s", cutoff.Format(time.RFC3339))})
+		}
+	}
+
+	_, err := db.Exec("VACUUM")
+	if err != nil {
+		logrus.Warnf("Couldn't vacuum catalog. err=%s", err)
+		compactionCounter.WithLabelValues("error").Inc()
+		return
+	}
+	logrus.Debugf("Catalog vacuumed")
+	compactionCounter.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactCatalog(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	options.location = time.UTC
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	month := old.Format("2006-01")
+
+	for _, mode := range []string{"archive", "drop"} {
+		initTestDB(t)
+		options.purgeDeletedDays = 30
+		options.purgeMode = mode
+		_, err := createMaterializedBackup("old-1", "d1", "deleted", old, old, "", 10)
+		assert.Nil(t, err, "err")
+		_, err = createMaterializedBackup("old-2", "d2", "deleted", old, old, "", 5)
+		assert.Nil(t, err, "err")
+		_, err = createMaterializedBackup("old-3", "d3", "available", old, old, "", 1)
+		assert.Nil(t, err, "err")
+		_, err = createMaterializedBackup("new-1", "d4", "deleted", time.Now(), time.Now(), "", 1)
+		assert.Nil(t, err, "err")
+
+		compactCatalog()
+		compactCatalog()
+
+		backups, _ := getMaterializedBackups(0, "", "", false)
+		assert.Equal(t, 2, len(backups), mode+" remaining backups")
+		_, err = getMaterializedBackup("old-1")
+		assert.NotNil(t, err, mode+" purged")
+
+		archived := 0
+		db.QueryRow("SELECT COUNT(*) FROM materialized_backup_archive").Scan(&archived)
+		if mode == "archive" {
+			assert.Equal(t, 2, archived, "archived backups")
+		} else {
+			assert.Equal(t, 0, archived, "dropped backups")
+		}
+
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/admin/catalog/stats", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		stats := struct {
+			Backups []BackupStats       `json:"backups"`
+			Purged  []PurgedBackupStats `json:"purged"`
+		}{}
+		err = json.Unmarshal(rec.Body.Bytes(), &stats)
+		assert.Nil(t, err, "err")
+		assert.Equal(t, []PurgedBackupStats{{Month: month, Count: 2, SizeMB: 15}}, stats.Purged, mode+" purged stats")
+		assert.Equal(t, 2, len(stats.Backups), "statuses")
+	}
+}
+
+func TestCompactCatalogDisabled(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.purgeDeletedDays = 0
+	old := time.Now().Add(-400 * 24 * time.Hour)
+	_, err := createMaterializedBackup("old-1", "d1", "deleted", old, old, "", 10)
+	assert.Nil(t, err, "err")
+	compactCatalog()
+	_, err = getMaterializedBackup("old-1")
+	assert.Nil(t, err, "deleted backup kept")
+	purged, _ := getPurgedBackupStats()
+	assert.Equal(t, 0, len(purged), "no stats")
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 var metricsSQLCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -29,315 +33,1416 @@ type MaterializedBackup struct {
 	Status     string
 	CustomData string
 	SizeMB     float64
-	Reference  int
-	Minutely   int
-	Hourly     int
-	Daily      int
-	Weekly     int
-	Monthly    int
-	Yearly     int
+	Tags       []string
 }
 
 var db = &sql.DB{}
 
+//statements prepared once on initDB
+var stmts = make(map[string]*sql.Stmt)
+
+const backupColumns = "id,data_id,status,start_time,end_time,custom_data,size"
+
 func initDB() error {
-	prometheus.MustRegister(metricsSQLCounter)
+	err0 := prometheus.Register(metricsSQLCounter)
+	if _, ok := err0.(prometheus.AlreadyRegisteredError); err0 != nil && !ok {
+		return err0
+	}
+
+	os.MkdirAll(options.dataDir, os.ModePerm)
 
-	db0, err := sql.Open("sqlite3", fmt.Sprintf("%s/sqlite.db", options.dataDir))
+	st, err := newStorage(options.catalogURL, options.dataDir)
 	if err != nil {
 		return err
 	}
-	statement, err1 := db0.Prepare("CREATE TABLE IF NOT EXISTS materialized_backup (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL DEFAULT `2000-01-01`, custom_data TEXT NOT NULL DEFAULT ``, size REAL, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`id`))")
-	if err1 != nil {
-		return err1
+	storage = st
+	db0, err := storage.open()
+	if err != nil {
+		return err
 	}
-	_, err1 = statement.Exec()
+	err1 := migrateDB(db0)
 	if err1 != nil {
 		return err1
 	}
 
-	os.MkdirAll(options.dataDir, os.ModePerm)
+	err2 := prepareStatements(db0)
+	if err2 != nil {
+		return err2
+	}
 
 	db = db0
+	importBackupTaskFiles()
 	logrus.Debug("Database initialized")
 	return nil
 }
 
+//returns the queries of all statements used by the data access functions, by statement name
+func statementQueries() map[string]string {
+	queries := map[string]string{
+		"setScheduleLastFire":            "INSERT OR REPLACE INTO schedule_state (name, last_fire) values(?,?)",
+		"getScheduleLastFire":            "SELECT last_fire FROM schedule_state WHERE name=?",
+		"deleteScheduleState":            "DELETE FROM schedule_state WHERE name=?",
+		"setBackupTask":                  "INSERT OR REPLACE INTO backup_task (name, backup_id, status, start_time, request) values(?,?,?,?,?)",
+		"getBackupTask":                  "SELECT backup_id,status,start_time,request FROM backup_task WHERE name=?",
+		"deleteBackupTask":               "DELETE FROM backup_task WHERE name=?",
+		"pauseSchedule":                  "INSERT OR REPLACE INTO schedule_pause (scope, paused_at, reason) values(?,?,?)",
+		"resumeSchedule":                 "DELETE FROM schedule_pause WHERE scope=?",
+		"getSchedulePauses":              "SELECT scope,paused_at,reason FROM schedule_pause",
+		"createChain":                    "INSERT OR IGNORE INTO backup_chain (id, status, start_time) values(?,'running',?)",
+		"setChainStatus":                 "UPDATE backup_chain SET status=?, end_time=? WHERE id=?",
+		"getChain":                       "SELECT status,start_time,end_time FROM backup_chain WHERE id=?",
+		"saveChainMember":                "INSERT OR REPLACE INTO backup_chain_member (chain_id, member, role, backup_id, status, start_time, end_time, message) values(?,?,?,?,?,?,?,?)",
+		"setChainMemberStatus":           "UPDATE backup_chain_member SET status=?, message=?, end_time=? WHERE chain_id=? AND member=?",
+		"getChainOfBackup":               "SELECT chain_id,role FROM backup_chain_member WHERE member=? AND backup_id=? AND role IN ('origin','self')",
+		"getChainMembers":                "SELECT chain_id,member,role,backup_id,status,start_time,end_time,message FROM backup_chain_member WHERE chain_id=? ORDER BY start_time",
+		"getRunningDownstreamMembers":    "SELECT chain_id,member,role,backup_id,status,start_time,end_time,message FROM backup_chain_member WHERE role='downstream' AND status='running' ORDER BY start_time",
+		"createHookExecution":            "INSERT INTO hook_execution (backup_id, phase, hook, status, message, start_time, end_time) values(?,?,?,?,?,?,?)",
+		"getHookExecutions":              "SELECT backup_id,phase,hook,status,message,start_time,end_time FROM hook_execution WHERE backup_id=? ORDER BY start_time",
+		"saveGroupMember":                "INSERT OR REPLACE INTO backup_group_member (group_id, provider_url, backup_id, data_id, status, size, message) values(?,?,?,?,?,?,?)",
+		"getGroupMembers":                "SELECT provider_url,backup_id,data_id,status,size,message FROM backup_group_member WHERE group_id=? ORDER BY provider_url",
+		"createMaintenanceWindow":        "INSERT INTO maintenance_window (scope, start_time, end_time, reason) values(?,?,?,?)",
+		"getActiveMaintenanceWindows":    "SELECT id,scope,start_time,end_time,reason FROM maintenance_window WHERE start_time<=? AND end_time>? ORDER BY start_time",
+		"endMaintenanceWindow":           "UPDATE maintenance_window SET end_time=? WHERE id=? AND end_time>?",
+		"createLeaderLease":              "INSERT OR IGNORE INTO leader_lease (name, holder, expires_at) values(?,?,?)",
+		"acquireLeaderLease":             "UPDATE leader_lease SET holder=?, expires_at=? WHERE name=? AND (holder=? OR expires_at<?)",
+		"getLeaderLease":                 "SELECT holder,expires_at FROM leader_lease WHERE name=?",
+		"releaseLeaderLease":             "UPDATE leader_lease SET expires_at=? WHERE name=? AND holder=?",
+		"getDeletedBackups":              "SELECT id,start_time,COALESCE(size,0) FROM materialized_backup WHERE status='deleted'",
+		"addPurgedBackupStats":           "UPDATE purged_backup_stats SET count=count+?, size=size+? WHERE month=?",
+		"createPurgedBackupStats":        "INSERT INTO purged_backup_stats (month, count, size) values(?,?,?)",
+		"archiveDeletedBackup":           "INSERT INTO materialized_backup_archive (" + backupColumns + ",archived_at) SELECT " + backupColumns + ",? FROM materialized_backup WHERE id=? AND status='deleted'",
+		"purgeDeletedBackup":             "DELETE FROM materialized_backup WHERE id=? AND status='deleted'",
+		"getPurgedBackupStats":           "SELECT month,count,size FROM purged_backup_stats ORDER BY month",
+		"getBackupStats":                 "SELECT status,COUNT(*),COALESCE(SUM(size),0) FROM materialized_backup GROUP BY status ORDER BY status",
+		"createAuditEvent":               "INSERT INTO audit_event (event_time, actor, action, object_type, object_id, before_value, after_value, reason) values(?,?,?,?,?,?,?,?)",
+		"getAuditEvents":                 "SELECT id,event_time,actor,action,object_type,object_id,before_value,after_value,reason FROM audit_event WHERE (?='' OR actor=? OR actor LIKE ?) AND (?='' OR action=?) AND (?='' OR object_type=?) AND (?='' OR object_id=?) AND event_time>=? AND event_time<? ORDER BY id DESC LIMIT ?",
+		"getStatusMaterializedBackup":    "SELECT status FROM materialized_backup WHERE id=?",
+		"getBackupTags":                  "SELECT tag FROM backup_tag WHERE backup_id=?",
+		"getAllBackupTags":               "SELECT backup_id,tag FROM backup_tag",
+		"clearBackupTags":                "DELETE FROM backup_tag",
+		"addBackupTag":                   "INSERT OR IGNORE INTO backup_tag (backup_id, tag) values(?,?)",
+		"deleteBackupTags":               "DELETE FROM backup_tag WHERE backup_id=?",
+		"setBackupLabel":                 "INSERT OR REPLACE INTO backup_label (backup_id, name, value) values(?,?,?)",
+		"addBackupLabel":                 "INSERT OR IGNORE INTO backup_label (backup_id, name, value) values(?,?,?)",
+		"deleteBackupLabel":              "DELETE FROM backup_label WHERE backup_id=? AND name=?",
+		"deleteBackupLabels":             "DELETE FROM backup_label WHERE backup_id=?",
+		"getBackupLabels":                "SELECT name,value FROM backup_label WHERE backup_id=?",
+		"getAllBackupLabels":             "SELECT backup_id,name,value FROM backup_label",
+		"createMaterializedBackup":       "INSERT INTO materialized_backup (id, data_id, status, start_time, end_time, custom_data, size) values(?,?,?,?,?,?,?)",
+		"getMaterializedBackup":          "SELECT " + backupColumns + " FROM materialized_backup WHERE id=?",
+		"setStatusMaterializedBackup":    "UPDATE materialized_backup SET status=? WHERE id=?",
+		"changeStatusMaterializedBackup": "UPDATE materialized_backup SET status=? WHERE id=? AND status=?",
+		"addBackupTrash":                 "INSERT INTO backup_trash (backup_id, delete_after, reason) VALUES (?,?,?)",
+		"deleteBackupTrash":              "DELETE FROM backup_trash WHERE backup_id=?",
+		"createBackupHold":               "INSERT INTO backup_hold (backup_id, selector, reason, created_by, created_at) values(?,?,?,?,?)",
+		"getBackupHolds":                 "SELECT id,backup_id,selector,reason,created_by,created_at FROM backup_hold ORDER BY id",
+		"deleteBackupHold":               "DELETE FROM backup_hold WHERE id=?",
+		"getGroupOfMember":               "SELECT group_id FROM backup_group_member WHERE backup_id=?",
+		"getBackupStartTime":             "SELECT start_time FROM materialized_backup WHERE id=?",
+		"setBackupExpiry":                "INSERT OR REPLACE INTO backup_expiry (backup_id, expires_at, exclude_from_tiers) values(?,?,?)",
+		"getBackupExpiries":              "SELECT backup_id,expires_at,exclude_from_tiers FROM backup_expiry",
+		"getBackupTrash":                 "SELECT backup_id,delete_after,reason FROM backup_trash ORDER BY delete_after",
+		"getReferenceCandidates":         "SELECT id,start_time FROM materialized_backup WHERE status='available' AND id NOT IN (SELECT backup_id FROM backup_expiry WHERE exclude_from_tiers=1) ORDER BY start_time, id",
+		"getTagCandidates":               "SELECT b.id,b.start_time FROM materialized_backup b, backup_tag t WHERE t.backup_id=b.id AND t.tag=? ORDER BY b.start_time, b.id",
+	}
+
+	filter := " FROM materialized_backup WHERE (?='' OR EXISTS (SELECT 1 FROM backup_tag t WHERE t.backup_id=materialized_backup.id AND t.tag=?)) AND (?='' OR status=?) ORDER BY "
+	queries["getMaterializedBackups"] = "SELECT " + backupColumns + filter + "start_time DESC LIMIT ?"
+	queries["getMaterializedBackupsRandom"] = "SELECT " + backupColumns + filter + "RANDOM() LIMIT ?"
+
+	for _, t := range catalogTables {
+		queries["exportCatalog."+t.name] = "SELECT * FROM " + t.name
+		queries["catalogColumns."+t.name] = "SELECT * FROM " + t.name + " WHERE 1=0"
+	}
+	return queries
+}
+
+//prepares all statements used by the data access functions. previously prepared statements are closed
+func prepareStatements(db0 *sql.DB) error {
+	queries := statementQueries()
+	prepared := make(map[string]*sql.Stmt)
+	for name, q := range queries {
+		stmt, err := db0.Prepare(storage.statement(name, q))
+		if err != nil {
+			for _, p := range prepared {
+				p.Close()
+			}
+			return fmt.Errorf("Couldn't prepare statement %s. err=%s", name, err)
+		}
+		prepared[name] = stmt
+	}
+	for _, p := range stmts {
+		p.Close()
+	}
+	stmts = prepared
+	return nil
+}
+
+//returns an error if tag is not the name of a retention tier
+func validateTag(tag string, allowReference bool) error {
+	if tag == "" || (allowReference && tag == "reference") {
+		return nil
+	}
+	if _, ok := getRetentionTier(tag); ok {
+		return nil
+	}
+	return fmt.Errorf("Invalid tag '%s'", tag)
+}
+
+//backupTask a row of backup_task. The running backup is kept as 'current' and the follow-up backup queued by the overlap
+//policy as 'queued', so that a new leader sharing the catalog finds them
+type backupTask struct {
+	backupID  string
+	status    string
+	startTime time.Time
+	//json trigger request of a queued backup
+	request string
+}
+
+func setBackupTask(name string, t backupTask) error {
+	stmt := stmts["setBackupTask"]
+	_, err2 := stmt.Exec(name, t.backupID, t.status, t.startTime.UTC(), t.request)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+//returns task, found, error
+func getBackupTask(name string) (backupTask, bool, error) {
+	t := backupTask{}
+	err := stmts["getBackupTask"].QueryRow(name).Scan(&t.backupID, &t.status, &t.startTime, &t.request)
+	if err == sql.ErrNoRows {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return backupTask{}, false, nil
+	} else if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return backupTask{}, false, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return t, true, nil
+}
+
+func deleteBackupTask(name string) error {
+	stmt := stmts["deleteBackupTask"]
+	_, err2 := stmt.Exec(name)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
 func setCurrentTaskStatus(id string, status string, date time.Time) error {
-	ft := date.Format(time.RFC3339)
-	return ioutil.WriteFile(fmt.Sprintf("%s/backup-task", options.dataDir), []byte(fmt.Sprintf("%s|%s|%s", id, status, ft)), 0644)
+	return setBackupTask("current", backupTask{backupID: id, status: status, startTime: date})
 }
 
 //returns backupId, backupStatus, time, error
 func getCurrentTaskStatus() (string, string, time.Time, error) {
-	b, err := ioutil.ReadFile(fmt.Sprintf("%s/backup-task", options.dataDir))
-	line := string(b)
+	t, found, err := getBackupTask("current")
 	if err != nil {
 		return "", "", time.Now(), err
 	}
-	params := strings.Split(line, "|")
-	if len(params) != 3 {
-		return "", "", time.Now(), fmt.Errorf("Invalid params found in /data/backup-task: %s", line)
+	if !found {
+		return "", "", time.Now(), fmt.Errorf("No backup task found in catalog")
 	}
-	t, err1 := time.Parse(time.RFC3339, params[2])
-	if err1 != nil {
-		return "", "", time.Now(), err1
+	return t.backupID, t.status, t.startTime, nil
+}
+
+//QueuedBackup follow-up backup kept by the 'queue' overlap policy, with what was requested for it by the trigger
+type QueuedBackup struct {
+	QueuedAt         time.Time          `json:"queued_at"`
+	Actor            string             `json:"actor,omitempty"`
+	Labels           map[string]*string `json:"labels,omitempty"`
+	ExpiresIn        time.Duration      `json:"expires_in,omitempty"`
+	ExcludeFromTiers bool               `json:"exclude_from_tiers,omitempty"`
+	ChainID          string             `json:"chain_id,omitempty"`
+	Upstream         string             `json:"upstream,omitempty"`
+}
+
+func setBackupQueued(queued bool) error {
+	if !queued {
+		return deleteBackupTask("queued")
 	}
-	return params[0], params[1], t, nil
+	return saveQueuedBackup(QueuedBackup{QueuedAt: time.Now()})
 }
 
-func createMaterializedBackup(backupID string, dataID string, status string, startDate time.Time, endDate time.Time, customData string, size float64) (string, error) {
-	stmt, err1 := db.Prepare("INSERT INTO materialized_backup (id, data_id, status, start_time, end_time, custom_data, size) values(?,?,?,?,?,?,?)")
-	if err1 != nil {
-		return "", err1
+func saveQueuedBackup(q QueuedBackup) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
 	}
-	_, err2 := stmt.Exec(backupID, dataID, status, startDate, endDate, customData, size)
+	return setBackupTask("queued", backupTask{status: "queued", startTime: q.QueuedAt, request: string(data)})
+}
+
+//returns the queued follow-up backup, if any
+func getQueuedBackup() (QueuedBackup, bool) {
+	t, found, err := getBackupTask("queued")
+	if err != nil {
+		logrus.Warnf("Couldn't get queued backup. err=%s", err)
+		return QueuedBackup{}, false
+	}
+	if !found {
+		return QueuedBackup{}, false
+	}
+	q := QueuedBackup{QueuedAt: t.startTime}
+	err = json.Unmarshal([]byte(t.request), &q)
+	if err != nil {
+		logrus.Warnf("Invalid trigger request of queued backup. err=%s", err)
+	}
+	return q, true
+}
+
+//returns whether a follow-up backup was queued while another backup was running
+func isBackupQueued() bool {
+	_, queued := getQueuedBackup()
+	return queued
+}
+
+//moves the running backup and the queued backup kept in DATA_DIR files by older versions into the catalog
+func importBackupTaskFiles() {
+	taskFile := fmt.Sprintf("%s/backup-task", options.dataDir)
+	if b, err := ioutil.ReadFile(taskFile); err == nil {
+		params := strings.Split(string(b), "|")
+		t, err1 := time.Time{}, fmt.Errorf("Invalid params found in %s: %s", taskFile, string(b))
+		if len(params) == 3 {
+			t, err1 = time.Parse(time.RFC3339, params[2])
+		}
+		if err1 == nil {
+			_, found, _ := getBackupTask("current")
+			if !found {
+				err1 = setCurrentTaskStatus(params[0], params[1], t)
+			}
+		}
+		if err1 != nil {
+			logrus.Warnf("Couldn't import backup task file into the catalog. err=%s", err1)
+		} else {
+			logrus.Infof("Backup task file imported into the catalog")
+			os.Remove(taskFile)
+		}
+	}
+	queueFile := fmt.Sprintf("%s/backup-queue", options.dataDir)
+	if _, err := os.Stat(queueFile); err == nil {
+		err1 := setBackupQueued(true)
+		if err1 != nil {
+			logrus.Warnf("Couldn't import queued backup file into the catalog. err=%s", err1)
+		} else {
+			logrus.Infof("Queued backup file imported into the catalog")
+			os.Remove(queueFile)
+		}
+	}
+}
+
+func setScheduleLastFire(name string, fireTime time.Time) error {
+	stmt := stmts["setScheduleLastFire"]
+	_, err2 := stmt.Exec(name, fireTime)
 	if err2 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return "", err2
+		return err2
 	}
 	metricsSQLCounter.WithLabelValues("success").Inc()
-	// rows, _ := db.Query("SELECT id,  FROM backup_tasks")
-	return backupID, nil
+	return nil
 }
 
-func getMaterializedBackup(backupID string) (MaterializedBackup, error) {
-	rows, err1 := db.Query("SELECT id,data_id,status,start_time,end_time,custom_data,size,reference,minutely,hourly,daily,weekly,monthly,yearly FROM materialized_backup WHERE id='" + backupID + "'")
+//returns lastFire, found, error
+func getScheduleLastFire(name string) (time.Time, bool, error) {
+	var lastFire time.Time
+	err := stmts["getScheduleLastFire"].QueryRow(name).Scan(&lastFire)
+	if err == sql.ErrNoRows {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return time.Time{}, false, nil
+	} else if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return time.Time{}, false, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return lastFire, true, nil
+}
+
+func deleteScheduleState(name string) error {
+	stmt := stmts["deleteScheduleState"]
+	_, err2 := stmt.Exec(name)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+func pauseSchedule(scope string, pausedAt time.Time, reason string) error {
+	stmt := stmts["pauseSchedule"]
+	_, err2 := stmt.Exec(scope, pausedAt.UTC(), reason)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+func resumeSchedule(scope string) error {
+	stmt := stmts["resumeSchedule"]
+	_, err2 := stmt.Exec(scope)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+//returns paused schedules by scope
+func getSchedulePauses() (map[string]SchedulePause, error) {
+	pauses := make(map[string]SchedulePause)
+	rows, err1 := stmts["getSchedulePauses"].Query()
 	if err1 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return MaterializedBackup{}, err1
+		return pauses, err1
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		backup := MaterializedBackup{}
-		err2 := rows.Scan(&backup.ID, &backup.DataID, &backup.Status, &backup.StartTime, &backup.EndTime, &backup.CustomData, &backup.SizeMB, &backup.Reference, &backup.Minutely, &backup.Hourly, &backup.Daily, &backup.Weekly, &backup.Monthly, &backup.Yearly)
+		p := SchedulePause{Paused: true}
+		scope := ""
+		err2 := rows.Scan(&scope, &p.PausedAt, &p.Reason)
 		if err2 != nil {
 			metricsSQLCounter.WithLabelValues("error").Inc()
-			return MaterializedBackup{}, err2
-		} else {
-			metricsSQLCounter.WithLabelValues("success").Inc()
-			return backup, nil
+			return pauses, err2
 		}
+		pauses[scope] = p
 	}
 	err := rows.Err()
 	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return MaterializedBackup{}, err
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
-		return MaterializedBackup{}, fmt.Errorf("Backup id %s not found", backupID)
+		return pauses, err
 	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return pauses, nil
 }
 
-func getMaterializedBackups(limit int, tag string, status string, randomOrder bool) ([]MaterializedBackup, error) {
-	where := ""
-	if tag != "" || status != "" {
-		where = where + " WHERE "
-		if tag != "" {
-			where = where + " " + tag + "=1"
-		}
-		if status != "" {
-			if tag != "" {
-				where = where + " AND "
-			}
-			where = where + " status='" + status + "'"
-		}
+func createChain(chainID string, startTime time.Time) error {
+	stmt := stmts["createChain"]
+	_, err2 := stmt.Exec(chainID, startTime.UTC())
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
 	}
-	orderBy := "start_time DESC"
-	if randomOrder {
-		orderBy = "RANDOM()"
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+func setChainStatus(chainID string, status string, endTime time.Time) error {
+	stmt := stmts["setChainStatus"]
+	_, err2 := stmt.Exec(status, endTime.UTC(), chainID)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+func saveChainMember(chainID string, m BackupChainMember) error {
+	stmt := stmts["saveChainMember"]
+	endTime := m.EndTime
+	if endTime.IsZero() {
+		endTime, _ = time.Parse("2006-01-02", "2000-01-01")
+	}
+	_, err2 := stmt.Exec(chainID, m.Member, m.Role, m.BackupID, m.Status, m.StartTime.UTC(), endTime.UTC(), m.Message)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+func setChainMemberStatus(chainID string, member string, status string, message string, endTime time.Time) error {
+	stmt := stmts["setChainMemberStatus"]
+	_, err2 := stmt.Exec(status, message, endTime.UTC(), chainID, member)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
 	}
-	q := "SELECT id,data_id,status,start_time,end_time,custom_data,size,reference,minutely,hourly,daily,weekly,monthly,yearly FROM materialized_backup " + where + " ORDER BY " + orderBy
-	if limit != 0 {
-		q = q + fmt.Sprintf(" LIMIT %d", limit)
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+//returns chainID, role, found, error for a backup made by this instance
+func getChainOfBackup(backupID string) (string, string, bool, error) {
+	chainID := ""
+	role := ""
+	err := stmts["getChainOfBackup"].QueryRow(options.backupName, backupID).Scan(&chainID, &role)
+	if err == sql.ErrNoRows {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return "", "", false, nil
+	} else if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return "", "", false, err
 	}
-	logrus.Debugf("query=%s", q)
-	rows, err1 := db.Query(q)
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return chainID, role, true, nil
+}
+
+func queryChainMembers(stmt *sql.Stmt, args ...interface{}) (map[string][]BackupChainMember, error) {
+	members := make(map[string][]BackupChainMember)
+	rows, err1 := stmt.Query(args...)
 	if err1 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err1
+		return members, err1
 	}
 	defer rows.Close()
 
-	var backups = make([]MaterializedBackup, 0)
 	for rows.Next() {
-		backup := MaterializedBackup{}
-		err2 := rows.Scan(&backup.ID, &backup.DataID, &backup.Status, &backup.StartTime, &backup.EndTime, &backup.CustomData, &backup.SizeMB, &backup.Reference, &backup.Minutely, &backup.Hourly, &backup.Daily, &backup.Weekly, &backup.Monthly, &backup.Yearly)
+		m := BackupChainMember{}
+		chainID := ""
+		err2 := rows.Scan(&chainID, &m.Member, &m.Role, &m.BackupID, &m.Status, &m.StartTime, &m.EndTime, &m.Message)
 		if err2 != nil {
 			metricsSQLCounter.WithLabelValues("error").Inc()
-			return []MaterializedBackup{}, err2
-		} else {
-			backups = append(backups, backup)
+			return members, err2
 		}
+		members[chainID] = append(members[chainID], m)
 	}
 	err := rows.Err()
 	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err
+		return members, err
 	}
 	metricsSQLCounter.WithLabelValues("success").Inc()
-	return backups, nil
+	return members, nil
 }
 
-func getExclusiveTagAvailableMaterializedBackups(tag string, skipNewestCount int, limit int) ([]MaterializedBackup, error) {
-	whereTags := ""
-	tags := []string{"minutely", "hourly", "daily", "weekly", "monthly", "yearly"}
-	if tag != "" {
-		for _, t := range tags {
-			if t == tag {
-				whereTags = whereTags + t + "=1"
-			} else if whereTags != "" {
-				whereTags = whereTags + " AND " + t + "=0"
-			}
-		}
-	} else {
-		for _, t := range tags {
-			if whereTags != "" {
-				whereTags = whereTags + " AND "
-			}
-			whereTags = whereTags + t + "=0"
-		}
+//returns downstream members still running by chain id
+func getRunningDownstreamMembers() (map[string][]BackupChainMember, error) {
+	return queryChainMembers(stmts["getRunningDownstreamMembers"])
+}
+
+func getChain(chainID string) (BackupChain, error) {
+	chain := BackupChain{ID: chainID}
+	err := stmts["getChain"].QueryRow(chainID).Scan(&chain.Status, &chain.StartTime, &chain.EndTime)
+	if err == sql.ErrNoRows {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return chain, fmt.Errorf("Chain %s not found", chainID)
+	} else if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return chain, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	members, err := queryChainMembers(stmts["getChainMembers"], chainID)
+	if err != nil {
+		return chain, err
+	}
+	chain.Members = members[chainID]
+	if chain.Members == nil {
+		chain.Members = make([]BackupChainMember, 0)
+	}
+	return chain, nil
+}
+
+func createHookExecution(he HookExecution) error {
+	stmt := stmts["createHookExecution"]
+	_, err2 := stmt.Exec(he.BackupID, he.Phase, he.Hook, he.Status, he.Message, he.StartTime.UTC(), he.EndTime.UTC())
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err2
 	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
 
-	q := fmt.Sprintf("SELECT id,data_id,status,start_time,end_time,custom_data,reference,minutely,hourly,daily,weekly,monthly,yearly FROM materialized_backup WHERE %s AND status='available' ORDER BY start_time DESC LIMIT %d OFFSET %d", whereTags, limit, skipNewestCount)
-	logrus.Debugf("getExclusiveTags query=%s", q)
-	rows, err1 := db.Query(q)
+func getHookExecutions(backupID string) ([]HookExecution, error) {
+	rows, err1 := stmts["getHookExecutions"].Query(backupID)
 	if err1 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err1
+		return []HookExecution{}, err1
 	}
 	defer rows.Close()
 
-	var backups = make([]MaterializedBackup, 0)
+	hes := make([]HookExecution, 0)
 	for rows.Next() {
-		backup := MaterializedBackup{}
-		err2 := rows.Scan(&backup.ID, &backup.DataID, &backup.Status, &backup.StartTime, &backup.EndTime, &backup.CustomData, &backup.Reference, &backup.Minutely, &backup.Hourly, &backup.Daily, &backup.Weekly, &backup.Monthly, &backup.Yearly)
+		he := HookExecution{}
+		err2 := rows.Scan(&he.BackupID, &he.Phase, &he.Hook, &he.Status, &he.Message, &he.StartTime, &he.EndTime)
 		if err2 != nil {
 			metricsSQLCounter.WithLabelValues("error").Inc()
-			return []MaterializedBackup{}, err2
-		} else {
-			backups = append(backups, backup)
+			return []HookExecution{}, err2
 		}
+		hes = append(hes, he)
 	}
 	err := rows.Err()
 	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err
+		return []HookExecution{}, err
 	}
 	metricsSQLCounter.WithLabelValues("success").Inc()
-	return backups, nil
+	return hes, nil
 }
 
-func clearTagsAndReferenceMaterializedBackup(tx *sql.Tx) (sql.Result, error) {
-	stmt, err := db.Prepare("UPDATE materialized_backup SET reference=0, minutely=0, hourly=0, daily=0, weekly=0, monthly=0, yearly=0;")
-	if err != nil {
-		return nil, err
-	}
-	res, err0 := tx.Stmt(stmt).Exec()
-	if err0 != nil {
+func saveGroupMember(groupID string, m GroupMember) error {
+	stmt := stmts["saveGroupMember"]
+	_, err2 := stmt.Exec(groupID, m.ProviderURL, m.BackupID, m.DataID, m.Status, m.SizeMB, m.Message)
+	if err2 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
+		return err2
 	}
-	return res, err0
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
 }
 
-func setAllTagsMaterializedBackup(tx *sql.Tx, backupID string) (sql.Result, error) {
-	stmt, err := db.Prepare("UPDATE materialized_backup SET minutely=1, hourly=1, daily=1, weekly=1, monthly=1, yearly=1 WHERE id=?;")
-	if err != nil {
-		return nil, err
-	}
-	res, err0 := tx.Stmt(stmt).Exec(backupID)
-	if err0 != nil {
+//returns the members of a consistency group backup. it is empty for backups of a single provider
+func getGroupMembers(groupID string) ([]GroupMember, error) {
+	rows, err1 := stmts["getGroupMembers"].Query(groupID)
+	if err1 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
+		return []GroupMember{}, err1
 	}
-	return res, err0
-}
+	defer rows.Close()
 
-func markReferencesMinutelyMaterializedBackup(tx *sql.Tx, secondReference string) (sql.Result, error) {
-	sql := `UPDATE materialized_backup set reference=1, minutely=1
-											WHERE id IN (
-												SELECT y.id AS id FROM 
-												(SELECT id, strftime('%Y-%m-%dT%H:%M:0.000', start_time) AS timeref, MIN(ABS(strftime('%S', start_time)-` + secondReference + `)) AS refdiff
-													FROM materialized_backup p
-													GROUP BY strftime('%Y-%m-%dT%H:%M:0.000', start_time)) y
-											)`
-	logrus.Debugf("sql=%s", sql)
-	stmt, err := db.Prepare(sql)
-	if err != nil {
-		return nil, err
+	members := make([]GroupMember, 0)
+	for rows.Next() {
+		m := GroupMember{}
+		err2 := rows.Scan(&m.ProviderURL, &m.BackupID, &m.DataID, &m.Status, &m.SizeMB, &m.Message)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return []GroupMember{}, err2
+		}
+		members = append(members, m)
 	}
-	res, err0 := tx.Stmt(stmt).Exec()
-	if err0 != nil {
+	err := rows.Err()
+	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
+		return []GroupMember{}, err
 	}
-	return res, err0
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return members, nil
 }
 
-func setStatusMaterializedBackup(backupID string, status string) (sql.Result, error) {
-	sql := `UPDATE materialized_backup SET status=? WHERE id=?`
-	stmt, err := db.Prepare(sql)
-	logrus.Infof("%s %s %s", sql, backupID, status)
-	if err != nil {
+func createMaintenanceWindow(scope string, startTime time.Time, endTime time.Time, reason string) (int, error) {
+	id, err2 := storage.insertID(stmts["createMaintenanceWindow"], scope, startTime.UTC(), endTime.UTC(), reason)
+	if err2 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return nil, err
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
+		return 0, err2
 	}
-	return stmt.Exec(status, backupID)
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return int(id), nil
 }
 
-func markTagMaterializedBackup(tx *sql.Tx, tag string, previousTag string, groupByPattern string, diffPattern string, ref string) (sql.Result, error) {
-	sql := `UPDATE materialized_backup set ` + tag + `=1
-								WHERE id IN (
-									SELECT y.id AS id FROM 
-									(SELECT id, strftime('` + groupByPattern + `', start_time) AS timeref, MIN(ABS(strftime('` + diffPattern + `', start_time)-` + ref + `)) AS refdiff
-										FROM materialized_backup p
-										WHERE reference=1 AND ` + previousTag + `=1
-										GROUP BY strftime('` + groupByPattern + `', start_time)) y
-								)`
-	logrus.Debugf("sql=%s", sql)
-	stmt, err := db.Prepare(sql)
-	if err != nil {
+func getActiveMaintenanceWindows(t time.Time) ([]MaintenanceWindow, error) {
+	rows, err1 := stmts["getActiveMaintenanceWindows"].Query(t.UTC(), t.UTC())
+	if err1 != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return nil, err
+		return []MaintenanceWindow{}, err1
 	}
-	res, err0 := tx.Stmt(stmt).Exec()
-	if err0 != nil {
+	defer rows.Close()
+
+	windows := make([]MaintenanceWindow, 0)
+	for rows.Next() {
+		w := MaintenanceWindow{}
+		err2 := rows.Scan(&w.ID, &w.Scope, &w.StartTime, &w.EndTime, &w.Reason)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return []MaintenanceWindow{}, err2
+		}
+		windows = append(windows, w)
+	}
+	err := rows.Err()
+	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
+		return []MaintenanceWindow{}, err
 	}
-	return res, err0
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return windows, nil
 }
 
-func getTags(backup MaterializedBackup) []string {
-	t := make([]string, 0)
-	if backup.Reference == 1 {
-		t = append(t, "reference")
+//closes a maintenance window at endTime. returns the number of windows affected
+func endMaintenanceWindow(id int, endTime time.Time) (int64, error) {
+	stmt := stmts["endMaintenanceWindow"]
+	res, err2 := stmt.Exec(endTime.UTC(), id, endTime.UTC())
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return 0, err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return res.RowsAffected()
+}
+
+func createMaterializedBackup(backupID string, dataID string, status string, startDate time.Time, endDate time.Time, customData string, size float64) (string, error) {
+	stmt := stmts["createMaterializedBackup"]
+	_, err2 := stmt.Exec(backupID, dataID, status, startDate, endDate, customData, size)
+	if err2 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return "", err2
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	// rows, _ := stmts["createMaterializedBackupQuery"].Query()
+	return backupID, nil
+}
+
+func getMaterializedBackup(backupID string) (MaterializedBackup, error) {
+	rows, err1 := stmts["getMaterializedBackup"].Query(backupID)
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return MaterializedBackup{}, err1
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		backup := MaterializedBackup{}
+		err2 := rows.Scan(&backup.ID, &backup.DataID, &backup.Status, &backup.StartTime, &backup.EndTime, &backup.CustomData, &backup.SizeMB)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return MaterializedBackup{}, err2
+		}
+		rows.Close()
+		backup.Tags, err2 = getBackupTags(backupID)
+		if err2 != nil {
+			return MaterializedBackup{}, err2
+		}
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return backup, nil
+	}
+	err := rows.Err()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return MaterializedBackup{}, err
+	} else {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return MaterializedBackup{}, fmt.Errorf("Backup id %s not found", backupID)
+	}
+}
+
+//returns backups filtered by tag and status (empty for any). limit 0 means no limit
+func getMaterializedBackups(limit int, tag string, status string, randomOrder bool) ([]MaterializedBackup, error) {
+	err0 := validateTag(tag, true)
+	if err0 != nil {
+		return []MaterializedBackup{}, err0
+	}
+	if limit == 0 {
+		limit = math.MaxInt32
+	}
+	stmt := stmts["getMaterializedBackups"]
+	if randomOrder {
+		stmt = stmts["getMaterializedBackupsRandom"]
+	}
+	rows, err1 := stmt.Query(tag, tag, status, status, limit)
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return []MaterializedBackup{}, err1
+	}
+	defer rows.Close()
+
+	var backups = make([]MaterializedBackup, 0)
+	for rows.Next() {
+		backup := MaterializedBackup{}
+		err2 := rows.Scan(&backup.ID, &backup.DataID, &backup.Status, &backup.StartTime, &backup.EndTime, &backup.CustomData, &backup.SizeMB)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return []MaterializedBackup{}, err2
+		} else {
+			backups = append(backups, backup)
+		}
+	}
+	err := rows.Err()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return []MaterializedBackup{}, err
+	}
+	rows.Close()
+	tags, err := getAllBackupTags()
+	if err != nil {
+		return []MaterializedBackup{}, err
+	}
+	for i := range backups {
+		backups[i].Tags = tags[backups[i].ID]
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return backups, nil
+}
+
+//returns available backups whose coarsest tier is tag (or without tier tags when tag is empty), newest first, skipping the newest skipNewestCount
+func getExclusiveTagAvailableMaterializedBackups(tag string, skipNewestCount int, limit int) ([]MaterializedBackup, error) {
+	err0 := validateTag(tag, false)
+	if err0 != nil {
+		return []MaterializedBackup{}, err0
+	}
+	available, err1 := getMaterializedBackups(0, "", "available", false)
+	if err1 != nil {
+		return []MaterializedBackup{}, err1
+	}
+	tiers := retentionTiers()
+	backups := make([]MaterializedBackup, 0)
+	skipped := 0
+	for _, b := range available {
+		coarsest := ""
+		for _, t := range tiers {
+			for _, bt := range b.Tags {
+				if bt == t.name {
+					coarsest = t.name
+				}
+			}
+		}
+		if coarsest != tag {
+			continue
+		}
+		if skipped < skipNewestCount {
+			skipped++
+			continue
+		}
+		if len(backups) >= limit {
+			break
+		}
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
+
+func clearBackupTags(tx *sql.Tx) (sql.Result, error) {
+	res, err0 := tx.Stmt(stmts["clearBackupTags"]).Exec()
+	if err0 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+	} else {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+	}
+	return res, err0
+}
+
+//tags a backup with all tiers
+func setAllTagsMaterializedBackup(tx *sql.Tx, backupID string) (sql.Result, error) {
+	count := int64(0)
+	for _, t := range retentionTiers() {
+		res, err0 := tx.Stmt(stmts["addBackupTag"]).Exec(backupID, t.name)
+		if err0 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err0
+		}
+		n, _ := res.RowsAffected()
+		count = count + n
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return driver.RowsAffected(count), nil
+}
+
+//purges deleted backups started before cutoff, archiving them if requested. their size and count are
+//added to purged_backup_stats first, in the same transaction. returns the number of backups purged
+func purgeDeletedBackups(cutoff time.Time, archive bool) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Stmt(stmts["getDeletedBackups"]).Query()
+	if err != nil {
+		tx.Rollback()
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return 0, err
+	}
+	ids := make([]string, 0)
+	months := make([]string, 0)
+	stats := make(map[string]PurgedBackupStats)
+	for rows.Next() {
+		var id string
+		var startTime time.Time
+		size := 0.0
+		err = rows.Scan(&id, &startTime, &size)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return 0, err
+		}
+		//start times are compared in go because they are not stored in a single timezone
+		if !startTime.Before(cutoff) {
+			continue
+		}
+		ids = append(ids, id)
+		month := formatStrftime("%Y-%m", localTime(startTime))
+		st, ok := stats[month]
+		if !ok {
+			months = append(months, month)
+			st.Month = month
+		}
+		st.Count++
+		st.SizeMB = st.SizeMB + size
+		stats[month] = st
+	}
+	rows.Close()
+
+	for _, month := range months {
+		st := stats[month]
+		res, err := tx.Stmt(stmts["addPurgedBackupStats"]).Exec(st.Count, st.SizeMB, month)
+		if err == nil {
+			n, _ := res.RowsAffected()
+			if n == 0 {
+				_, err = tx.Stmt(stmts["createPurgedBackupStats"]).Exec(month, st.Count, st.SizeMB)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return 0, err
+		}
+	}
+
+	archivedAt := time.Now().UTC()
+	for _, id := range ids {
+		if archive {
+			_, err = tx.Stmt(stmts["archiveDeletedBackup"]).Exec(archivedAt, id)
+		}
+		if err == nil && !archive {
+			_, err = tx.Stmt(stmts["deleteBackupLabels"]).Exec(id)
+		}
+		if err == nil {
+			_, err = tx.Stmt(stmts["deleteBackupTags"]).Exec(id)
+		}
+		if err == nil {
+			_, err = tx.Stmt(stmts["purgeDeletedBackup"]).Exec(id)
+		}
+		if err != nil {
+			tx.Rollback()
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return 0, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return int64(len(ids)), nil
+}
+
+func getPurgedBackupStats() ([]PurgedBackupStats, error) {
+	rows, err1 := stmts["getPurgedBackupStats"].Query()
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return []PurgedBackupStats{}, err1
+	}
+	defer rows.Close()
+
+	stats := make([]PurgedBackupStats, 0)
+	for rows.Next() {
+		st := PurgedBackupStats{}
+		err2 := rows.Scan(&st.Month, &st.Count, &st.SizeMB)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return []PurgedBackupStats{}, err2
+		}
+		stats = append(stats, st)
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return stats, rows.Err()
+}
+
+func getBackupStats() ([]BackupStats, error) {
+	rows, err1 := stmts["getBackupStats"].Query()
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return []BackupStats{}, err1
+	}
+	defer rows.Close()
+
+	stats := make([]BackupStats, 0)
+	for rows.Next() {
+		st := BackupStats{}
+		err2 := rows.Scan(&st.Status, &st.Count, &st.SizeMB)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return []BackupStats{}, err2
+		}
+		stats = append(stats, st)
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return stats, rows.Err()
+}
+
+//marks the backup nearest to the reference position of tier in each group of backups tagged with its parent tier.
+//the first tier has no parent: all available backups are candidates and the marked ones are also tagged 'reference'
+func markTierMaterializedBackups(tx *sql.Tx, tier retentionTier) (sql.Result, error) {
+	ref := tier.params[1]
+	if ref == "L" {
+		//only monthly keeps 'L' in its params, for the cron string. the last day of a month is the nearest to 31
+		ref = "31"
+	}
+	if tier.parent == "" {
+		return markNearestBackups(tx, stmts["getReferenceCandidates"], []interface{}{}, tier, []string{"reference", tier.name}, ref)
+	}
+	return markNearestBackups(tx, stmts["getTagCandidates"], []interface{}{tier.parent}, tier, []string{tier.name}, ref)
+}
+
+//changes labels of a backup in a transaction. returns the labels before and after the change
+func updateBackupLabels(backupID string, labels map[string]*string, overwrite bool) (map[string]string, map[string]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	before, err := queryBackupLabels(tx.Stmt(stmts["getBackupLabels"]), backupID)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	for name, value := range labels {
+		if value == nil {
+			_, err = tx.Stmt(stmts["deleteBackupLabel"]).Exec(backupID, name)
+		} else if overwrite {
+			_, err = tx.Stmt(stmts["setBackupLabel"]).Exec(backupID, name, *value)
+		} else {
+			_, err = tx.Stmt(stmts["addBackupLabel"]).Exec(backupID, name, *value)
+		}
+		if err != nil {
+			tx.Rollback()
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, nil, err
+		}
+	}
+	after, err := queryBackupLabels(tx.Stmt(stmts["getBackupLabels"]), backupID)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, nil, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return before, after, nil
+}
+
+func getBackupLabels(backupID string) (map[string]string, error) {
+	return queryBackupLabels(stmts["getBackupLabels"], backupID)
+}
+
+func queryBackupLabels(stmt *sql.Stmt, backupID string) (map[string]string, error) {
+	rows, err1 := stmt.Query(backupID)
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err1
+	}
+	defer rows.Close()
+	labels := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		err2 := rows.Scan(&name, &value)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err2
+		}
+		labels[name] = value
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return labels, rows.Err()
+}
+
+//returns the labels of all backups by backup id
+func getAllBackupLabels() (map[string]map[string]string, error) {
+	rows, err1 := stmts["getAllBackupLabels"].Query()
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err1
+	}
+	defer rows.Close()
+	labels := make(map[string]map[string]string)
+	for rows.Next() {
+		var backupID, name, value string
+		err2 := rows.Scan(&backupID, &name, &value)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err2
+		}
+		if labels[backupID] == nil {
+			labels[backupID] = make(map[string]string)
+		}
+		labels[backupID][name] = value
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return labels, rows.Err()
+}
+
+//sets the status of a backup and records the change in the audit log in the same transaction
+func setStatusMaterializedBackup(backupID string, status string, actor string, reason string) (sql.Result, error) {
+	logrus.Infof("Setting status of backup %s to %s", backupID, status)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	before := ""
+	err = tx.Stmt(stmts["getStatusMaterializedBackup"]).QueryRow(backupID).Scan(&before)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	res, err0 := tx.Stmt(stmts["setStatusMaterializedBackup"]).Exec(status, backupID)
+	if err0 == nil {
+		n, _ := res.RowsAffected()
+		if n > 0 {
+			err0 = createAuditEvent(tx, AuditEvent{Actor: actor, Action: "status", ObjectType: "backup", ObjectID: backupID, Before: before, After: status, Reason: reason})
+		}
+	}
+	if err0 == nil {
+		err0 = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err0 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err0
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return res, nil
+}
+
+//changeStatusMaterializedBackup changes the status of a backup only if it is 'from', in a transaction with its audit event.
+//the backup leaves the trash and, when deleteAfter is not nil, is put back in it to be deleted after deleteAfter.
+//returns false if the backup doesn't have status 'from'
+func changeStatusMaterializedBackup(backupID string, from string, to string, deleteAfter *time.Time, actor string, reason string) (bool, error) {
+	logrus.Infof("Changing status of backup %s from %s to %s", backupID, from, to)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Stmt(stmts["changeStatusMaterializedBackup"]).Exec(to, backupID, from)
+	if err != nil {
+		tx.Rollback()
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		tx.Rollback()
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return false, nil
+	}
+	_, err = tx.Stmt(stmts["deleteBackupTrash"]).Exec(backupID)
+	if err == nil && deleteAfter != nil {
+		_, err = tx.Stmt(stmts["addBackupTrash"]).Exec(backupID, *deleteAfter, reason)
+	}
+	if err == nil {
+		err = createAuditEvent(tx, AuditEvent{Actor: actor, Action: "status", ObjectType: "backup", ObjectID: backupID, Before: from, After: to, Reason: reason})
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return false, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return true, nil
+}
+
+func createBackupHold(h BackupHold) (int, error) {
+	id, err := storage.insertID(stmts["createBackupHold"], h.BackupID, h.Selector, h.Reason, h.CreatedBy, h.CreatedAt.UTC())
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return 0, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return int(id), nil
+}
+
+func getBackupHolds() ([]BackupHold, error) {
+	rows, err := stmts["getBackupHolds"].Query()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	defer rows.Close()
+	holds := make([]BackupHold, 0)
+	for rows.Next() {
+		h := BackupHold{}
+		err = rows.Scan(&h.ID, &h.BackupID, &h.Selector, &h.Reason, &h.CreatedBy, &h.CreatedAt)
+		if err != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return holds, rows.Err()
+}
+
+func deleteBackupHold(id int) (int64, error) {
+	res, err := stmts["deleteBackupHold"].Exec(id)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return 0, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return res.RowsAffected()
+}
+
+//returns the group backup that has a member with the provider backup id, or an empty string when there is none
+//returns startTime, found, error
+func getBackupStartTime(backupID string) (time.Time, bool, error) {
+	var startTime time.Time
+	err := stmts["getBackupStartTime"].QueryRow(backupID).Scan(&startTime)
+	if err == sql.ErrNoRows {
+		metricsSQLCounter.WithLabelValues("success").Inc()
+		return time.Time{}, false, nil
+	} else if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return time.Time{}, false, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return startTime, true, nil
+}
+
+func getGroupOfMember(backupID string) (string, error) {
+	groupID := ""
+	err := stmts["getGroupOfMember"].QueryRow(backupID).Scan(&groupID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return "", err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return groupID, nil
+}
+
+func setBackupExpiry(x BackupExpiry) error {
+	var expiresAt interface{}
+	if x.ExpiresAt != nil {
+		expiresAt = x.ExpiresAt.UTC()
+	}
+	exclude := 0
+	if x.ExcludeFromTiers {
+		exclude = 1
+	}
+	_, err := stmts["setBackupExpiry"].Exec(x.BackupID, expiresAt, exclude)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+//returns the expiry of ad hoc backups by backup id
+func getBackupExpiries() (map[string]BackupExpiry, error) {
+	rows, err := stmts["getBackupExpiries"].Query()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	defer rows.Close()
+	expiries := make(map[string]BackupExpiry)
+	for rows.Next() {
+		x := BackupExpiry{}
+		exclude := 0
+		err = rows.Scan(&x.BackupID, &x.ExpiresAt, &exclude)
+		if err != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		x.ExcludeFromTiers = exclude == 1
+		expiries[x.BackupID] = x
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return expiries, rows.Err()
+}
+
+//returns the backups in the trash, the first to be deleted first
+func getBackupTrash() ([]TrashedBackup, error) {
+	rows, err := stmts["getBackupTrash"].Query()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	defer rows.Close()
+	trash := make([]TrashedBackup, 0)
+	for rows.Next() {
+		t := TrashedBackup{}
+		err = rows.Scan(&t.BackupID, &t.DeleteAfter, &t.Reason)
+		if err != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		trash = append(trash, t)
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return trash, rows.Err()
+}
+
+//returns the tier tags of all backups by backup id, as seen by tx
+func getTagsMaterializedBackups(tx *sql.Tx) (map[string][]string, error) {
+	return queryBackupTags(tx.Stmt(stmts["getAllBackupTags"]), false)
+}
+
+//returns the tags of all backups by backup id
+func getAllBackupTags() (map[string][]string, error) {
+	return queryBackupTags(stmts["getAllBackupTags"], true)
+}
+
+func queryBackupTags(stmt *sql.Stmt, withReference bool) (map[string][]string, error) {
+	rows, err := stmt.Query()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var id, tag string
+		err = rows.Scan(&id, &tag)
+		if err != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		if tag == "reference" && !withReference {
+			continue
+		}
+		tags[id] = append(tags[id], tag)
+	}
+	for _, t := range tags {
+		sortTags(t)
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return tags, rows.Err()
+}
+
+func getBackupTags(backupID string) ([]string, error) {
+	rows, err := stmts["getBackupTags"].Query(backupID)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		tags = append(tags, tag)
 	}
-	if backup.Minutely == 1 {
-		t = append(t, "minutely")
+	sortTags(tags)
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return tags, rows.Err()
+}
+
+//appends an event to the audit log, inside tx when it is not nil
+func createAuditEvent(tx *sql.Tx, e AuditEvent) error {
+	stmt := stmts["createAuditEvent"]
+	if tx != nil {
+		stmt = tx.Stmt(stmt)
 	}
-	if backup.Hourly == 1 {
-		t = append(t, "hourly")
+	if e.Time.IsZero() {
+		e.Time = time.Now()
 	}
-	if backup.Daily == 1 {
-		t = append(t, "daily")
+	_, err := stmt.Exec(e.Time.UTC(), e.Actor, e.Action, e.ObjectType, e.ObjectID, e.Before, e.After, e.Reason)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err
 	}
-	if backup.Weekly == 1 {
-		t = append(t, "weekly")
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+//returns audit events matching filter, newest first
+func getAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	until := filter.Until
+	if until.IsZero() {
+		until = time.Now().Add(24 * time.Hour)
 	}
-	if backup.Monthly == 1 {
-		t = append(t, "monthly")
+	limit := filter.Limit
+	if limit == 0 {
+		limit = math.MaxInt32
 	}
-	if backup.Yearly == 1 {
-		t = append(t, "yearly")
+	rows, err1 := stmts["getAuditEvents"].Query(filter.Actor, filter.Actor, filter.Actor+"@%", filter.Action, filter.Action, filter.ObjectType, filter.ObjectType, filter.ObjectID, filter.ObjectID, filter.Since.UTC(), until.UTC(), limit)
+	if err1 != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return []AuditEvent{}, err1
+	}
+	defer rows.Close()
+
+	events := make([]AuditEvent, 0)
+	for rows.Next() {
+		e := AuditEvent{}
+		err2 := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.ObjectType, &e.ObjectID, &e.Before, &e.After, &e.Reason)
+		if err2 != nil {
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return []AuditEvent{}, err2
+		}
+		events = append(events, e)
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return events, rows.Err()
+}
+
+//groups the backups returned by 'candidates' by their start time formatted with groupByPattern and runs 'mark' for the backup
+//of each group whose start time formatted with diffPattern is nearest to ref. times are formatted in the configured timezone,
+//so that groups are local hours, days, weeks, months and years. this is done here instead of in SQL so that it works on all storages
+func markNearestBackups(tx *sql.Tx, candidates *sql.Stmt, args []interface{}, tier retentionTier, tags []string, ref string) (sql.Result, error) {
+	//as in the former SQL implementation, a non numeric reference counts as 0
+	refValue, _ := strconv.Atoi(ref)
+
+	rows, err := tx.Stmt(candidates).Query(args...)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	groups := make([]string, 0)
+	nearest := make(map[string]string)
+	diffs := make(map[string]int)
+	for rows.Next() {
+		id := ""
+		var startTime time.Time
+		err = rows.Scan(&id, &startTime)
+		if err != nil {
+			rows.Close()
+			metricsSQLCounter.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		group, value := tier.locate(localTime(startTime))
+		diff := value - refValue
+		if diff < 0 {
+			diff = -diff
+		}
+		d, ok := diffs[group]
+		if !ok {
+			groups = append(groups, group)
+		}
+		if !ok || diff < d {
+			diffs[group] = diff
+			nearest[group] = id
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	count := int64(0)
+	m := tx.Stmt(stmts["addBackupTag"])
+	for _, group := range groups {
+		for _, tag := range tags {
+			res, err := m.Exec(nearest[group], tag)
+			if err != nil {
+				metricsSQLCounter.WithLabelValues("error").Inc()
+				return nil, err
+			}
+			n, _ := res.RowsAffected()
+			count = count + n
+		}
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return driver.RowsAffected(count), nil
+}
+
+func getTags(backup MaterializedBackup) []string {
+	if backup.Tags == nil {
+		return []string{}
 	}
-	return t
+	return backup.Tags
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -66,5 +68,54 @@ func TestGetFilteredMaterializedBackups(t *testing.T) {
 	assert.Equal(t, 2, len(backups), "backups")
 	assert.Equal(t, backups[0].ID+"1", backups[0].DataID, "backups")
 	assert.Equal(t, backups[1].ID+"1", backups[1].DataID, "backups")
-	assert.Equal(t, backups[2].ID+"1", backups[2].DataID, "backups")
+}
+
+func TestBackupTaskInCatalog(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	start := time.Now().Add(-time.Minute)
+	err := setCurrentTaskStatus("shared", "running", start)
+	assert.Nil(t, err, "err")
+	v := "prod"
+	err = saveQueuedBackup(QueuedBackup{QueuedAt: time.Now(), Labels: map[string]*string{"env": &v}, ExpiresIn: time.Hour})
+	assert.Nil(t, err, "err")
+	files, _ := ioutil.ReadDir(options.dataDir)
+	for _, f := range files {
+		assert.NotContains(t, []string{"backup-task", "backup-queue"}, f.Name(), "not kept in files")
+	}
+
+	//a new leader opening the same catalog
+	initDB()
+	backupID, backupStatus, backupTime, err := getCurrentTaskStatus()
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "shared", backupID, "backupID")
+	assert.Equal(t, "running", backupStatus, "backupStatus")
+	assert.True(t, start.Sub(backupTime) < time.Second, "backupTime")
+	q, queued := getQueuedBackup()
+	assert.True(t, queued, "queued")
+	assert.Equal(t, "prod", *q.Labels["env"], "queued labels")
+	assert.Equal(t, time.Hour, q.ExpiresIn, "queued expiry")
+
+	assert.Nil(t, setBackupQueued(false), "err")
+	assert.False(t, isBackupQueued(), "not queued")
+}
+
+func TestImportBackupTaskFiles(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	dir, err := ioutil.TempDir(options.dataDir, "db")
+	assert.Nil(t, err, "err")
+	options.dataDir = dir
+	ioutil.WriteFile(dir+"/backup-task", []byte("legacy|running|2019-03-04T10:00:00Z"), 0644)
+	ioutil.WriteFile(dir+"/backup-queue", []byte("2019-03-04T10:30:00Z"), 0644)
+
+	initDB()
+	backupID, backupStatus, _, err := getCurrentTaskStatus()
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "legacy", backupID, "backupID")
+	assert.Equal(t, "running", backupStatus, "backupStatus")
+	assert.True(t, isBackupQueued(), "queued")
+	_, err = os.Stat(dir + "/backup-task")
+	assert.True(t, os.IsNotExist(err), "task file removed")
+	_, err = os.Stat(dir + "/backup-queue")
+	assert.True(t, os.IsNotExist(err), "queue file removed")
 }
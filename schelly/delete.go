@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var deleteBacklogGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_retention_delete_backlog",
+	Help: "Backups elected for deletion or waiting for a delete retry that were not deleted on the provider yet",
+})
+
+var deleteProgressGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_retention_delete_progress_ratio",
+	Help: "Ratio of the backups of the current (or last) delete batch already processed",
+})
+
+var deleteInFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_retention_delete_in_flight",
+	Help: "Backup deletes waiting for the backup provider",
+})
+
+//deleteSemaphore bounds the provider requests of the parallel retention delete workers
+type deleteSemaphore chan struct{}
+
+func (s deleteSemaphore) Lock() {
+	s <- struct{}{}
+}
+
+func (s deleteSemaphore) Unlock() {
+	<-s
+}
+
+//serializes catalog updates of parallel deletes, as sqlite doesn't handle concurrent writers
+var deleteStatusLock = &sync.Mutex{}
+
+func initDelete() {
+	prometheus.MustRegister(deleteBacklogGauge)
+	prometheus.MustRegister(deleteProgressGauge)
+	prometheus.MustRegister(deleteInFlightGauge)
+}
+
+//deleteBackups deletes backups on the provider with up to --retention-delete-concurrency parallel requests and no more
+//than --retention-delete-rate requests per second. deferred is the number of backups left for later runs, reported in the backlog.
+//returns the number of backups deleted
+func deleteBackups(backupIDs []string, actor string, deferred int) int {
+	deleteBacklogGauge.Set(float64(len(backupIDs) + deferred))
+	deleteProgressGauge.Set(0)
+	if len(backupIDs) == 0 {
+		deleteProgressGauge.Set(1)
+		return 0
+	}
+
+	var ticker *time.Ticker
+	if options.retentionDeleteRate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / options.retentionDeleteRate))
+		defer ticker.Stop()
+	}
+	concurrency := options.retentionDeleteConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	//a single worker is serialized with the other webhook requests. parallel workers only wait for each other
+	var lock sync.Locker = webhookLock
+	if concurrency > 1 {
+		lock = make(deleteSemaphore, concurrency)
+	}
+	logrus.Debugf("Deleting %d backups. concurrency=%d rate=%.2f/s", len(backupIDs), concurrency, options.retentionDeleteRate)
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	processed := 0
+	deleted := 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for backupID := range queue {
+				deleteInFlightGauge.Inc()
+				err := deleteBackupWithLock(backupID, actor, lock)
+				deleteInFlightGauge.Dec()
+
+				deleteStatusLock.Lock()
+				if finishBackupDelete(backupID, actor, err) == nil {
+					deleted++
+				}
+				processed++
+				deleteBacklogGauge.Dec()
+				deleteProgressGauge.Set(float64(processed) / float64(len(backupIDs)))
+				deleteStatusLock.Unlock()
+			}
+		}()
+	}
+	for _, backupID := range backupIDs {
+		if ticker != nil {
+			<-ticker.C
+		}
+		queue <- backupID
+	}
+	close(queue)
+	wg.Wait()
+	return deleted
+}
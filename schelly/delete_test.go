@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteBackupsConcurrency(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	lock := &sync.Mutex{}
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionDeleteConcurrency = 3
+
+	ids := make([]string, 0)
+	for i := 0; i < 9; i++ {
+		id := fmt.Sprintf("b%d", i)
+		ids = append(ids, id)
+		_, err := createMaterializedBackup(id, id, "deleting", time.Now(), time.Now(), "", 1)
+		assert.Nil(t, err, "err")
+	}
+	deleted := deleteBackups(ids, actorCron, 0)
+	assert.Equal(t, 9, deleted, "deleted")
+	assert.Equal(t, 3, maxInFlight, "bounded concurrency")
+	backups, _ := getMaterializedBackups(0, "", "deleted", false)
+	assert.Equal(t, 9, len(backups), "status")
+
+	//deletes outside the retention workers are still serialized with the other webhook requests
+	webhookLock.Lock()
+	done := make(chan error)
+	go func() { done <- deleteBackup("b0", actorCron) }()
+	select {
+	case <-done:
+		assert.Fail(t, "delete didn't wait for the webhook lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	webhookLock.Unlock()
+	assert.Nil(t, <-done, "err")
+}
+
+func TestDeleteBackupsRate(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionDeleteConcurrency = 4
+	options.retentionDeleteRate = 20
+
+	ids := []string{"r1", "r2", "r3", "r4"}
+	for _, id := range ids {
+		createMaterializedBackup(id, id, "deleting", time.Now(), time.Now(), "", 1)
+	}
+	start := time.Now()
+	deleted := deleteBackups(ids, actorCron, 0)
+	assert.Equal(t, 4, deleted, "deleted")
+	assert.True(t, time.Since(start) >= 190*time.Millisecond, "rate limited")
+}
+
+func TestRetryAllDeleteErrors(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+
+	for i := 0; i < 15; i++ {
+		id := fmt.Sprintf("e%d", i)
+		createMaterializedBackup(id, id, "delete-error", time.Now(), time.Now(), "", 1)
+	}
+	retryDeleteErrors()
+	backups, _ := getMaterializedBackups(0, "", "delete-error", false)
+	assert.Equal(t, 0, len(backups), "all retried")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//BackupExpiry expiry of an ad hoc backup triggered with POST /backups. expired backups are deleted by the next retention run,
+//whatever their tiers. backups excluded from tiers are never tagged, so they don't take the place of a scheduled backup in a tier
+type BackupExpiry struct {
+	BackupID         string     `json:"backup_id"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ExcludeFromTiers bool       `json:"exclude_from_tiers"`
+}
+
+//setExpiry makes a backup expire after expiresIn (0 for never) and records it in the audit log
+func setExpiry(backupID string, expiresIn time.Duration, excludeFromTiers bool, actor string) (BackupExpiry, error) {
+	x := BackupExpiry{BackupID: backupID, ExcludeFromTiers: excludeFromTiers}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		x.ExpiresAt = &expiresAt
+	}
+	err := setBackupExpiry(x)
+	if err != nil {
+		return BackupExpiry{}, err
+	}
+	recordAudit(AuditEvent{Actor: actor, Action: "expiry", ObjectType: "backup", ObjectID: backupID, After: auditValue(x), Reason: "expiry from backup trigger"})
+	return x, nil
+}
+
+//appends the expired backups to the election. expired backups and backups excluded from tiers are not evaluated by tier rules
+func appendElectedForExpiry(available []MaterializedBackup, expiries map[string]BackupExpiry, e *retentionElection) {
+	now := time.Now()
+	for _, b := range available {
+		x, ok := expiries[b.ID]
+		if !ok {
+			continue
+		}
+		if x.ExpiresAt != nil && !x.ExpiresAt.After(now) {
+			e.byExpiry[b.ID] = true
+			if reason, held := e.held[b.ID]; held {
+				e.kept[b.ID] = reason
+				continue
+			}
+			e.reasons[b.ID] = fmt.Sprintf("expiry: expired at %s", localTime(*x.ExpiresAt).Format(time.RFC3339))
+			e.backups = append(e.backups, b)
+		} else if x.ExcludeFromTiers {
+			e.byExpiry[b.ID] = true
+			if x.ExpiresAt != nil {
+				e.kept[b.ID] = fmt.Sprintf("expiry: excluded from tiers until %s", localTime(*x.ExpiresAt).Format(time.RFC3339))
+			} else {
+				e.kept[b.ID] = "expiry: excluded from tiers"
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerBackupExpiry(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"adhoc-1","status":"running"}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.webhookURLs = []string{server.URL}
+	setCurrentTaskStatus("", "", time.Now())
+
+	for _, body := range []string{`{"expires_in":"soon"}`, `{"expires_in":"-1h"}`} {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"expires_in":"3d", "exclude_from_tiers":true}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp ResponseWebhook
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp), "json")
+	assert.NotNil(t, resp.ExpiresAt, "expires at in response")
+
+	expiries, err := getBackupExpiries()
+	assert.Nil(t, err, "err")
+	x := expiries["adhoc-1"]
+	assert.True(t, x.ExcludeFromTiers, "excluded from tiers")
+	assert.True(t, x.ExpiresAt.After(time.Now().Add(71*time.Hour)), "expires at")
+	events, _ := getAuditEvents(AuditFilter{Action: "expiry", ObjectID: "adhoc-1"})
+	assert.Equal(t, 1, len(events), "expiry audited")
+}
+
+func TestRetentionExpiry(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "0", "hourly": "0", "daily": "0", "weekly": "0", "monthly": "0", "yearly": "7"}, "")
+
+	now := time.Now()
+	_, err := createMaterializedBackup("expired", "expired", "available", now.Add(-3*time.Hour), now, "", 1)
+	assert.Nil(t, err, "err")
+	_, err = createMaterializedBackup("scheduled", "scheduled", "available", now.Add(-2*time.Hour), now, "", 1)
+	assert.Nil(t, err, "err")
+	_, err = createMaterializedBackup("adhoc", "adhoc", "available", now.Add(-time.Hour), now, "", 1)
+	assert.Nil(t, err, "err")
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	assert.Nil(t, setBackupExpiry(BackupExpiry{BackupID: "expired", ExpiresAt: &past}), "err")
+	assert.Nil(t, setBackupExpiry(BackupExpiry{BackupID: "adhoc", ExpiresAt: &future, ExcludeFromTiers: true}), "err")
+
+	assert.Nil(t, tagAllBackups(), "err")
+	tags, _ := getBackupTags("adhoc")
+	assert.Equal(t, 0, len(tags), "excluded backup not tagged")
+	tags, _ = getBackupTags("scheduled")
+	assert.Contains(t, tags, "yearly", "newest backup not excluded from tiers gets the tags")
+
+	plan, err := getRetentionPlan()
+	assert.Nil(t, err, "err")
+	rules := make(map[string]string)
+	for _, d := range plan {
+		rules[d.ID] = d.Action + " " + d.Rule
+	}
+	assert.Contains(t, rules["expired"], "delete expiry: expired", "expired")
+	assert.Contains(t, rules["adhoc"], "keep expiry: excluded from tiers", "excluded")
+	assert.Contains(t, rules["scheduled"], "keep yearly", "scheduled")
+
+	triggerRetentionTask(actorCron, false)
+	assert.Equal(t, []string{"/expired"}, deleted, "only the expired backup deleted")
+
+	assert.Nil(t, setBackupExpiry(BackupExpiry{BackupID: "adhoc", ExpiresAt: &past, ExcludeFromTiers: true}), "err")
+	triggerRetentionTask(actorCron, false)
+	assert.Equal(t, []string{"/expired", "/adhoc"}, deleted, "excluded backup deleted when expired")
+	b, _ := getMaterializedBackup("scheduled")
+	assert.Equal(t, "available", b.Status, "scheduled kept")
+}
+
+func TestTriggerBackupExpiryOnOverlap(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"adhoc-queued","status":"running"}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.webhookURLs = []string{server.URL}
+	setBackupQueued(false)
+	setCurrentTaskStatus("scheduled-running", "running", time.Now())
+
+	options.overlapPolicy = "skip"
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"expires_in":"3d"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	expiries, _ := getBackupExpiries()
+	assert.Equal(t, 0, len(expiries), "running backup doesn't expire when skipped")
+
+	options.overlapPolicy = "queue"
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"expires_in":"3d","exclude_from_tiers":true}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	expiries, _ = getBackupExpiries()
+	assert.Equal(t, 0, len(expiries), "running backup doesn't expire when queued")
+	q, _ := getQueuedBackup()
+	assert.Equal(t, 72*time.Hour, q.ExpiresIn, "expiry kept for the queued backup")
+
+	setCurrentTaskStatus("scheduled-running", "available", time.Now())
+	checkQueuedBackup()
+	for i := 0; i < 50 && len(expiries) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		expiries, _ = getBackupExpiries()
+	}
+	x := expiries["adhoc-queued"]
+	assert.True(t, x.ExcludeFromTiers, "queued backup excluded from tiers")
+	assert.NotNil(t, x.ExpiresAt, "queued backup expires")
+	_, found := expiries["scheduled-running"]
+	assert.False(t, found, "running backup doesn't expire")
+}
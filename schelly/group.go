@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var groupBackupCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_group_backup_total",
+	Help: "Total consistency group backups by final status",
+}, []string{
+	"status",
+})
+
+//GroupMember backup made by one of the providers of a consistency group
+type GroupMember struct {
+	ProviderURL string  `json:"provider_url"`
+	BackupID    string  `json:"backup_id"`
+	DataID      string  `json:"data_id"`
+	Status      string  `json:"status"`
+	SizeMB      float64 `json:"size_mb"`
+	Message     string  `json:"message"`
+}
+
+func initGroup() {
+	prometheus.MustRegister(groupBackupCounter)
+}
+
+//createBackup asks the backup provider for a new backup. With more than one webhook URL, all providers are
+//asked at the same time and their backups are tracked as a single consistency group backup
+func createBackup() (ResponseWebhook, error) {
+	if len(options.webhookURLs) <= 1 {
+		return createWebhookBackup(options.webhookURL)
+	}
+
+	groupID := fmt.Sprintf("group-%s-%d", options.backupName, time.Now().UnixNano())
+	logrus.Infof("Creating consistency group backup %s on %d providers", groupID, len(options.webhookURLs))
+	resps, errs := createWebhookBackups(options.webhookURLs)
+
+	failed := false
+	messages := make([]string, 0)
+	for i, url := range options.webhookURLs {
+		m := GroupMember{ProviderURL: url, BackupID: resps[i].ID, DataID: resps[i].DataID, Status: resps[i].Status, Message: resps[i].Message}
+		if errs[i] != nil {
+			m.Status = "error"
+			m.Message = errs[i].Error()
+		}
+		if m.Status != "running" {
+			failed = true
+			messages = append(messages, fmt.Sprintf("%s: %s %s", url, m.Status, m.Message))
+		}
+		err := saveGroupMember(groupID, m)
+		if err != nil {
+			logrus.Errorf("Couldn't save member %s of group %s. err=%s", url, groupID, err)
+		}
+	}
+
+	if failed {
+		logrus.Warnf("Group backup %s couldn't be created on all providers. Cleaning up the others. %s", groupID, strings.Join(messages, "; "))
+		cleanupGroup(groupID)
+		groupBackupCounter.WithLabelValues("error").Inc()
+		return ResponseWebhook{}, fmt.Errorf("Couldn't create group backup %s. %s", groupID, strings.Join(messages, "; "))
+	}
+	return ResponseWebhook{ID: groupID, DataID: groupID, Status: "running", Message: fmt.Sprintf("group backup on %d providers", len(options.webhookURLs))}, nil
+}
+
+//getBackupInfo returns backup info from the backup provider. For group backups, the group is 'running' until every member
+//finishes, 'available' when all members are available and 'error' if any member fails
+func getBackupInfo(backupID string) (ResponseWebhook, error) {
+	members, err := getGroupMembers(backupID)
+	if err != nil {
+		return ResponseWebhook{}, err
+	}
+	if len(members) == 0 {
+		return getWebhookBackupInfo(options.webhookURL, backupID)
+	}
+
+	resp := ResponseWebhook{ID: backupID, DataID: backupID}
+	running := 0
+	failed := make([]string, 0)
+	for _, m := range members {
+		if m.Status == "running" {
+			info, err := getWebhookBackupInfo(m.ProviderURL, m.BackupID)
+			if err != nil {
+				logrus.Warnf("Couldn't get info of member %s of group %s. err=%s", m.BackupID, backupID, err)
+				running++
+				continue
+			}
+			if info.Status != m.Status || info.SizeMB != m.SizeMB {
+				m.Status = info.Status
+				m.DataID = info.DataID
+				m.SizeMB = info.SizeMB
+				m.Message = info.Message
+				err = saveGroupMember(backupID, m)
+				if err != nil {
+					logrus.Errorf("Couldn't update member %s of group %s. err=%s", m.BackupID, backupID, err)
+				}
+			}
+		}
+		if m.Status == "running" {
+			running++
+		} else if m.Status != "available" {
+			failed = append(failed, fmt.Sprintf("%s: %s %s", m.ProviderURL, m.Status, m.Message))
+		}
+		resp.SizeMB += m.SizeMB
+	}
+
+	if len(failed) > 0 {
+		logrus.Warnf("Group backup %s failed. Cleaning up the other members. %s", backupID, strings.Join(failed, "; "))
+		cleanupGroup(backupID)
+		resp.Status = "error"
+		resp.Message = strings.Join(failed, "; ")
+		groupBackupCounter.WithLabelValues("error").Inc()
+	} else if running > 0 {
+		resp.Status = "running"
+	} else {
+		resp.Status = "available"
+		resp.Message = fmt.Sprintf("group backup on %d providers", len(members))
+		groupBackupCounter.WithLabelValues("available").Inc()
+	}
+	return resp, nil
+}
+
+//deleteBackup deletes a backup on the backup provider. For group backups, every member is deleted on its provider
+func deleteBackup(backupID string, actor string) error {
+	return deleteBackupWithLock(backupID, actor, webhookLock)
+}
+
+//deleteBackupWithLock deletes a backup holding lock during each request to the backup provider
+func deleteBackupWithLock(backupID string, actor string, lock sync.Locker) error {
+	members, err := getGroupMembers(backupID)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return deleteWebhookBackup(options.webhookURL, backupID, actor, lock)
+	}
+
+	failed := make([]string, 0)
+	for _, m := range members {
+		if m.Status == "deleted" || m.BackupID == "" {
+			continue
+		}
+		err = deleteWebhookBackup(m.ProviderURL, m.BackupID, actor, lock)
+		if _, held := err.(*holdError); held {
+			return err
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", m.ProviderURL, err))
+			continue
+		}
+		m.Status = "deleted"
+		err = saveGroupMember(backupID, m)
+		if err != nil {
+			logrus.Errorf("Couldn't update member %s of group %s. err=%s", m.BackupID, backupID, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Couldn't delete all members of group backup %s. %s", backupID, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+//cleanupGroup deletes the members of a failed group that were created on their providers
+func cleanupGroup(groupID string) {
+	members, err := getGroupMembers(groupID)
+	if err != nil {
+		logrus.Errorf("Couldn't get members of group %s for cleanup. err=%s", groupID, err)
+		return
+	}
+	for _, m := range members {
+		if m.BackupID == "" || m.Status == "deleted" || m.Status == "error" {
+			continue
+		}
+		err = deleteWebhookBackup(m.ProviderURL, m.BackupID, actorSystem, webhookLock)
+		if err != nil {
+			logrus.Warnf("Couldn't clean up member %s of failed group %s on %s. err=%s", m.BackupID, groupID, m.ProviderURL, err)
+			m.Status = "cleanup-error"
+		} else {
+			m.Status = "deleted"
+		}
+		err = saveGroupMember(groupID, m)
+		if err != nil {
+			logrus.Errorf("Couldn't update member %s of group %s. err=%s", m.BackupID, groupID, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func groupProvider(name string, createStatus int, infoStatus *string, deleted *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.WriteHeader(createStatus)
+			w.Write([]byte(fmt.Sprintf(`{"id":"%s-1","status":"running"}`, name)))
+		case "GET":
+			w.Write([]byte(fmt.Sprintf(`{"id":"%s-1","data_id":"d%s","status":"%s","size_mb":10}`, name, name, *infoStatus)))
+		case "DELETE":
+			*deleted = append(*deleted, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+			w.Write([]byte(fmt.Sprintf(`{"id":"%s-1","status":"deleted"}`, name)))
+		}
+	}))
+}
+
+func TestGroupBackup(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+	statusA := "running"
+	statusB := "running"
+	deleted := make([]string, 0)
+	a := groupProvider("a", 202, &statusA, &deleted)
+	defer a.Close()
+	b := groupProvider("b", 202, &statusB, &deleted)
+	defer b.Close()
+	options.webhookURLs = []string{a.URL, b.URL}
+	options.webhookURL = a.URL
+
+	resp, err := createBackup()
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "running", resp.Status, "group running")
+	members, _ := getGroupMembers(resp.ID)
+	assert.Equal(t, 2, len(members), "members")
+
+	statusA = "available"
+	info, err := getBackupInfo(resp.ID)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "running", info.Status, "still running")
+
+	statusB = "available"
+	info, err = getBackupInfo(resp.ID)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "available", info.Status, "all available")
+	assert.Equal(t, 20.0, info.SizeMB, "summed size")
+
+	err = deleteBackup(resp.ID, actorCron)
+	assert.Nil(t, err, "err")
+	assert.ElementsMatch(t, []string{"a-1", "b-1"}, deleted, "deleted on every provider")
+	members, _ = getGroupMembers(resp.ID)
+	assert.Equal(t, "deleted", members[0].Status, "member deleted")
+}
+
+func TestGroupBackupFailure(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+	statusA := "running"
+	statusB := "running"
+	deleted := make([]string, 0)
+	a := groupProvider("a", 202, &statusA, &deleted)
+	defer a.Close()
+	b := groupProvider("b", 500, &statusB, &deleted)
+	defer b.Close()
+	options.webhookURLs = []string{a.URL, b.URL}
+	options.webhookURL = a.URL
+
+	_, err := createBackup()
+	assert.NotNil(t, err, "creation failed on one provider")
+	assert.Equal(t, []string{"a-1"}, deleted, "backup of the other provider cleaned up")
+
+	deleted = deleted[:0]
+	b.Close()
+	b = groupProvider("b", 202, &statusB, &deleted)
+	options.webhookURLs = []string{a.URL, b.URL}
+	resp, err := createBackup()
+	assert.Nil(t, err, "err")
+	statusB = "error"
+	info, err := getBackupInfo(resp.ID)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "error", info.Status, "group failed")
+	assert.Equal(t, []string{"a-1"}, deleted, "available member cleaned up")
+}
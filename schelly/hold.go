@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var deleteBlockedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "schelly_backup_delete_blocked_total",
+	Help: "Total attempts to delete a backup under legal hold or WORM period on the backup provider",
+})
+
+//BackupHold a legal hold on a backup or on the backups whose labels match a selector. held backups are never deleted on the provider
+type BackupHold struct {
+	ID        int       `json:"id"`
+	BackupID  string    `json:"backup_id,omitempty"`
+	Selector  string    `json:"selector,omitempty"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+//holdError returned when the delete of a held backup is refused
+type holdError struct {
+	backupID string
+	reason   string
+}
+
+func (e *holdError) Error() string {
+	return fmt.Sprintf("Backup %s can't be deleted. %s", e.backupID, e.reason)
+}
+
+func initHold() {
+	prometheus.MustRegister(deleteBlockedCounter)
+}
+
+//validateHold checks that a hold is for exactly one backup or a non empty label selector
+func validateHold(h BackupHold) error {
+	if (h.BackupID == "") == (h.Selector == "") {
+		return fmt.Errorf("A hold must have either 'backup_id' or 'selector'")
+	}
+	if h.Selector != "" {
+		reqs, err := parseLabelSelector(h.Selector)
+		if err != nil {
+			return err
+		}
+		if len(reqs) == 0 {
+			return fmt.Errorf("Empty hold selector")
+		}
+	}
+	return nil
+}
+
+//holdReason returns why a backup started at startTime with labels can't be deleted, or an empty string when it can
+func holdReason(backupID string, startTime time.Time, labels map[string]string, holds []BackupHold, now time.Time) string {
+	if options.wormPeriod > 0 && startTime.Add(options.wormPeriod).After(now) {
+		return fmt.Sprintf("worm: immutable until %s", localTime(startTime.Add(options.wormPeriod)).Format(time.RFC3339))
+	}
+	for _, h := range holds {
+		if h.BackupID == backupID {
+			return fmt.Sprintf("legal hold %d: %s", h.ID, h.Reason)
+		}
+		if h.Selector != "" {
+			reqs, err := parseLabelSelector(h.Selector)
+			if err == nil && matchesLabelSelector(labels, reqs) {
+				return fmt.Sprintf("legal hold %d (%s): %s", h.ID, h.Selector, h.Reason)
+			}
+		}
+	}
+	return ""
+}
+
+//heldBackups returns the reason each held backup can't be deleted, by backup id
+func heldBackups(backups []MaterializedBackup) (map[string]string, error) {
+	held := make(map[string]string)
+	holds, err := getBackupHolds()
+	if err != nil {
+		return nil, err
+	}
+	if options.wormPeriod == 0 && len(holds) == 0 {
+		return held, nil
+	}
+	labels, err := getAllBackupLabels()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, b := range backups {
+		if reason := holdReason(b.ID, b.StartTime, labels[b.ID], holds, now); reason != "" {
+			held[b.ID] = reason
+		}
+	}
+	return held, nil
+}
+
+//checkDeleteAllowed refuses the delete of a held backup with a holdError, recording the attempt in the audit log.
+//backupID may be the id of a group member on its provider. backups not in the catalog yet (running) were just started.
+//members of a failed group are not kept by the WORM period, as they never became a restorable backup and the group
+//cleanup must remove them, but legal holds still apply. when holds can't be verified, the delete is refused
+func checkDeleteAllowed(backupID string, actor string) error {
+	catalogID := backupID
+	startTime, found, err := getBackupStartTime(backupID)
+	if err != nil {
+		return fmt.Errorf("Couldn't verify holds of backup %s. Delete refused. err=%s", backupID, err)
+	}
+	if !found {
+		startTime = time.Now()
+		groupID, err0 := getGroupOfMember(backupID)
+		if err0 != nil {
+			return fmt.Errorf("Couldn't verify holds of backup %s. Delete refused. err=%s", backupID, err0)
+		}
+		if groupID != "" {
+			catalogID = groupID
+			groupStart, groupFound, err1 := getBackupStartTime(groupID)
+			if err1 != nil {
+				return fmt.Errorf("Couldn't verify holds of backup %s. Delete refused. err=%s", backupID, err1)
+			}
+			if groupFound {
+				startTime = groupStart
+			}
+			failed, err2 := groupFailed(groupID)
+			if err2 != nil {
+				return fmt.Errorf("Couldn't verify holds of backup %s. Delete refused. err=%s", backupID, err2)
+			}
+			if failed {
+				//a zero start time is outside any WORM period
+				startTime = time.Time{}
+			}
+		}
+	}
+	holds, err := getBackupHolds()
+	if err != nil {
+		return fmt.Errorf("Couldn't verify holds of backup %s. Delete refused. err=%s", backupID, err)
+	}
+	labels, err := getBackupLabels(catalogID)
+	if err != nil {
+		return fmt.Errorf("Couldn't verify holds of backup %s. Delete refused. err=%s", backupID, err)
+	}
+	reason := holdReason(catalogID, startTime, labels, holds, time.Now())
+	if reason == "" {
+		return nil
+	}
+	logrus.Warnf("Refusing to delete backup %s requested by %s. %s", backupID, actor, reason)
+	deleteBlockedCounter.Inc()
+	recordAudit(AuditEvent{Actor: actor, Action: "delete-blocked", ObjectType: "backup", ObjectID: catalogID, Reason: reason})
+	return &holdError{backupID: catalogID, reason: reason}
+}
+
+//a group failed when one of its members didn't become available on its provider
+func groupFailed(groupID string) (bool, error) {
+	members, err := getGroupMembers(groupID)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range members {
+		if m.Status != "running" && m.Status != "available" && m.Status != "deleted" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//placeHold creates a legal hold and records it in the audit log
+func placeHold(h BackupHold) (BackupHold, error) {
+	h.CreatedAt = time.Now()
+	id, err := createBackupHold(h)
+	if err != nil {
+		return BackupHold{}, err
+	}
+	h.ID = id
+	object := h.BackupID
+	if object == "" {
+		object = h.Selector
+	}
+	logrus.Infof("Legal hold %d placed on %s by %s. reason=%s", h.ID, object, h.CreatedBy, h.Reason)
+	recordAudit(AuditEvent{Actor: h.CreatedBy, Action: "hold", ObjectType: "hold", ObjectID: strconv.Itoa(h.ID), After: auditValue(h), Reason: h.Reason})
+	return h, nil
+}
+
+//releaseHold removes a legal hold and records it in the audit log. returns false if the hold doesn't exist
+func releaseHold(id int, actor string, reason string) (bool, error) {
+	holds, err := getBackupHolds()
+	if err != nil {
+		return false, err
+	}
+	for _, h := range holds {
+		if h.ID != id {
+			continue
+		}
+		_, err = deleteBackupHold(id)
+		if err != nil {
+			return false, err
+		}
+		logrus.Infof("Legal hold %d released by %s. reason=%s", id, actor, reason)
+		recordAudit(AuditEvent{Actor: actor, Action: "release", ObjectType: "hold", ObjectID: strconv.Itoa(id), Before: auditValue(h), Reason: reason})
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWormPeriod(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "0", "hourly": "0", "daily": "0", "weekly": "0", "monthly": "0", "yearly": "0"}, "")
+	options.wormPeriod = 24 * time.Hour
+
+	_, err := createMaterializedBackup("recent", "recent", "available", time.Now().Add(-time.Hour), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+	_, err = createMaterializedBackup("old", "old", "available", time.Now().Add(-48*time.Hour), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+
+	plan, err := getRetentionPlan()
+	assert.Nil(t, err, "err")
+	for _, d := range plan {
+		if d.ID == "recent" {
+			assert.Equal(t, "keep", d.Action, "held backup kept")
+			assert.Contains(t, d.Rule, "worm", "rule")
+		}
+	}
+
+	result := triggerRetentionTask(actorCron, false)
+	assert.Equal(t, 1, result.Deleted, "deleted")
+	assert.Equal(t, []string{"/old"}, deleted, "only the old backup deleted on provider")
+
+	//a delete that doesn't go through retention is refused too
+	err = deleteWebhookBackup(server.URL, "recent", "api:test", webhookLock)
+	_, held := err.(*holdError)
+	assert.True(t, held, "hold error")
+	assert.Equal(t, []string{"/old"}, deleted, "recent not deleted on provider")
+	events, err := getAuditEvents(AuditFilter{Action: "delete-blocked", Limit: 10})
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 1, len(events), "blocked delete audited")
+	assert.Equal(t, "recent", events[0].ObjectID, "audited backup")
+	assert.Equal(t, "api:test", events[0].Actor, "audited actor")
+
+	//a held backup elected before the hold goes back to available
+	assert.NotNil(t, finishBackupDelete("recent", actorCron, deleteBackup("recent", actorCron)), "refused")
+	b, _ := getMaterializedBackup("recent")
+	assert.Equal(t, "available", b.Status, "status")
+}
+
+func TestLegalHold(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "0", "hourly": "0", "daily": "0", "weekly": "0", "monthly": "0", "yearly": "0"}, "")
+
+	for _, id := range []string{"h1", "h2", "h3"} {
+		_, err := createMaterializedBackup(id, id, "available", time.Now().Add(-time.Hour), time.Now(), "", 1)
+		assert.Nil(t, err, "err")
+	}
+	v := "legal"
+	_, err := setBackupLabels("h2", map[string]*string{"case": &v}, true, actorSystem, "")
+	assert.Nil(t, err, "err")
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/holds", bytes.NewBufferString(body)))
+		return rec
+	}
+	assert.Equal(t, http.StatusBadRequest, post(`{"reason":"none"}`).Code, "no target")
+	assert.Equal(t, http.StatusBadRequest, post(`{"backup_id":"h1","selector":"case=legal"}`).Code, "two targets")
+	assert.Equal(t, http.StatusBadRequest, post(`{"selector":"=legal"}`).Code, "invalid selector")
+	rec := post(`{"backup_id":"h1","reason":"audit 2019"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code, "hold on backup")
+	var h BackupHold
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &h), "json")
+	assert.Equal(t, "audit 2019", h.Reason, "reason")
+	assert.Equal(t, http.StatusCreated, post(`{"selector":"case=legal","reason":"lawsuit"}`).Code, "hold on label")
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/holds", nil))
+	var holds []BackupHold
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &holds), "json")
+	assert.Equal(t, 2, len(holds), "holds")
+
+	result := triggerRetentionTask(actorCron, false)
+	assert.Equal(t, 1, result.Deleted, "deleted")
+	assert.Equal(t, []string{"/h3"}, deleted, "held backups not deleted")
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("DELETE", "/holds/999", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "hold not found")
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("DELETE", "/holds/1?reason=closed", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "released")
+	events, _ := getAuditEvents(AuditFilter{Action: "release", Limit: 10})
+	assert.Equal(t, 1, len(events), "release audited")
+	assert.Equal(t, "closed", events[0].Reason, "release reason")
+
+	triggerRetentionTask(actorCron, false)
+	assert.Equal(t, []string{"/h3", "/h1"}, deleted, "released backup deleted")
+	b, _ := getMaterializedBackup("h2")
+	assert.Equal(t, "available", b.Status, "still held by label")
+}
+
+func TestWormPeriodGroupMembers(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.wormPeriod = 24 * time.Hour
+
+	//members of a running group are kept like any just started backup
+	assert.Nil(t, saveGroupMember("group-running", GroupMember{ProviderURL: server.URL, BackupID: "r1", Status: "running"}), "err")
+	assert.Nil(t, saveGroupMember("group-running", GroupMember{ProviderURL: server.URL + "/b", BackupID: "r2", Status: "running"}), "err")
+	err := deleteWebhookBackup(server.URL, "r1", actorSystem, webhookLock)
+	_, held := err.(*holdError)
+	assert.True(t, held, "running group member held")
+
+	//members of a failed group never became a backup and are cleaned up
+	assert.Nil(t, saveGroupMember("group-failed", GroupMember{ProviderURL: server.URL, BackupID: "f1", Status: "running"}), "err")
+	assert.Nil(t, saveGroupMember("group-failed", GroupMember{ProviderURL: server.URL + "/b", Status: "error"}), "err")
+	cleanupGroup("group-failed")
+	assert.Equal(t, []string{"/f1"}, deleted, "failed group member cleaned up")
+
+	//legal holds still apply to them
+	_, err = placeHold(BackupHold{BackupID: "group-failed2", Reason: "lawsuit"})
+	assert.Nil(t, err, "err")
+	assert.Nil(t, saveGroupMember("group-failed2", GroupMember{ProviderURL: server.URL, BackupID: "f2", Status: "running"}), "err")
+	assert.Nil(t, saveGroupMember("group-failed2", GroupMember{ProviderURL: server.URL + "/b", Status: "error"}), "err")
+	cleanupGroup("group-failed2")
+	assert.Equal(t, []string{"/f1"}, deleted, "held failed group member not deleted")
+}
+
+func TestDeleteRefusedWhenCatalogUnavailable(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	_, err := createMaterializedBackup("c1", "c1", "available", time.Now().Add(-48*time.Hour), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+
+	db.Close()
+	defer initTestDB(t)
+	err = deleteWebhookBackup(server.URL, "c1", actorSystem, webhookLock)
+	assert.NotNil(t, err, "delete refused")
+	_, held := err.(*holdError)
+	assert.False(t, held, "not a hold")
+	assert.False(t, called, "provider not called")
+}
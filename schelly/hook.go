@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var hookInvocationHist = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "schelly_hook_invocation",
+	Help:    "Total duration of pre and post backup hook calls",
+	Buckets: []float64{0.1, 1, 10, 60},
+}, []string{
+	// pre-backup or post-backup
+	"phase",
+	// hook result
+	"status",
+})
+
+//HookExecution result of a pre or post backup hook
+type HookExecution struct {
+	BackupID  string    `json:"backup_id"`
+	Phase     string    `json:"phase"`
+	Hook      string    `json:"hook"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+const maxHookOutput = 4096
+
+func initHook() {
+	prometheus.MustRegister(hookInvocationHist)
+}
+
+//runHook runs a hook for phase ('pre-backup' or 'post-backup'). Hooks starting with http:// or https:// are called with a
+//POST with backup info as json body and succeed on a 2xx status. Other hooks are run as local commands with 'sh -c' and backup
+//info in SCHELLY_* env vars, succeeding on exit code 0
+func runHook(phase string, hook string, backupID string, backupStatus string) HookExecution {
+	he := HookExecution{BackupID: backupID, Phase: phase, Hook: hook, StartTime: time.Now()}
+	logrus.Infof("Running %s hook '%s'", phase, hook)
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.hookTimeout)
+	defer cancel()
+
+	var err error
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		he.Message, err = runHTTPHook(ctx, hook, phase, backupID, backupStatus)
+	} else {
+		he.Message, err = runCommandHook(ctx, hook, phase, backupID, backupStatus)
+	}
+	he.EndTime = time.Now()
+
+	if err != nil {
+		he.Status = "error"
+		he.Message = strings.TrimSpace(fmt.Sprintf("%s %s", err, he.Message))
+		logrus.Warnf("%s hook '%s' failed. %s", phase, hook, he.Message)
+	} else {
+		he.Status = "success"
+		logrus.Debugf("%s hook '%s' succeeded. %s", phase, hook, he.Message)
+	}
+	if len(he.Message) > maxHookOutput {
+		he.Message = he.Message[:maxHookOutput]
+	}
+	hookInvocationHist.WithLabelValues(phase, he.Status).Observe(he.EndTime.Sub(he.StartTime).Seconds())
+	return he
+}
+
+func runHTTPHook(ctx context.Context, url string, phase string, backupID string, backupStatus string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"phase": phase, "backup_name": options.backupName, "backup_id": backupID, "status": backupStatus})
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHookOutput))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return string(data), fmt.Errorf("Hook returned status %d", resp.StatusCode)
+	}
+	return string(data), nil
+}
+
+func runCommandHook(ctx context.Context, command string, phase string, backupID string, backupStatus string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"SCHELLY_HOOK_PHASE="+phase,
+		"SCHELLY_BACKUP_NAME="+options.backupName,
+		"SCHELLY_BACKUP_ID="+backupID,
+		"SCHELLY_BACKUP_STATUS="+backupStatus)
+	//run in its own process group so that child processes are killed on timeout too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		return out.String(), err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.String(), fmt.Errorf("Hook timed out after %s", options.hookTimeout)
+	}
+}
+
+//saves a hook execution to the catalog
+func recordHookExecution(he HookExecution) {
+	err := createHookExecution(he)
+	if err != nil {
+		logrus.Errorf("Couldn't save %s hook result for backup %s. err=%s", he.Phase, he.BackupID, err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandHook(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	options.backupName = "db"
+	options.hookTimeout = 5 * time.Second
+
+	he := runHook("post-backup", "echo $SCHELLY_HOOK_PHASE $SCHELLY_BACKUP_NAME $SCHELLY_BACKUP_ID $SCHELLY_BACKUP_STATUS", "b1", "available")
+	assert.Equal(t, "success", he.Status, "status")
+	assert.Equal(t, "post-backup db b1 available\n", he.Message, "output")
+
+	he = runHook("pre-backup", "echo failing; exit 3", "", "")
+	assert.Equal(t, "error", he.Status, "status")
+	assert.Contains(t, he.Message, "failing", "output")
+
+	options.hookTimeout = 100 * time.Millisecond
+	he = runHook("pre-backup", "sleep 2", "", "")
+	assert.Equal(t, "error", he.Status, "timeout")
+	assert.Contains(t, he.Message, "timed out", "timeout message")
+}
+
+func TestHTTPHook(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	options.hookTimeout = 5 * time.Second
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("maintenance mode on"))
+	}))
+	defer server.Close()
+
+	he := runHook("pre-backup", server.URL, "", "")
+	assert.Equal(t, "success", he.Status, "status")
+	assert.Equal(t, "maintenance mode on", he.Message, "body")
+
+	status = 503
+	he = runHook("pre-backup", server.URL, "", "")
+	assert.Equal(t, "error", he.Status, "status")
+}
+
+func TestPreBackupHookAbort(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+	created := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		created = true
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"hooked","status":"running"}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.hookTimeout = 5 * time.Second
+	setCurrentTaskStatus("old", "available", time.Now())
+
+	options.preBackupHook = "exit 1"
+	options.preBackupHookPolicy = "abort"
+	resp, err := triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "aborted", resp.Status, "aborted")
+	assert.False(t, created, "backup not created")
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code, "aborted by the API")
+	var aborted ResponseWebhook
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &aborted), "json")
+	assert.Equal(t, "aborted", aborted.Status, "aborted status")
+	assert.Contains(t, aborted.Message, "pre-backup hook failed", "hook message")
+	assert.False(t, created, "backup not created")
+
+	options.preBackupHookPolicy = "continue"
+	resp, err = triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "hooked", resp.ID, "backup created")
+	hes, _ := getHookExecutions("hooked")
+	assert.Equal(t, 1, len(hes), "hook recorded")
+	assert.Equal(t, "error", hes[0].Status, "hook status")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var labelNameRegex = regexp.MustCompile("^[A-Za-z0-9]([A-Za-z0-9_./-]{0,61}[A-Za-z0-9])?$")
+
+const maxLabelValueLength = 255
+
+//labelRequirement one term of a label selector
+type labelRequirement struct {
+	name     string
+	operator string
+	value    string
+}
+
+//validateLabels checks label names and values. a nil value (removal) is accepted when allowRemoval is true
+func validateLabels(labels map[string]*string, allowRemoval bool) error {
+	for name, value := range labels {
+		if !labelNameRegex.MatchString(name) {
+			return fmt.Errorf("Invalid label name '%s'. Use up to 63 letters, digits, '_', '.', '-' or '/', starting and ending with a letter or digit", name)
+		}
+		if value == nil {
+			if !allowRemoval {
+				return fmt.Errorf("Label '%s' must have a value", name)
+			}
+		} else if len(*value) > maxLabelValueLength {
+			return fmt.Errorf("Value of label '%s' is longer than %d characters", name, maxLabelValueLength)
+		}
+	}
+	return nil
+}
+
+//labelValues converts a map of label values to the format accepted by validateLabels and setBackupLabels
+func labelValues(labels map[string]string) map[string]*string {
+	result := make(map[string]*string)
+	for name, value := range labels {
+		v := value
+		result[name] = &v
+	}
+	return result
+}
+
+//parseLabelSelector parses comma separated requirements: 'name=value', 'name==value', 'name!=value', 'name' (has label) and '!name' (doesn't have label)
+func parseLabelSelector(selector string) ([]labelRequirement, error) {
+	reqs := make([]labelRequirement, 0)
+	if strings.TrimSpace(selector) == "" {
+		return reqs, nil
+	}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		req := labelRequirement{}
+		if strings.Contains(term, "!=") {
+			parts := strings.SplitN(term, "!=", 2)
+			req = labelRequirement{strings.TrimSpace(parts[0]), "!=", strings.TrimSpace(parts[1])}
+		} else if strings.Contains(term, "=") {
+			parts := strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2)
+			req = labelRequirement{strings.TrimSpace(parts[0]), "=", strings.TrimSpace(parts[1])}
+		} else if strings.HasPrefix(term, "!") {
+			req = labelRequirement{strings.TrimSpace(term[1:]), "!", ""}
+		} else {
+			req = labelRequirement{term, "exists", ""}
+		}
+		if !labelNameRegex.MatchString(req.name) {
+			return nil, fmt.Errorf("Invalid label selector term '%s'", term)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+//matchesLabelSelector returns true when labels satisfy all requirements. as in kubernetes, 'name!=value' matches backups without the label
+func matchesLabelSelector(labels map[string]string, reqs []labelRequirement) bool {
+	for _, req := range reqs {
+		value, ok := labels[req.name]
+		switch req.operator {
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//setBackupLabels adds, changes (non nil values) and removes (nil values) labels of a backup, recording the change in the audit log.
+//when overwrite is false, labels the backup already has are kept
+func setBackupLabels(backupID string, labels map[string]*string, overwrite bool, actor string, reason string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return getBackupLabels(backupID)
+	}
+	before, after, err := updateBackupLabels(backupID, labels, overwrite)
+	if err != nil {
+		return nil, err
+	}
+	if auditValue(before) != auditValue(after) {
+		logrus.Debugf("Labels of backup %s changed to %v", backupID, after)
+		recordAudit(AuditEvent{Actor: actor, Action: "labels", ObjectType: "backup", ObjectID: backupID, Before: auditValue(before), After: auditValue(after), Reason: reason})
+	}
+	return after, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	labels := map[string]string{"env": "prod", "release": "1.2.0"}
+	cases := map[string]bool{
+		"":                         true,
+		"env=prod":                 true,
+		"env==prod":                true,
+		"env=dev":                  false,
+		"env=prod,release=1.2.0":   true,
+		"env=prod,release=1.3.0":   false,
+		"reason!=manual":           true,
+		"env!=prod":                false,
+		"incident":                 false,
+		"release":                  true,
+		"!incident":                true,
+		"!env":                     false,
+		" env = prod , !incident ": true,
+	}
+	for selector, match := range cases {
+		reqs, err := parseLabelSelector(selector)
+		assert.Nil(t, err, selector)
+		assert.Equal(t, match, matchesLabelSelector(labels, reqs), selector)
+	}
+	for _, selector := range []string{"=prod", "env=prod,", "e nv=prod", "!", "env' OR '1'='1"} {
+		_, err := parseLabelSelector(selector)
+		assert.NotNil(t, err, selector)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	v := "1.2.0"
+	long := strings.Repeat("x", 256)
+	assert.Nil(t, validateLabels(map[string]*string{"release": &v, "app.kubernetes.io/name": &v}, false), "valid")
+	assert.NotNil(t, validateLabels(map[string]*string{"-release": &v}, false), "invalid name")
+	assert.NotNil(t, validateLabels(map[string]*string{"release": &long}, false), "long value")
+	assert.NotNil(t, validateLabels(map[string]*string{"release": nil}, false), "removal not allowed")
+	assert.Nil(t, validateLabels(map[string]*string{"release": nil}, true), "removal")
+}
+
+func TestBackupLabelsAPI(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	_, err := createMaterializedBackup("lab-1", "d1", "available", time.Now(), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+	_, err = createMaterializedBackup("lab-2", "d2", "available", time.Now(), time.Now(), "", 1)
+	assert.Nil(t, err, "err")
+
+	patch := func(id string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/backups/"+id, strings.NewReader(body))
+		req.Header.Set("X-Schelly-Actor", "release-bot")
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+	rec := patch("lab-1", `{"labels":{"env":"prod","release":"1.2.0","reason":"manual"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = patch("lab-2", `{"labels":{"env":"prod","incident":"INC-42"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = patch("lab-1", `{"labels":{"reason":null}}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"labels":{"env":"prod","release":"1.2.0"}`, "label removed")
+
+	assert.Equal(t, http.StatusNotFound, patch("unknown", `{"labels":{"env":"prod"}}`).Code, "unknown backup")
+	assert.Equal(t, http.StatusBadRequest, patch("lab-1", `{"labels":{"bad name":"x"}}`).Code, "invalid label")
+
+	code, backups := getBackupsAPI(t, url.Values{"selector": {"env=prod,reason!=manual"}})
+	assert.Equal(t, http.StatusOK, code, "status")
+	assert.Equal(t, 2, len(backups), "both prod")
+	_, backups = getBackupsAPI(t, url.Values{"selector": {"incident"}})
+	assert.Equal(t, 1, len(backups), "with incident")
+	assert.Equal(t, "lab-2", backups[0].ID, "with incident")
+	assert.Equal(t, "INC-42", backups[0].Labels["incident"], "labels in response")
+	_, backups = getBackupsAPI(t, url.Values{"selector": {"release=1.2.0"}})
+	assert.Equal(t, 1, len(backups), "release")
+	code, _ = getBackupsAPI(t, url.Values{"selector": {"=x"}})
+	assert.Equal(t, http.StatusBadRequest, code, "invalid selector")
+
+	events, _ := getAuditEvents(AuditFilter{Action: "labels", ObjectID: "lab-1"})
+	assert.Equal(t, 2, len(events), "label changes audited")
+	assert.Equal(t, "api:release-bot@192.0.2.1", events[0].Actor, "actor")
+}
+
+func TestBackupLabelsFromTriggerAndProvider(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"lab-new","status":"running","labels":{"provider":"s3","env":"provider-env"}}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.webhookURLs = []string{server.URL}
+	setCurrentTaskStatus("", "", time.Now())
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"labels":{"env":"prod","release":"1.2.0"}}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	labels, err := getBackupLabels("lab-new")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, map[string]string{"env": "prod", "release": "1.2.0", "provider": "s3"}, labels, "trigger labels win over provider labels")
+
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"labels":{"env":"prod","bad name":"x"}}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "invalid labels")
+}
+
+func TestBackupLabelsOnOverlap(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"lab-queued","status":"running"}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.webhookURLs = []string{server.URL}
+	setBackupQueued(false)
+	setCurrentTaskStatus("lab-running", "running", time.Now())
+
+	options.overlapPolicy = "skip"
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"labels":{"env":"prod"}}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	labels, _ := getBackupLabels("lab-running")
+	assert.Equal(t, 0, len(labels), "running backup not labeled when skipped")
+
+	options.overlapPolicy = "queue"
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups", strings.NewReader(`{"labels":{"env":"prod"}}`)))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	labels, _ = getBackupLabels("lab-running")
+	assert.Equal(t, 0, len(labels), "running backup not labeled when queued")
+	q, queued := getQueuedBackup()
+	assert.True(t, queued, "queued")
+	assert.Equal(t, "prod", *q.Labels["env"], "labels kept for the queued backup")
+
+	setCurrentTaskStatus("lab-running", "available", time.Now())
+	checkQueuedBackup()
+	for i := 0; i < 50 && len(labels) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		labels, _ = getBackupLabels("lab-queued")
+	}
+	assert.Equal(t, map[string]string{"env": "prod"}, labels, "queued backup labeled")
+}
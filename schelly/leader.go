@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_leader",
+	Help: "1 if this instance holds the leader lease and runs scheduled tasks, 0 if it is a follower",
+})
+
+var leaderTransitionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_leader_transition_total",
+	Help: "Total leadership changes of this instance",
+}, []string{
+	"transition",
+})
+
+//leaseStore keeps the leader lease shared by Schelly replicas
+type leaseStore interface {
+	//acquires or renews the lease for holder until now+ttl. returns whether holder is the leader and the current holder
+	acquire(holder string, ttl time.Duration, now time.Time) (bool, string, error)
+	//gives up the lease if it is held by holder
+	release(holder string, now time.Time) error
+}
+
+//LeaderStatus leadership state of this instance
+type LeaderStatus struct {
+	InstanceID string    `json:"instance_id"`
+	Leader     bool      `json:"leader"`
+	Holder     string    `json:"holder"`
+	RenewedAt  time.Time `json:"renewed_at,omitempty"`
+}
+
+var leaderMutex = &sync.Mutex{}
+var leaderStatus = LeaderStatus{Leader: true}
+var leases leaseStore
+
+func initLeader() {
+	prometheus.MustRegister(leaderGauge)
+	prometheus.MustRegister(leaderTransitionCounter)
+	leaderStatus = LeaderStatus{InstanceID: options.instanceID, Leader: options.leaderLease == 0, Holder: options.instanceID}
+	if leaderStatus.Leader {
+		leaderGauge.Set(1)
+	}
+}
+
+//returns the lease store for the catalog. sqlite catalogs use a lock file in the data dir, which should be on storage shared by the replicas
+func newLeaseStore() leaseStore {
+	if _, ok := storage.(sqliteStorage); ok {
+		return fileLease{file: fmt.Sprintf("%s/leader.lock", options.dataDir)}
+	}
+	return catalogLease{name: options.backupName}
+}
+
+func isLeader() bool {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+	return leaderStatus.Leader
+}
+
+func getLeaderStatus() LeaderStatus {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+	return leaderStatus
+}
+
+//leaderOnly wraps a scheduled task so that it only runs on the leader
+func leaderOnly(task func()) func() {
+	return func() {
+		if !isLeader() {
+			logrus.Debugf("Not the leader. Skipping scheduled task")
+			return
+		}
+		task()
+	}
+}
+
+//tries to acquire or renew the leader lease. onLeader is called when this instance becomes the leader
+func checkLeadership(onLeader func()) {
+	if options.leaderLease == 0 {
+		return
+	}
+	now := time.Now()
+	leader, holder, err := leases.acquire(options.instanceID, options.leaderLease, now)
+	if err != nil {
+		//a leader that can't renew its lease must stop before another replica takes over
+		logrus.Warnf("Couldn't renew leader lease. err=%s", err)
+		leader = false
+		holder = ""
+	}
+
+	leaderMutex.Lock()
+	was := leaderStatus.Leader
+	leaderStatus.Leader = leader
+	leaderStatus.Holder = holder
+	if leader {
+		leaderStatus.RenewedAt = now
+	}
+	leaderMutex.Unlock()
+
+	if leader {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+	if leader && !was {
+		logrus.Infof("This instance (%s) is now the leader", options.instanceID)
+		leaderTransitionCounter.WithLabelValues("acquired").Inc()
+		if onLeader != nil {
+			go onLeader()
+		}
+	} else if !leader && was {
+		logrus.Warnf("This instance (%s) is no longer the leader. Current leader: %s", options.instanceID, holder)
+		leaderTransitionCounter.WithLabelValues("lost").Inc()
+	}
+}
+
+//runs checkLeadership periodically, renewing the lease three times per lease duration
+func runLeaderElection(onLeader func()) {
+	if options.leaderLease == 0 {
+		return
+	}
+	for {
+		time.Sleep(options.leaderLease / 3)
+		checkLeadership(onLeader)
+	}
+}
+
+//releaseLeadership gives up the lease so that a follower takes over right away
+func releaseLeadership() {
+	if options.leaderLease == 0 || !isLeader() {
+		return
+	}
+	err := leases.release(options.instanceID, time.Now())
+	if err != nil {
+		logrus.Warnf("Couldn't release leader lease. err=%s", err)
+	}
+}
+
+//followerReadOnly rejects state changing API requests on followers. they must be sent to the leader
+func followerReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && !isLeader() {
+			ls := getLeaderStatus()
+			w.Header().Set("X-Schelly-Leader", ls.Holder)
+			http.Error(w, fmt.Sprintf("This instance is a read only follower. Send it to the leader '%s'", ls.Holder), http.StatusServiceUnavailable)
+			apiInvocationsCounter.WithLabelValues("error").Inc()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//catalogLease keeps the lease in the leader_lease table of the catalog database
+type catalogLease struct {
+	name string
+}
+
+func (l catalogLease) acquire(holder string, ttl time.Duration, now time.Time) (bool, string, error) {
+	_, err := stmts["createLeaderLease"].Exec(l.name, "", time.Unix(0, 0).UTC())
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return false, "", err
+	}
+	res, err := stmts["acquireLeaderLease"].Exec(holder, now.Add(ttl).UTC(), l.name, holder, now.UTC())
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return false, "", err
+	}
+	n, _ := res.RowsAffected()
+	current := ""
+	var expiresAt time.Time
+	err = stmts["getLeaderLease"].QueryRow(l.name).Scan(&current, &expiresAt)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return false, "", err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return n == 1, current, nil
+}
+
+func (l catalogLease) release(holder string, now time.Time) error {
+	_, err := stmts["releaseLeaderLease"].Exec(now.UTC(), l.name, holder)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return nil
+}
+
+//fileLease keeps the lease in a lock file with 'holder|expiration'. a guard file created exclusively protects its updates
+type fileLease struct {
+	file string
+}
+
+func (l fileLease) acquire(holder string, ttl time.Duration, now time.Time) (bool, string, error) {
+	err := l.lock(ttl)
+	if err != nil {
+		return false, "", err
+	}
+	defer os.Remove(l.file + ".guard")
+
+	current, expiresAt, err := l.read()
+	if err != nil {
+		return false, "", err
+	}
+	if current != "" && current != holder && now.Before(expiresAt) {
+		return false, current, nil
+	}
+	err = l.write(holder, now.Add(ttl))
+	if err != nil {
+		return false, "", err
+	}
+	return true, holder, nil
+}
+
+func (l fileLease) release(holder string, now time.Time) error {
+	err := l.lock(time.Minute)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(l.file + ".guard")
+	current, _, err := l.read()
+	if err != nil || current != holder {
+		return err
+	}
+	return l.write(holder, now)
+}
+
+//creates the guard file. a guard older than ttl was left by a crashed replica and is removed
+func (l fileLease) lock(ttl time.Duration) error {
+	guard := l.file + ".guard"
+	for i := 0; i < 50; i++ {
+		f, err := os.OpenFile(guard, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		fi, err := os.Stat(guard)
+		if err == nil && time.Since(fi.ModTime()) > ttl {
+			os.Remove(guard)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Timeout waiting for lease guard file %s", guard)
+}
+
+func (l fileLease) read() (string, time.Time, error) {
+	b, err := ioutil.ReadFile(l.file)
+	if os.IsNotExist(err) {
+		return "", time.Time{}, nil
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+	params := strings.Split(strings.TrimSpace(string(b)), "|")
+	if len(params) != 2 {
+		return "", time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, params[1])
+	if err != nil {
+		return "", time.Time{}, nil
+	}
+	return params[0], t, nil
+}
+
+func (l fileLease) write(holder string, expiresAt time.Time) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", l.file, os.Getpid())
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%s|%s", holder, expiresAt.UTC().Format(time.RFC3339Nano))), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLease(t *testing.T, l leaseStore) {
+	now := time.Now()
+	leader, holder, err := l.acquire("a", time.Minute, now)
+	assert.Nil(t, err, "err")
+	assert.True(t, leader, "a is leader")
+	assert.Equal(t, "a", holder, "holder")
+
+	leader, holder, err = l.acquire("b", time.Minute, now.Add(10*time.Second))
+	assert.Nil(t, err, "err")
+	assert.False(t, leader, "b is follower")
+	assert.Equal(t, "a", holder, "holder")
+
+	leader, _, err = l.acquire("a", time.Minute, now.Add(20*time.Second))
+	assert.Nil(t, err, "err")
+	assert.True(t, leader, "a renewed")
+
+	leader, holder, err = l.acquire("b", time.Minute, now.Add(90*time.Second))
+	assert.Nil(t, err, "err")
+	assert.True(t, leader, "b takes over the expired lease")
+	assert.Equal(t, "b", holder, "holder")
+
+	err = l.release("b", now.Add(100*time.Second))
+	assert.Nil(t, err, "err")
+	leader, _, err = l.acquire("a", time.Minute, now.Add(101*time.Second))
+	assert.Nil(t, err, "err")
+	assert.True(t, leader, "a takes over the released lease")
+}
+
+func TestFileLease(t *testing.T) {
+	dir, _ := ioutil.TempDir(options.dataDir, "lease")
+	testLease(t, fileLease{file: dir + "/leader.lock"})
+}
+
+func TestCatalogLease(t *testing.T) {
+	initDB()
+	testLease(t, catalogLease{name: "lease-test"})
+}
+
+func TestFollowerReadOnly(t *testing.T) {
+	initDB()
+	defer func(o Options) { *options = o }(*options)
+	defer func(l leaseStore) { leases = l }(leases)
+	defer func(s LeaderStatus) { leaderStatus = s }(leaderStatus)
+	dir, _ := ioutil.TempDir(options.dataDir, "lease")
+	leases = fileLease{file: dir + "/leader.lock"}
+	options.leaderLease = time.Minute
+
+	//another replica holds the lease
+	leases.acquire("other", time.Minute, time.Now())
+	options.instanceID = "me"
+	checkLeadership(nil)
+	assert.False(t, isLeader(), "follower")
+
+	ran := false
+	leaderOnly(func() { ran = true })()
+	assert.False(t, ran, "scheduled task skipped on follower")
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/schedule/pause", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "state change rejected")
+	assert.Equal(t, "other", rec.Header().Get("X-Schelly-Leader"), "leader header")
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/schedule", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "read only request served")
+
+	leases.release("other", time.Now())
+	became := make(chan bool, 1)
+	checkLeadership(func() { became <- true })
+	assert.True(t, isLeader(), "took over")
+	assert.True(t, <-became, "onLeader called")
+	leaderOnly(func() { ran = true })()
+	assert.True(t, ran, "scheduled task runs on leader")
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"math/rand"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
 )
 
 //VERSION schelly version
@@ -19,53 +24,127 @@ type Options struct {
 	backupCron        string
 	retentionCron     string
 	webhookURL        string
+	webhookURLs       []string
 	webhookHeaders    map[string]string
 	webhookCreateBody string
 	webhookDeleteBody string
 	graceTimeSeconds  float64
-	dataDir           string
-	listenPort        int
-	listenIP          string
-
-	minutelyParams []string
-	hourlyParams   []string
-	dailyParams    []string
-	weeklyParams   []string
-	monthlyParams  []string
-	yearlyParams   []string
+	overlapPolicy     string
+	catchupWindow     time.Duration
+	location          *time.Location
+	backupWindows     []blackoutWindow
+	retentionWindows  []blackoutWindow
+	windowPolicy      string
+	splay             time.Duration
+	splayMode         string
+
+	chainDownstreamURLs []string
+	chainTimeout        time.Duration
+	chainFailurePolicy  string
+
+	preBackupHook            string
+	postBackupHook           string
+	preBackupHookPolicy      string
+	hookTimeout              time.Duration
+	dataDir                  string
+	catalogURL               string
+	leaderLease              time.Duration
+	catalogSnapshotCron      string
+	catalogSnapshotDir       string
+	catalogSnapshotRetention int
+	compactionCron           string
+	purgeDeletedDays         int
+	purgeMode                string
+	instanceID               string
+	listenPort               int
+	listenIP                 string
+
+	retentionTiers      []retentionTier
+	retentionKeepWithin time.Duration
+	retentionQuotaMB    float64
+
+	retentionMinAvailable      int
+	retentionMaxBackupAge      time.Duration
+	retentionMaxDeletes        int
+	retentionMaxDeletePercent  int
+	retentionDeleteConcurrency int
+	retentionDeleteRate        float64
+	retentionTrashPeriod       time.Duration
+	wormPeriod                 time.Duration
 }
 
 //ResponseWebhook default response type for webhook invocations
 type ResponseWebhook struct {
-	ID      string  `json:"id",omitempty`
-	DataID  string  `json:"data_id",omitempty`
-	Status  string  `json:"status",omitempty`
-	Message string  `json:"message",omitempty`
-	SizeMB  float64 `json:"size_mb",omitempty`
+	ID      string            `json:"id"`
+	DataID  string            `json:"data_id"`
+	Status  string            `json:"status"`
+	Message string            `json:"message"`
+	SizeMB  float64           `json:"size_mb"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	//when the backup will be deleted by retention, if triggered with 'expires_in'
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 var options = new(Options)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
 	backupName := flag.String("backup-name", "", "Backup name. Required.")
 	backupCron := flag.String("backup-cron-string", "", "Cron string used for triggering new backups. If not defined it will be auto generated based on retention configs")
 	retentionCron := flag.String("retention-cron-string", "", "Cron string used for triggering retention management tasks. If not defined it will be the same as backup cron string")
-	webhookURL := flag.String("webhook-url", "", "Base webhook URL for calling backup operations (create/delete backups)")
+	webhookURL := flag.String("webhook-url", "", "Base webhook URL for calling backup operations (create/delete backups). Use a comma separated list of URLs for consistency group backups made by several providers at the same time")
 	webhookHeaders := flag.String("webhook-headers", "", "key=value comma separated list of headers to be sent on backup backend calls")
 	webhookCreateBody := flag.String("webhook-create-body", "", "Custom json body to be sent to backup backend webhook when requesting the creation of a new backup")
 	webhookDeleteBody := flag.String("webhook-delete-body", "", "Custom json body to be sent to backup backend webhook when requesting the removal of an existing backup")
 	graceTimeSeconds := flag.String("webhook-grace-time", "3600", "Minimum time seconds running backup task before trying to cancel it (by calling a /DELETE on the webhook)")
+	overlapPolicy := flag.String("backup-overlap-policy", "skip", "What to do when a backup is triggered while another one is still running: 'skip' the new one, 'queue' one follow-up backup to run when the current finishes or 'cancel' the running backup and start a new one")
+	catchupWindow := flag.String("catchup-window", "0", "Maximum age of a backup or retention schedule missed while Schelly was down for triggering a catch-up run on startup (ex.: 36h). 0 disables catch-up")
+	timezone := flag.String("timezone", "Local", "Timezone used for evaluating cron strings, for the day, week, month and year boundaries used in backup tagging and for API output (ex.: America/Sao_Paulo). Defaults to the process local timezone")
+	backupWindows := flag.String("backup-blackout-windows", "", "';' separated list of windows in which scheduled backups are not triggered. Each window is '[days] HH:MM-HH:MM [timezone]' (ex.: 'mon-fri 09:00-18:00') or '[cron string]|[duration]' (ex.: '0 0 2 * * SUN|4h')")
+	retentionWindows := flag.String("retention-blackout-windows", "", "';' separated list of windows in which retention won't delete backups. Same format as --backup-blackout-windows")
+	windowPolicy := flag.String("blackout-window-policy", "skip", "What to do with scheduled tasks that fall inside a blackout or maintenance window: 'skip' them or 'defer' them until the window ends")
+	splay := flag.String("schedule-splay", "0", "Maximum delay applied after each backup and retention schedule tick before running the task, so that Schelly instances sharing the same cron string don't hit storage at the same time (ex.: 10m). 0 disables it")
+	splayMode := flag.String("schedule-splay-mode", "deterministic", "'deterministic' for a fixed delay derived from the backup name or 'random' for a new random delay on each tick")
+	chainDownstreamURLs := flag.String("chain-downstream-urls", "", "Comma separated list of downstream Schelly base URLs (ex.: http://schelly-files:8080) whose backups are triggered after a backup of this instance becomes available")
+	chainTimeout := flag.String("chain-timeout", "6h", "Maximum time for a downstream chained backup to become available")
+	chainFailurePolicy := flag.String("chain-failure-policy", "fail", "What happens to a backup chain when one of its backups fails or times out: 'fail' marks the whole chain as failed right away and 'ignore' lets the other backups finish and marks the chain as partial")
+	preBackupHook := flag.String("pre-backup-hook", "", "Hook run before asking the backup provider for a new backup. An http(s) URL is called with a POST and other values are run as a local command with 'sh -c'")
+	postBackupHook := flag.String("post-backup-hook", "", "Hook run after a backup finishes (available, error or cancelled). Same format as --pre-backup-hook")
+	preBackupHookPolicy := flag.String("pre-backup-hook-failure", "abort", "What to do when the pre-backup hook fails: 'abort' the backup or 'continue' with it")
+	hookTimeout := flag.String("hook-timeout", "5m", "Maximum time a hook can run before being considered failed")
 	listenPort := flag.Int("listen-port", 8080, "REST API server listen port")
 	listenIP := flag.String("listen-ip", "0.0.0.0", "REST API server listen ip address")
 
-	minutelyRetention := flag.String("retention-minutely", "0", "Minutely retention config")
-	hourlyRetention := flag.String("retention-hourly", "1", "Hourly retention config")
-	dailyRetention := flag.String("retention-daily", "4@L", "Daily retention config")
-	weeklyRetention := flag.String("retention-weekly", "3@L", "Weekly retention config")
-	monthlyRetention := flag.String("retention-monthly", "3@L", "Monthly retention config")
-	yearlyRetention := flag.String("retention-yearly", "2@L", "Yearly retention config")
+	tierRetentions := make(map[string]*string)
+	for _, t := range builtinTiers {
+		tierRetentions[t.name] = flag.String("retention-"+t.name, t.defaultConfig, strings.ToUpper(t.name[:1])+t.name[1:]+" retention config")
+	}
+	customTiers := flag.String("retention-tiers", "", "Comma separated list of custom retention tiers as [name]=[multiple]*[built-in tier]:[retention config]. Ex.: every-6h=6*hourly:4@L,quarterly=3*monthly:8@L")
+	keepWithin := flag.String("retention-keep-within", "0", "Available backups started within this duration are never deleted by retention, whatever their tags (ex.: 48h or 2d). 0 disables it")
+	quota := flag.String("retention-quota", "0", "Maximum total size of available backups (ex.: 500GB). When exceeded, retention deletes the oldest backups, except the ones kept by the retention count of their tier. 0 disables it")
+	minAvailable := flag.Int("retention-min-available", 0, "Retention never deletes backups when it would leave less than this number of available backups. 0 disables it")
+	maxBackupAge := flag.String("retention-max-backup-age", "0", "Retention is skipped when the newest available backup is older than this duration (ex.: 3d), because backups may be failing. 0 disables it")
+	maxDeletes := flag.Int("retention-max-deletes", 0, "Maximum number of backups deleted by a retention run. The oldest elected backups are deleted first and the others are left for the next runs. 0 for no limit")
+	maxDeletePercent := flag.Int("retention-max-delete-percent", 0, "Retention runs that would delete more than this percentage of the available backups are skipped until confirmed with POST /retention/run. 0 disables it")
+	deleteConcurrency := flag.Int("retention-delete-concurrency", 1, "Maximum number of parallel backup delete requests to the backup provider. With more than 1, retention deletes are no longer serialized with the other webhook requests")
+	deleteRate := flag.Float64("retention-delete-rate", 0, "Maximum number of backup delete requests per second to the backup provider (ex.: 0.5). 0 for no limit")
+	trashPeriod := flag.String("retention-trash-period", "0", "When set, backups elected by retention get status 'pending-delete' and are only deleted on the backup provider after this period (ex.: 72h or 3d). Meanwhile, POST /backups/{id}/restore-from-trash cancels the deletion. 0 deletes them right away")
+	wormPeriod := flag.String("worm-period", "0", "Backups are immutable for this period after they start (ex.: 2555d): no backup delete is sent to the backup provider for them, be it by retention, grace time cancellation or the API. 0 disables it")
 	logLevel := flag.String("log-level", "info", "debug, info, warning or error")
 	dataDir := flag.String("data-dir", "/var/lib/schelly/data", "debug, info, warning or error")
+	catalogURL := flag.String("catalog-url", "", "postgres:// url of the database used as backup catalog, so that it doesn't depend on a local volume. If empty, a sqlite catalog is kept in --data-dir")
+	leaderLease := flag.String("leader-lease", "0", "Duration of the leader lease when running several replicas of the same Schelly (ex.: 30s). Only the leader runs scheduled tasks and accepts state changing API requests. 0 disables leader election")
+	instanceID := flag.String("instance-id", "", "Identity of this replica in leader election. Defaults to the hostname")
+	catalogSnapshotCron := flag.String("catalog-snapshot-cron", "0 0 0 * * *", "Cron string for taking snapshots of the backup catalog. Use 'none' to disable them")
+	catalogSnapshotDir := flag.String("catalog-snapshot-dir", "", "Directory where catalog snapshots are saved. Defaults to [data-dir]/snapshots")
+	catalogSnapshotRetention := flag.Int("catalog-snapshot-retention", 7, "Number of catalog snapshots to keep")
+	compactionCron := flag.String("catalog-compaction-cron", "0 0 1 * * *", "Cron string for purging old deleted backups from the catalog and vacuuming it. Use 'none' to disable")
+	purgeDeletedDays := flag.Int("purge-deleted-days", 0, "Backups with status 'deleted' started more than this number of days ago are removed from the catalog on compaction. Their count and size are kept in aggregated statistics. 0 keeps them forever")
+	purgeMode := flag.String("purge-mode", "archive", "'archive' moves purged backups to the table materialized_backup_archive and 'drop' removes them")
 	versionFlag := flag.String("version", "", "Version info")
 	flag.Parse()
 
@@ -92,25 +171,163 @@ func main() {
 	options.backupName = *backupName
 	options.backupCron = *backupCron
 	options.retentionCron = *retentionCron
-	options.webhookURL = *webhookURL
+	options.webhookURLs = make([]string, 0)
+	for _, u := range strings.Split(*webhookURL, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			options.webhookURLs = append(options.webhookURLs, u)
+		}
+	}
+	if len(options.webhookURLs) > 0 {
+		options.webhookURL = options.webhookURLs[0]
+	}
 	options.webhookCreateBody = *webhookCreateBody
 	options.webhookDeleteBody = *webhookDeleteBody
 	options.dataDir = *dataDir
+	options.catalogURL = *catalogURL
+	options.instanceID = *instanceID
+	if options.instanceID == "" {
+		hostname, _ := os.Hostname()
+		options.instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
 	gts, err2 := strconv.ParseFloat(*graceTimeSeconds, 64)
 	options.graceTimeSeconds = gts
 	if err2 != nil {
 		logrus.Errorf("grace-time-seconds has not a valid number. err=%s", err2)
 		os.Exit(1)
 	}
+	options.overlapPolicy = *overlapPolicy
+	cw, err3 := time.ParseDuration(*catchupWindow)
+	if err3 != nil {
+		logrus.Errorf("catchup-window is not a valid duration. err=%s", err3)
+		os.Exit(1)
+	}
+	options.catchupWindow = cw
+	loc, err4 := time.LoadLocation(*timezone)
+	if err4 != nil {
+		logrus.Errorf("timezone is not valid. err=%s", err4)
+		os.Exit(1)
+	}
+	options.location = loc
+	bw, err5 := parseBlackoutWindows(*backupWindows, options.location)
+	if err5 != nil {
+		logrus.Errorf("backup-blackout-windows is not valid. err=%s", err5)
+		os.Exit(1)
+	}
+	options.backupWindows = bw
+	rw, err6 := parseBlackoutWindows(*retentionWindows, options.location)
+	if err6 != nil {
+		logrus.Errorf("retention-blackout-windows is not valid. err=%s", err6)
+		os.Exit(1)
+	}
+	options.retentionWindows = rw
+	options.windowPolicy = *windowPolicy
+	sp, err7 := time.ParseDuration(*splay)
+	if err7 != nil || sp < 0 {
+		logrus.Errorf("schedule-splay is not a valid duration. err=%s", err7)
+		os.Exit(1)
+	}
+	options.splay = sp
+	options.splayMode = *splayMode
+	options.chainDownstreamURLs = make([]string, 0)
+	for _, u := range strings.Split(*chainDownstreamURLs, ",") {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u != "" {
+			options.chainDownstreamURLs = append(options.chainDownstreamURLs, u)
+		}
+	}
+	ct, err8 := time.ParseDuration(*chainTimeout)
+	if err8 != nil {
+		logrus.Errorf("chain-timeout is not a valid duration. err=%s", err8)
+		os.Exit(1)
+	}
+	options.chainTimeout = ct
+	options.chainFailurePolicy = *chainFailurePolicy
+	options.preBackupHook = *preBackupHook
+	options.postBackupHook = *postBackupHook
+	options.preBackupHookPolicy = *preBackupHookPolicy
+	ht, err9 := time.ParseDuration(*hookTimeout)
+	if err9 != nil || ht <= 0 {
+		logrus.Errorf("hook-timeout is not a valid duration. err=%s", err9)
+		os.Exit(1)
+	}
+	options.hookTimeout = ht
+	ll, err10 := time.ParseDuration(*leaderLease)
+	if err10 != nil || ll < 0 {
+		logrus.Errorf("leader-lease is not a valid duration. err=%s", err10)
+		os.Exit(1)
+	}
+	options.leaderLease = ll
+	options.catalogSnapshotCron = *catalogSnapshotCron
+	options.catalogSnapshotDir = *catalogSnapshotDir
+	options.catalogSnapshotRetention = *catalogSnapshotRetention
+	options.compactionCron = *compactionCron
+	options.purgeDeletedDays = *purgeDeletedDays
+	options.purgeMode = *purgeMode
+	if options.purgeMode != "archive" && options.purgeMode != "drop" {
+		logrus.Errorf("--purge-mode must be 'archive' or 'drop'")
+		os.Exit(1)
+	}
+	if options.catalogSnapshotRetention < 1 {
+		logrus.Errorf("--catalog-snapshot-retention must be at least 1")
+		os.Exit(1)
+	}
 	options.listenPort = *listenPort
 	options.listenIP = *listenIP
 
-	options.minutelyParams = retentionParams(*minutelyRetention, "59")
-	options.hourlyParams = retentionParams(*hourlyRetention, "59")
-	options.dailyParams = retentionParams(*dailyRetention, "23")
-	options.weeklyParams = retentionParams(*weeklyRetention, "7")
-	options.monthlyParams = retentionParams(*monthlyRetention, "L")
-	options.yearlyParams = retentionParams(*yearlyRetention, "12")
+	retentionConfigs := make(map[string]string)
+	for name, config := range tierRetentions {
+		retentionConfigs[name] = *config
+	}
+	tiers, err7 := newRetentionTiers(retentionConfigs, *customTiers)
+	if err7 != nil {
+		logrus.Errorf("Invalid retention config. err=%s", err7)
+		os.Exit(1)
+	}
+	options.retentionTiers = tiers
+	kw, err11 := parseAge(*keepWithin)
+	if err11 != nil {
+		logrus.Errorf("retention-keep-within is not a valid duration. err=%s", err11)
+		os.Exit(1)
+	}
+	options.retentionKeepWithin = kw
+	qmb, err12 := parseSize(*quota)
+	if err12 != nil {
+		logrus.Errorf("retention-quota is not a valid size. err=%s", err12)
+		os.Exit(1)
+	}
+	options.retentionQuotaMB = qmb
+	mba, err13 := parseAge(*maxBackupAge)
+	if err13 != nil {
+		logrus.Errorf("retention-max-backup-age is not a valid duration. err=%s", err13)
+		os.Exit(1)
+	}
+	options.retentionMaxBackupAge = mba
+	options.retentionMinAvailable = *minAvailable
+	options.retentionMaxDeletes = *maxDeletes
+	options.retentionMaxDeletePercent = *maxDeletePercent
+	tp, err14 := parseAge(*trashPeriod)
+	if err14 != nil {
+		logrus.Errorf("retention-trash-period is not a valid duration. err=%s", err14)
+		os.Exit(1)
+	}
+	options.retentionTrashPeriod = tp
+	wp, err15 := parseAge(*wormPeriod)
+	if err15 != nil {
+		logrus.Errorf("worm-period is not a valid duration. err=%s", err15)
+		os.Exit(1)
+	}
+	options.wormPeriod = wp
+	options.retentionDeleteConcurrency = *deleteConcurrency
+	options.retentionDeleteRate = *deleteRate
+	if options.retentionDeleteConcurrency < 1 || options.retentionDeleteRate < 0 {
+		logrus.Errorf("--retention-delete-concurrency must be at least 1 and --retention-delete-rate must not be negative")
+		os.Exit(1)
+	}
+	if options.retentionMinAvailable < 0 || options.retentionMaxDeletes < 0 || options.retentionMaxDeletePercent < 0 || options.retentionMaxDeletePercent > 100 {
+		logrus.Errorf("--retention-min-available and --retention-max-deletes must not be negative and --retention-max-delete-percent must be between 0 and 100")
+		os.Exit(1)
+	}
 
 	headers := strings.Split(*webhookHeaders, ",")
 	options.webhookHeaders = make(map[string]string)
@@ -135,41 +352,139 @@ func main() {
 		os.Exit(1)
 	}
 
+	if options.overlapPolicy != "skip" && options.overlapPolicy != "queue" && options.overlapPolicy != "cancel" {
+		logrus.Errorf("--backup-overlap-policy must be 'skip', 'queue' or 'cancel'")
+		os.Exit(1)
+	}
+
+	if options.windowPolicy != "skip" && options.windowPolicy != "defer" {
+		logrus.Errorf("--blackout-window-policy must be 'skip' or 'defer'")
+		os.Exit(1)
+	}
+
+	if options.splayMode != "deterministic" && options.splayMode != "random" {
+		logrus.Errorf("--schedule-splay-mode must be 'deterministic' or 'random'")
+		os.Exit(1)
+	}
+
+	if options.chainFailurePolicy != "fail" && options.chainFailurePolicy != "ignore" {
+		logrus.Errorf("--chain-failure-policy must be 'fail' or 'ignore'")
+		os.Exit(1)
+	}
+
+	if options.preBackupHookPolicy != "abort" && options.preBackupHookPolicy != "continue" {
+		logrus.Errorf("--pre-backup-hook-failure must be 'abort' or 'continue'")
+		os.Exit(1)
+	}
+
 	if options.dataDir == "" {
 		logrus.Error("--data-dir cannot be empty")
 		os.Exit(1)
 	}
 
 	logrus.Infof("====Starting Schelly %s====", VERSION)
+	rand.Seed(time.Now().UnixNano())
 
 	initBackup()
 	initRetention()
 	initWebhook()
+	initSchedule()
+	initWindow()
+	initChain()
+	initHook()
+	initGroup()
+	initLeader()
+	initCatalog()
+	initCompaction()
+	initAudit()
+	initQuota()
+	initDelete()
+	initTrash()
+	initHold()
 	err := initDB()
 	if err != nil {
 		logrus.Errorf("Could not initialized db. err=%s", err)
 		os.Exit(1)
 	}
+	leases = newLeaseStore()
+	updateSchedulePausedGauge()
 
 	if options.backupCron == "" {
 		logrus.Debug("Generating CRON schedule string")
-		options.backupCron = CalculateCronString(options.minutelyParams, options.hourlyParams, options.dailyParams, options.weeklyParams, options.monthlyParams, options.yearlyParams)
+		options.backupCron = CalculateCronString(tierParams("minutely"), tierParams("hourly"), tierParams("daily"), tierParams("weekly"), tierParams("monthly"), tierParams("yearly"))
 	}
 
 	if options.retentionCron == "" {
 		options.retentionCron = options.backupCron
+		if options.backupCron == "none" {
+			options.retentionCron = CalculateCronString(tierParams("minutely"), tierParams("hourly"), tierParams("daily"), tierParams("weekly"), tierParams("monthly"), tierParams("yearly"))
+		}
 	}
 
 	logrus.Infof("Starting backup cron with schedule '%s'", options.backupCron)
 	logrus.Infof("Starting retention cron with schedule '%s'", options.retentionCron)
+	auditConfigChange()
+	updateStorageUsage()
+
+	//with 'none', backups are only triggered by the REST API or by an upstream Schelly
+	var backupSchedule cron.Schedule = noSchedule{}
+	if options.backupCron != "none" {
+		backupSchedule, err = parseCronSchedule(options.backupCron, options.location)
+		if err != nil {
+			logrus.Errorf("Invalid backup cron string '%s'. err=%s", options.backupCron, err)
+			os.Exit(1)
+		}
+	}
+	retentionSchedule, err := parseCronSchedule(options.retentionCron, options.location)
+	if err != nil {
+		logrus.Errorf("Invalid retention cron string '%s'. err=%s", options.retentionCron, err)
+		os.Exit(1)
+	}
 
-	c := cron.New()
-	c.AddFunc(options.backupCron, func() { runBackupTask() })
-	c.AddFunc("@every 5s", func() { checkBackupTask() })
-	c.AddFunc(options.retentionCron, func() { runRetentionTask() })
-	c.AddFunc("@every 1d", func() { retryDeleteErrors() })
+	logrus.Infof("Using timezone %s", options.location)
+	c := cron.NewWithLocation(options.location)
+	c.Schedule(backupSchedule, cron.FuncJob(leaderOnly(scheduleJob("backup", options.backupCron, backupSchedule, func() { runBackupTask() }).Run)))
+	c.AddFunc("@every 5s", leaderOnly(func() { checkBackupTask() }))
+	c.Schedule(retentionSchedule, cron.FuncJob(leaderOnly(scheduleJob("retention", options.retentionCron, retentionSchedule, func() { runRetentionTask() }).Run)))
+	c.AddFunc("@every 24h", leaderOnly(func() { unlessPaused("retention", retryDeleteErrors) }))
+	c.AddFunc("@every 1m", leaderOnly(func() { unlessPaused("retention", emptyTrash) }))
+	c.AddFunc("@every 1m", leaderOnly(func() { checkDeferredTasks() }))
+	c.AddFunc("@every 30s", leaderOnly(func() { checkChains() }))
+	if options.catalogSnapshotCron != "none" {
+		snapshotSchedule, err := parseCronSchedule(options.catalogSnapshotCron, options.location)
+		if err != nil {
+			logrus.Errorf("Invalid catalog snapshot cron string '%s'. err=%s", options.catalogSnapshotCron, err)
+			os.Exit(1)
+		}
+		c.Schedule(snapshotSchedule, cron.FuncJob(leaderOnly(snapshotCatalog)))
+	}
+	if options.compactionCron != "none" {
+		compactionSchedule, err := parseCronSchedule(options.compactionCron, options.location)
+		if err != nil {
+			logrus.Errorf("Invalid catalog compaction cron string '%s'. err=%s", options.compactionCron, err)
+			os.Exit(1)
+		}
+		c.Schedule(compactionSchedule, cron.FuncJob(leaderOnly(compactCatalog)))
+	}
 	go c.Start()
 
+	//a replica that takes over the leadership catches up the schedules missed while there was no leader
+	onLeader := func() { checkMissedSchedules(backupSchedule, retentionSchedule) }
+	checkLeadership(nil)
+	if isLeader() {
+		go onLeader()
+	}
+	go runLeaderElection(onLeader)
+	if options.leaderLease > 0 {
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+			<-sigs
+			releaseLeadership()
+			os.Exit(0)
+		}()
+	}
+
 	startRestAPI()
 }
 
@@ -1,7 +1,23 @@
 package main
 
-import "testing"
-import "github.com/stretchr/testify/assert"
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "schelly-test")
+	if err != nil {
+		panic(err)
+	}
+	options.dataDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
 
 func TestCalculateCronString1(t *testing.T) {
 	cs := CalculateCronString(
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type migration struct {
+	version     int
+	description string
+	sqlite      []string
+	postgres    []string
+}
+
+//ordered schema migrations of the catalog, with the statements for each storage engine. never change a released migration,
+//append a new one instead. the first migrations use IF NOT EXISTS because data dirs created before schema_version already have these tables
+var migrations = []migration{
+	{1, "create materialized_backup", []string{
+		"CREATE TABLE IF NOT EXISTS materialized_backup (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL DEFAULT `2000-01-01`, custom_data TEXT NOT NULL DEFAULT ``, size REAL, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`id`))",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS materialized_backup (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL DEFAULT '2000-01-01', custom_data TEXT NOT NULL DEFAULT '', size DOUBLE PRECISION, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(id))",
+	}},
+	{2, "create maintenance_window", []string{
+		"CREATE TABLE IF NOT EXISTS maintenance_window (id INTEGER PRIMARY KEY AUTOINCREMENT, scope TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL, reason TEXT NOT NULL DEFAULT ``)",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS maintenance_window (id SERIAL PRIMARY KEY, scope TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL, reason TEXT NOT NULL DEFAULT '')",
+	}},
+	{3, "create schedule_pause", []string{
+		"CREATE TABLE IF NOT EXISTS schedule_pause (scope TEXT NOT NULL, paused_at TIMESTAMP NOT NULL, reason TEXT NOT NULL DEFAULT ``, PRIMARY KEY(`scope`))",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS schedule_pause (scope TEXT NOT NULL, paused_at TIMESTAMPTZ NOT NULL, reason TEXT NOT NULL DEFAULT '', PRIMARY KEY(scope))",
+	}},
+	{4, "create backup_chain and backup_chain_member", []string{
+		"CREATE TABLE IF NOT EXISTS backup_chain (id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL DEFAULT `2000-01-01`, PRIMARY KEY(`id`))",
+		"CREATE TABLE IF NOT EXISTS backup_chain_member (chain_id TEXT NOT NULL, member TEXT NOT NULL, role TEXT NOT NULL, backup_id TEXT NOT NULL DEFAULT ``, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL DEFAULT `2000-01-01`, message TEXT NOT NULL DEFAULT ``, PRIMARY KEY(`chain_id`,`member`))",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS backup_chain (id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL DEFAULT '2000-01-01', PRIMARY KEY(id))",
+		"CREATE TABLE IF NOT EXISTS backup_chain_member (chain_id TEXT NOT NULL, member TEXT NOT NULL, role TEXT NOT NULL, backup_id TEXT NOT NULL DEFAULT '', status TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL DEFAULT '2000-01-01', message TEXT NOT NULL DEFAULT '', PRIMARY KEY(chain_id, member))",
+	}},
+	{5, "create hook_execution", []string{
+		"CREATE TABLE IF NOT EXISTS hook_execution (id INTEGER PRIMARY KEY AUTOINCREMENT, backup_id TEXT NOT NULL DEFAULT ``, phase TEXT NOT NULL, hook TEXT NOT NULL, status TEXT NOT NULL, message TEXT NOT NULL DEFAULT ``, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL)",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS hook_execution (id SERIAL PRIMARY KEY, backup_id TEXT NOT NULL DEFAULT '', phase TEXT NOT NULL, hook TEXT NOT NULL, status TEXT NOT NULL, message TEXT NOT NULL DEFAULT '', start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL)",
+	}},
+	{6, "create backup_group_member", []string{
+		"CREATE TABLE IF NOT EXISTS backup_group_member (group_id TEXT NOT NULL, provider_url TEXT NOT NULL, backup_id TEXT NOT NULL DEFAULT ``, data_id TEXT NOT NULL DEFAULT ``, status TEXT NOT NULL, size REAL NOT NULL DEFAULT 0, message TEXT NOT NULL DEFAULT ``, PRIMARY KEY(`group_id`,`provider_url`))",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS backup_group_member (group_id TEXT NOT NULL, provider_url TEXT NOT NULL, backup_id TEXT NOT NULL DEFAULT '', data_id TEXT NOT NULL DEFAULT '', status TEXT NOT NULL, size DOUBLE PRECISION NOT NULL DEFAULT 0, message TEXT NOT NULL DEFAULT '', PRIMARY KEY(group_id, provider_url))",
+	}},
+	{7, "create schedule_state", []string{
+		"CREATE TABLE IF NOT EXISTS schedule_state (name TEXT NOT NULL, last_fire TIMESTAMP NOT NULL, PRIMARY KEY(`name`))",
+	}, []string{
+		"CREATE TABLE IF NOT EXISTS schedule_state (name TEXT NOT NULL, last_fire TIMESTAMPTZ NOT NULL, PRIMARY KEY(name))",
+	}},
+	{8, "create leader_lease", []string{
+		"CREATE TABLE leader_lease (name TEXT NOT NULL, holder TEXT NOT NULL, expires_at TIMESTAMP NOT NULL, PRIMARY KEY(`name`))",
+	}, []string{
+		"CREATE TABLE leader_lease (name TEXT NOT NULL, holder TEXT NOT NULL, expires_at TIMESTAMPTZ NOT NULL, PRIMARY KEY(name))",
+	}},
+	{9, "create materialized_backup_archive and purged_backup_stats", []string{
+		"CREATE TABLE materialized_backup_archive (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL, custom_data TEXT NOT NULL DEFAULT ``, size REAL, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, archived_at TIMESTAMP NOT NULL, PRIMARY KEY(`id`))",
+		"CREATE TABLE purged_backup_stats (month TEXT NOT NULL, count INTEGER NOT NULL, size REAL NOT NULL, PRIMARY KEY(`month`))",
+	}, []string{
+		"CREATE TABLE materialized_backup_archive (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL, custom_data TEXT NOT NULL DEFAULT '', size DOUBLE PRECISION, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, archived_at TIMESTAMPTZ NOT NULL, PRIMARY KEY(id))",
+		"CREATE TABLE purged_backup_stats (month TEXT NOT NULL, count INTEGER NOT NULL, size DOUBLE PRECISION NOT NULL, PRIMARY KEY(month))",
+	}},
+	{10, "create audit_event", []string{
+		"CREATE TABLE audit_event (id INTEGER PRIMARY KEY AUTOINCREMENT, event_time TIMESTAMP NOT NULL, actor TEXT NOT NULL, action TEXT NOT NULL, object_type TEXT NOT NULL, object_id TEXT NOT NULL DEFAULT ``, before_value TEXT NOT NULL DEFAULT ``, after_value TEXT NOT NULL DEFAULT ``, reason TEXT NOT NULL DEFAULT ``)",
+		"CREATE INDEX audit_event_object ON audit_event (object_type, object_id)",
+	}, []string{
+		"CREATE TABLE audit_event (id SERIAL PRIMARY KEY, event_time TIMESTAMPTZ NOT NULL, actor TEXT NOT NULL, action TEXT NOT NULL, object_type TEXT NOT NULL, object_id TEXT NOT NULL DEFAULT '', before_value TEXT NOT NULL DEFAULT '', after_value TEXT NOT NULL DEFAULT '', reason TEXT NOT NULL DEFAULT '')",
+		"CREATE INDEX audit_event_object ON audit_event (object_type, object_id)",
+	}},
+	{11, "create backup_label", []string{
+		"CREATE TABLE backup_label (backup_id TEXT NOT NULL, name TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(`backup_id`, `name`))",
+	}, []string{
+		"CREATE TABLE backup_label (backup_id TEXT NOT NULL, name TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(backup_id, name))",
+	}},
+	//tags move from one column per tier to backup_tag, so that new tiers don't need schema changes. the tables are rebuilt
+	//without the tag columns because the bundled sqlite can't drop columns
+	{12, "move backup tags to backup_tag", []string{
+		"CREATE TABLE backup_tag (backup_id TEXT NOT NULL, tag TEXT NOT NULL, PRIMARY KEY(`backup_id`, `tag`))",
+		"CREATE INDEX backup_tag_tag ON backup_tag (tag)",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'reference' FROM materialized_backup WHERE reference=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'minutely' FROM materialized_backup WHERE minutely=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'hourly' FROM materialized_backup WHERE hourly=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'daily' FROM materialized_backup WHERE daily=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'weekly' FROM materialized_backup WHERE weekly=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'monthly' FROM materialized_backup WHERE monthly=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'yearly' FROM materialized_backup WHERE yearly=1",
+		"CREATE TABLE materialized_backup_v12 (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL DEFAULT `2000-01-01`, custom_data TEXT NOT NULL DEFAULT ``, size REAL, PRIMARY KEY(`id`))",
+		"INSERT INTO materialized_backup_v12 (id, data_id, status, start_time, end_time, custom_data, size) SELECT id, data_id, status, start_time, end_time, custom_data, size FROM materialized_backup",
+		"DROP TABLE materialized_backup",
+		"ALTER TABLE materialized_backup_v12 RENAME TO materialized_backup",
+		"CREATE TABLE materialized_backup_archive_v12 (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL, custom_data TEXT NOT NULL DEFAULT ``, size REAL, archived_at TIMESTAMP NOT NULL, PRIMARY KEY(`id`))",
+		"INSERT INTO materialized_backup_archive_v12 (id, data_id, status, start_time, end_time, custom_data, size, archived_at) SELECT id, data_id, status, start_time, end_time, custom_data, size, archived_at FROM materialized_backup_archive",
+		"DROP TABLE materialized_backup_archive",
+		"ALTER TABLE materialized_backup_archive_v12 RENAME TO materialized_backup_archive",
+	}, []string{
+		"CREATE TABLE backup_tag (backup_id TEXT NOT NULL, tag TEXT NOT NULL, PRIMARY KEY(backup_id, tag))",
+		"CREATE INDEX backup_tag_tag ON backup_tag (tag)",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'reference' FROM materialized_backup WHERE reference=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'minutely' FROM materialized_backup WHERE minutely=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'hourly' FROM materialized_backup WHERE hourly=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'daily' FROM materialized_backup WHERE daily=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'weekly' FROM materialized_backup WHERE weekly=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'monthly' FROM materialized_backup WHERE monthly=1",
+		"INSERT INTO backup_tag (backup_id, tag) SELECT id,'yearly' FROM materialized_backup WHERE yearly=1",
+		"CREATE TABLE materialized_backup_v12 (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL DEFAULT '2000-01-01', custom_data TEXT NOT NULL DEFAULT '', size DOUBLE PRECISION, PRIMARY KEY(id))",
+		"INSERT INTO materialized_backup_v12 (id, data_id, status, start_time, end_time, custom_data, size) SELECT id, data_id, status, start_time, end_time, custom_data, size FROM materialized_backup",
+		"DROP TABLE materialized_backup",
+		"ALTER TABLE materialized_backup_v12 RENAME TO materialized_backup",
+		"CREATE TABLE materialized_backup_archive_v12 (id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL, custom_data TEXT NOT NULL DEFAULT '', size DOUBLE PRECISION, archived_at TIMESTAMPTZ NOT NULL, PRIMARY KEY(id))",
+		"INSERT INTO materialized_backup_archive_v12 (id, data_id, status, start_time, end_time, custom_data, size, archived_at) SELECT id, data_id, status, start_time, end_time, custom_data, size, archived_at FROM materialized_backup_archive",
+		"DROP TABLE materialized_backup_archive",
+		"ALTER TABLE materialized_backup_archive_v12 RENAME TO materialized_backup_archive",
+	}},
+	{13, "create backup_trash", []string{
+		"CREATE TABLE backup_trash (backup_id TEXT NOT NULL, delete_after TIMESTAMP NOT NULL, reason TEXT NOT NULL DEFAULT ``, PRIMARY KEY(`backup_id`))",
+	}, []string{
+		"CREATE TABLE backup_trash (backup_id TEXT NOT NULL, delete_after TIMESTAMPTZ NOT NULL, reason TEXT NOT NULL DEFAULT '', PRIMARY KEY(backup_id))",
+	}},
+	{14, "create backup_hold", []string{
+		"CREATE TABLE backup_hold (id INTEGER PRIMARY KEY AUTOINCREMENT, backup_id TEXT NOT NULL DEFAULT ``, selector TEXT NOT NULL DEFAULT ``, reason TEXT NOT NULL DEFAULT ``, created_by TEXT NOT NULL DEFAULT ``, created_at TIMESTAMP NOT NULL)",
+	}, []string{
+		"CREATE TABLE backup_hold (id SERIAL PRIMARY KEY, backup_id TEXT NOT NULL DEFAULT '', selector TEXT NOT NULL DEFAULT '', reason TEXT NOT NULL DEFAULT '', created_by TEXT NOT NULL DEFAULT '', created_at TIMESTAMPTZ NOT NULL)",
+	}},
+	{15, "create backup_expiry", []string{
+		"CREATE TABLE backup_expiry (backup_id TEXT NOT NULL, expires_at TIMESTAMP, exclude_from_tiers INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`backup_id`))",
+	}, []string{
+		"CREATE TABLE backup_expiry (backup_id TEXT NOT NULL, expires_at TIMESTAMPTZ, exclude_from_tiers INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(backup_id))",
+	}},
+	{16, "create backup_task", []string{
+		"CREATE TABLE backup_task (name TEXT NOT NULL, backup_id TEXT NOT NULL DEFAULT ``, status TEXT NOT NULL DEFAULT ``, start_time TIMESTAMP NOT NULL, request TEXT NOT NULL DEFAULT ``, PRIMARY KEY(`name`))",
+	}, []string{
+		"CREATE TABLE backup_task (name TEXT NOT NULL, backup_id TEXT NOT NULL DEFAULT '', status TEXT NOT NULL DEFAULT '', start_time TIMESTAMPTZ NOT NULL, request TEXT NOT NULL DEFAULT '', PRIMARY KEY(name))",
+	}},
+}
+
+//returns the migrations not applied yet, in order
+func pendingMigrations(version int) []migration {
+	pending := make([]migration, 0)
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+//upgrades the catalog to the latest schema version. the storage takes a copy of the catalog before the first pending migration runs
+func migrateDB(db0 *sql.DB) error {
+	version, err := storage.schemaVersion(db0)
+	if err != nil {
+		return err
+	}
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		logrus.Debugf("Database schema is up to date at version %d", version)
+		return nil
+	}
+
+	err = storage.backupBeforeMigration(version)
+	if err != nil {
+		return err
+	}
+	err = storage.createSchemaVersionTable(db0)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		logrus.Infof("Migrating database schema to version %d: %s", m.version, m.description)
+		tx, err := db0.Begin()
+		if err != nil {
+			return err
+		}
+		for _, s := range storage.migrationStatements(m) {
+			_, err = tx.Exec(s)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed. err=%s", m.version, err)
+			}
+		}
+		_, err = tx.Exec(storage.statement("insertSchemaVersion", "INSERT INTO schema_version (version, description, applied_at) values(?,?,?)"), m.version, m.description, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Database schema migrated from version %d to %d", version, pending[len(pending)-1].version)
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+//runMigrateCommand handles 'schelly migrate [--dry-run] [--data-dir=...] [--catalog-url=...]'
+func runMigrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "/var/lib/schelly/data", "Directory of the sqlite catalog")
+	catalogURL := fs.String("catalog-url", "", "postgres:// url of the catalog database. If empty, the sqlite catalog in --data-dir is used")
+	dryRun := fs.Bool("dry-run", false, "Only show the current schema version and the migrations that would be applied")
+	fs.Parse(args)
+
+	st, err := newStorage(*catalogURL, *dataDir)
+	if err != nil {
+		logrus.Errorf("%s", err)
+		os.Exit(1)
+	}
+	storage = st
+	if s, ok := st.(sqliteStorage); ok && *dryRun {
+		if _, err := os.Stat(s.file); err != nil {
+			fmt.Printf("Database %s doesn't exist. All %d migrations would be applied\n", s.file, len(migrations))
+			return
+		}
+	}
+	db0, err := storage.open()
+	if err != nil {
+		logrus.Errorf("Couldn't open %s catalog. err=%s", storage.name(), err)
+		os.Exit(1)
+	}
+	defer db0.Close()
+
+	version, err := storage.schemaVersion(db0)
+	if err != nil {
+		logrus.Errorf("Couldn't get schema version. err=%s", err)
+		os.Exit(1)
+	}
+	pending := pendingMigrations(version)
+	fmt.Printf("Current schema version: %d. Pending migrations: %d\n", version, len(pending))
+	for _, m := range pending {
+		fmt.Printf("  %d - %s\n", m.version, m.description)
+		for _, s := range storage.migrationStatements(m) {
+			fmt.Printf("      %s\n", s)
+		}
+	}
+	if *dryRun || len(pending) == 0 {
+		return
+	}
+
+	err = migrateDB(db0)
+	if err != nil {
+		logrus.Errorf("Migration failed. err=%s", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Database migrated to version %d\n", pending[len(pending)-1].version)
+}
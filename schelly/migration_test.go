@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateNewDB(t *testing.T) {
+	dir, _ := ioutil.TempDir(options.dataDir, "migrate")
+	dbFile := dir + "/sqlite.db"
+	db0, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err, "err")
+	defer db0.Close()
+	defer func(s catalogStorage) { storage = s }(storage)
+	storage = sqliteStorage{file: dbFile}
+
+	err = migrateDB(db0)
+	assert.Nil(t, err, "err")
+	version, _ := storage.schemaVersion(db0)
+	assert.Equal(t, migrations[len(migrations)-1].version, version, "latest version")
+	baks, _ := filepath.Glob(dbFile + ".*.bak")
+	assert.Equal(t, 0, len(baks), "nothing to backup on a new db")
+
+	err = migrateDB(db0)
+	assert.Nil(t, err, "migrating again is a no-op")
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	dir, _ := ioutil.TempDir(options.dataDir, "migrate")
+	dbFile := dir + "/sqlite.db"
+	db0, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err, "err")
+	defer db0.Close()
+	defer func(s catalogStorage) { storage = s }(storage)
+	storage = sqliteStorage{file: dbFile}
+
+	//data dir created before schema_version existed
+	_, err = db0.Exec(migrations[0].sqlite[0])
+	assert.Nil(t, err, "err")
+	_, err = db0.Exec("INSERT INTO materialized_backup (id, data_id, status, start_time) values('legacy','legacy','available','2018-01-01')")
+	assert.Nil(t, err, "err")
+	version, _ := storage.schemaVersion(db0)
+	assert.Equal(t, 0, version, "unversioned")
+	assert.Equal(t, len(migrations), len(pendingMigrations(version)), "all pending")
+
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = append(migrations, migration{version: 99, description: "add test column", sqlite: []string{"ALTER TABLE materialized_backup ADD COLUMN test_column TEXT NOT NULL DEFAULT ``"}})
+	err = migrateDB(db0)
+	assert.Nil(t, err, "err")
+	version, _ = storage.schemaVersion(db0)
+	assert.Equal(t, 99, version, "migrated")
+
+	testColumn := "x"
+	err = db0.QueryRow("SELECT test_column FROM materialized_backup WHERE id='legacy'").Scan(&testColumn)
+	assert.Nil(t, err, "existing row kept")
+	assert.Equal(t, "", testColumn, "new column")
+	baks, _ := filepath.Glob(dbFile + ".v0-*.bak")
+	assert.Equal(t, 1, len(baks), "db backed up before migration")
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	dir, _ := ioutil.TempDir(options.dataDir, "migrate")
+	dbFile := dir + "/sqlite.db"
+	db0, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err, "err")
+	defer db0.Close()
+	defer func(s catalogStorage) { storage = s }(storage)
+	storage = sqliteStorage{file: dbFile}
+	err = migrateDB(db0)
+	assert.Nil(t, err, "err")
+	latest, _ := storage.schemaVersion(db0)
+
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = append(migrations, migration{version: 99, description: "broken", sqlite: []string{"CREATE TABLE broken_table (id TEXT)", "INVALID SQL"}})
+	err = migrateDB(db0)
+	assert.NotNil(t, err, "err")
+	version, _ := storage.schemaVersion(db0)
+	assert.Equal(t, latest, version, "version unchanged")
+	count := 1
+	db0.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name='broken_table'").Scan(&count)
+	assert.Equal(t, 0, count, "partial migration rolled back")
+}
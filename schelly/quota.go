@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var storageUsedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_backup_storage_used_mb",
+	Help: "Total size in MB of available backups, as reported by the backup provider",
+})
+
+var storageQuotaGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_backup_storage_quota_mb",
+	Help: "Storage quota in MB enforced by retention. 0 when disabled",
+})
+
+func initQuota() {
+	prometheus.MustRegister(storageUsedGauge)
+	prometheus.MustRegister(storageQuotaGauge)
+}
+
+//parseSize parses a size in MB, GB, TB or PB (ex.: 500GB) and returns it in MB. a number without unit is in MB
+func parseSize(value string) (float64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	units := []struct {
+		suffix string
+		mb     float64
+	}{{"PB", 1024 * 1024 * 1024}, {"TB", 1024 * 1024}, {"GB", 1024}, {"MB", 1}}
+	multiplier := float64(1)
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			multiplier = u.mb
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'. Use a number followed by MB, GB, TB or PB", value)
+	}
+	return size * multiplier, nil
+}
+
+//availableSize sums the size of available backups that are not elected for deletion
+func availableSize(backups []MaterializedBackup, elected map[string]string) float64 {
+	size := float64(0)
+	for _, b := range backups {
+		if _, ok := elected[b.ID]; !ok {
+			size = size + b.SizeMB
+		}
+	}
+	return size
+}
+
+//appends the oldest available backups to the election until the size of the remaining ones is under --retention-quota.
+//backups kept by the retention count of their tier are never elected, so the quota may stay exceeded
+func appendElectedForQuota(e *retentionElection) {
+	if options.retentionQuotaMB <= 0 {
+		return
+	}
+	available, err := getMaterializedBackups(0, "", "available", false)
+	if err != nil {
+		logrus.Errorf("quota: Error querying backups for deletion. err=%s", err)
+		return
+	}
+	used := availableSize(available, e.reasons)
+	if used <= options.retentionQuotaMB {
+		logrus.Debugf("quota: %.0f MB used of %.0f MB", used, options.retentionQuotaMB)
+		return
+	}
+	logrus.Infof("quota: %.0f MB used is over the quota of %.0f MB. Electing the oldest backups for deletion", used, options.retentionQuotaMB)
+	elected := 0
+	//oldest first
+	for i := len(available) - 1; i >= 0 && used > options.retentionQuotaMB; i-- {
+		b := available[i]
+		if _, held := e.held[b.ID]; held {
+			continue
+		}
+		if _, ok := e.reasons[b.ID]; ok || e.minimum[b.ID] {
+			continue
+		}
+		e.reasons[b.ID] = fmt.Sprintf("retention: total size of %.0f MB is over the quota of %.0f MB and this is the oldest backup not kept by a retention count", used, options.retentionQuotaMB)
+		delete(e.kept, b.ID)
+		e.backups = append(e.backups, b)
+		used = used - b.SizeMB
+		elected++
+	}
+	if used > options.retentionQuotaMB {
+		logrus.Warnf("quota: %.0f MB will still be used after this retention run, over the quota of %.0f MB. Backups kept by retention counts aren't deleted to honor the quota", used, options.retentionQuotaMB)
+	}
+	logrus.Debugf("quota: %d backups elected for deletion", elected)
+}
+
+//updateStorageUsage updates the storage usage and quota metrics
+func updateStorageUsage() {
+	storageQuotaGauge.Set(options.retentionQuotaMB)
+	available, err := getMaterializedBackups(0, "", "available", false)
+	if err != nil {
+		logrus.Warnf("Couldn't get size of available backups. err=%s", err)
+		return
+	}
+	storageUsedGauge.Set(availableSize(available, nil))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, mb := range map[string]float64{"800": 800, "800MB": 800, "500GB": 500 * 1024, "1.5tb": 1.5 * 1024 * 1024, "0": 0} {
+		size, err := parseSize(value)
+		assert.Nil(t, err, "err")
+		assert.Equalf(t, mb, size, "size %s", value)
+	}
+	for _, value := range []string{"GB", "ten", "-1GB", "10KB"} {
+		_, err := parseSize(value)
+		assert.NotNilf(t, err, "invalid size %s", value)
+	}
+}
+
+//backups are left untagged, so that the untagged tier elects nothing and only the quota deletes backups
+func TestQuotaRetention(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.retentionKeepWithin = 30 * 24 * time.Hour
+
+	now := time.Now()
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		ti := now.Add(-time.Duration(i) * time.Hour)
+		id := ti.UTC().Format(time.RFC3339)
+		ids = append(ids, id)
+		_, err := createMaterializedBackup(id, id, "available", ti, ti, "", 100)
+		assert.Nil(t, err, "err")
+	}
+
+	e := electBackups()
+	assert.Equal(t, 0, len(e.backups), "quota disabled")
+
+	options.retentionQuotaMB = 250
+	e = electBackups()
+	assert.Equal(t, 3, len(e.backups), "over quota")
+	assert.Equal(t, ids[4], e.backups[0].ID, "oldest first")
+	assert.Equal(t, ids[2], e.backups[2].ID, "until under quota")
+	_, kept := e.kept[ids[4]]
+	assert.False(t, kept, "not kept")
+
+	//the minimum of the untagged tier is honored
+	e = newRetentionElection()
+	appendElectedForTag(retentionTier{count: 4}, e)
+	appendElectedForQuota(e)
+	assert.Equal(t, 1, len(e.backups), "minimum honored")
+	assert.Equal(t, ids[4], e.backups[0].ID, "only backup over the minimum")
+
+	available, _ := getMaterializedBackups(0, "", "available", false)
+	assert.Equal(t, 500.0, availableSize(available, nil), "used")
+	assert.Equal(t, 400.0, availableSize(available, e.reasons), "used after retention")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var scheduleCatchupCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_schedule_catchup_total",
+	Help: "Total catch-up runs triggered for schedules missed while Schelly was down",
+}, []string{
+	// backup or retention
+	"schedule",
+})
+
+var schedulePausedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "schelly_schedule_paused",
+	Help: "Whether scheduling is paused (1) or not (0)",
+}, []string{
+	// backup or retention
+	"scope",
+})
+
+var schedulePausedSkipCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_schedule_paused_skips_total",
+	Help: "Total scheduled tasks skipped because scheduling was paused",
+}, []string{
+	// backup or retention
+	"scope",
+})
+
+var scheduleSplayGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "schelly_schedule_splay_seconds",
+	Help: "Delay applied after the last schedule tick before running its task",
+}, []string{
+	// backup or retention
+	"schedule",
+})
+
+//ScheduleStatus runtime info about a schedule
+type ScheduleStatus struct {
+	Cron         string    `json:"cron"`
+	NextFire     time.Time `json:"next_fire"`
+	LastFire     time.Time `json:"last_fire,omitempty"`
+	SplayDelay   string    `json:"splay_delay"`
+	SplayRunTime time.Time `json:"splay_run_time,omitempty"`
+	Paused       bool      `json:"paused"`
+}
+
+type scheduleRuntime struct {
+	spec         string
+	schedule     cron.Schedule
+	lastFire     time.Time
+	splayDelay   time.Duration
+	splayRunTime time.Time
+}
+
+var scheduleRuntimes = make(map[string]*scheduleRuntime)
+var scheduleRuntimesLock = &sync.Mutex{}
+
+//SchedulePause pause state of backup triggering or retention
+type SchedulePause struct {
+	Paused   bool      `json:"paused"`
+	PausedAt time.Time `json:"paused_at,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+func initSchedule() {
+	prometheus.MustRegister(scheduleCatchupCounter)
+	prometheus.MustRegister(schedulePausedGauge)
+	prometheus.MustRegister(schedulePausedSkipCounter)
+	prometheus.MustRegister(scheduleSplayGauge)
+}
+
+//splayDelay returns the delay applied after a tick of schedule name before running its task. In 'deterministic'
+//mode the delay is derived from the backup name, so that each Schelly instance keeps a stable offset, and in 'random'
+//mode it changes on each tick
+func splayDelay(name string) time.Duration {
+	if options.splay <= 0 {
+		return 0
+	}
+	if options.splayMode == "random" {
+		return time.Duration(rand.Int63n(int64(options.splay)))
+	}
+	h := fnv.New64a()
+	h.Write([]byte(options.backupName + "/" + name))
+	return time.Duration(h.Sum64() % uint64(options.splay)).Truncate(time.Millisecond)
+}
+
+//getScheduleStatus returns runtime info about schedule name ('backup' or 'retention')
+func getScheduleStatus(name string) (ScheduleStatus, bool) {
+	scheduleRuntimesLock.Lock()
+	defer scheduleRuntimesLock.Unlock()
+	sr, ok := scheduleRuntimes[name]
+	if !ok {
+		return ScheduleStatus{}, false
+	}
+	return ScheduleStatus{
+		Cron:         sr.spec,
+		NextFire:     localTime(sr.schedule.Next(time.Now())),
+		LastFire:     localTime(sr.lastFire),
+		SplayDelay:   sr.splayDelay.String(),
+		SplayRunTime: localTime(sr.splayRunTime),
+		Paused:       isSchedulePaused(name),
+	}, true
+}
+
+//isSchedulePaused returns true if scheduled tasks of scope ('backup' or 'retention') were paused through the REST API
+func isSchedulePaused(scope string) bool {
+	pauses, err := getSchedulePauses()
+	if err != nil {
+		logrus.Warnf("Couldn't query schedule pause state. Considering it not paused. err=%s", err)
+		return false
+	}
+	return pauses[scope].Paused
+}
+
+//setSchedulePaused pauses or resumes scheduled tasks of scope ('backup', 'retention' or 'all')
+func setSchedulePaused(scope string, paused bool, reason string) error {
+	scopes := []string{scope}
+	if scope == "all" {
+		scopes = []string{"backup", "retention"}
+	}
+	for _, s := range scopes {
+		var err error
+		if paused {
+			err = pauseSchedule(s, time.Now(), reason)
+		} else {
+			err = resumeSchedule(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	updateSchedulePausedGauge()
+	return nil
+}
+
+func updateSchedulePausedGauge() {
+	pauses, err := getSchedulePauses()
+	if err != nil {
+		logrus.Warnf("Couldn't query schedule pause state. err=%s", err)
+		return
+	}
+	for _, scope := range []string{"backup", "retention"} {
+		if pauses[scope].Paused {
+			schedulePausedGauge.WithLabelValues(scope).Set(1)
+		} else {
+			schedulePausedGauge.WithLabelValues(scope).Set(0)
+		}
+	}
+}
+
+//unlessPaused runs task if scheduled tasks of scope are not paused
+func unlessPaused(scope string, task func()) {
+	if isSchedulePaused(scope) {
+		logrus.Infof("Scheduling of %s tasks is paused. Skipping scheduled %s task", scope, scope)
+		schedulePausedSkipCounter.WithLabelValues(scope).Inc()
+		return
+	}
+	task()
+}
+
+//parseCronSchedule parses a cron string as used by Schelly. The 7 fields strings generated
+//by CalculateCronString have a trailing year field, which is accepted when it matches every year.
+//The schedule is evaluated in location
+func parseCronSchedule(spec string, location *time.Location) (cron.Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 7 {
+		if fields[6] != "*" {
+			return nil, fmt.Errorf("Year field is not supported in cron string '%s'", spec)
+		}
+		spec = strings.Join(fields[:6], " ")
+	}
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	return localSchedule{schedule: schedule, location: location}, nil
+}
+
+//noSchedule a schedule that never fires
+type noSchedule struct{}
+
+func (s noSchedule) Next(t time.Time) time.Time {
+	return time.Time{}
+}
+
+//missedScheduleTime returns the latest fire time of schedule after lastFire that was missed before now
+//and whether it is still inside the catch-up window
+func missedScheduleTime(schedule cron.Schedule, lastFire time.Time, now time.Time, window time.Duration) (time.Time, bool) {
+	next := schedule.Next(lastFire)
+	if next.IsZero() || !next.Before(now) {
+		return next, false
+	}
+	for {
+		after := schedule.Next(next)
+		if after.IsZero() || !after.Before(now) || !after.After(next) {
+			break
+		}
+		next = after
+	}
+	return next, now.Sub(next) <= window
+}
+
+//registers the fire of a schedule and runs its task after the splay delay unless the schedule is paused
+func scheduleJob(name string, spec string, schedule cron.Schedule, task func()) cron.FuncJob {
+	scheduleRuntimesLock.Lock()
+	scheduleRuntimes[name] = &scheduleRuntime{spec: spec, schedule: schedule}
+	scheduleRuntimesLock.Unlock()
+
+	return func() {
+		now := time.Now()
+		err := setScheduleLastFire(name, now)
+		if err != nil {
+			logrus.Warnf("Couldn't store last fire time for schedule %s. err=%s", name, err)
+		}
+
+		delay := splayDelay(name)
+		scheduleRuntimesLock.Lock()
+		sr := scheduleRuntimes[name]
+		sr.lastFire = now
+		sr.splayDelay = delay
+		sr.splayRunTime = now.Add(delay)
+		scheduleRuntimesLock.Unlock()
+		scheduleSplayGauge.WithLabelValues(name).Set(delay.Seconds())
+
+		if delay > 0 {
+			logrus.Infof("Schedule %s fired. Waiting splay delay of %s before running task", name, delay)
+			time.Sleep(delay)
+		}
+		unlessPaused(name, task)
+	}
+}
+
+//runs one catch-up backup and one catch-up retention if their schedules were missed while Schelly was down
+func checkMissedSchedules(backupSchedule cron.Schedule, retentionSchedule cron.Schedule) {
+	if options.catchupWindow <= 0 {
+		logrus.Debug("Catch-up of missed schedules disabled")
+		return
+	}
+	if checkMissedSchedule("backup", backupSchedule) {
+		unlessPaused("backup", func() { runBackupTask() })
+	}
+	if checkMissedSchedule("retention", retentionSchedule) {
+		unlessPaused("retention", runRetentionTask)
+	}
+}
+
+func checkMissedSchedule(name string, schedule cron.Schedule) bool {
+	if _, none := schedule.(noSchedule); none {
+		logrus.Debugf("Schedule %s is disabled. Skipping catch-up", name)
+		return false
+	}
+	now := time.Now()
+	lastFire, found, err := getScheduleLastFire(name)
+	if err != nil {
+		logrus.Warnf("Couldn't get last fire time for schedule %s. Skipping catch-up. err=%s", name, err)
+		return false
+	}
+	if !found {
+		logrus.Debugf("No previous fire time found for schedule %s. Using current time as reference for future catch-ups", name)
+		err = setScheduleLastFire(name, now)
+		if err != nil {
+			logrus.Warnf("Couldn't store last fire time for schedule %s. err=%s", name, err)
+		}
+		return false
+	}
+	missed, catchup := missedScheduleTime(schedule, lastFire, now, options.catchupWindow)
+	if missed.IsZero() || !missed.Before(now) {
+		logrus.Debugf("No %s schedule was missed since %s", name, lastFire)
+		return false
+	}
+	if !catchup {
+		logrus.Warnf("Schedule %s was missed at %s, but it is outside the catch-up window of %s. Waiting for next schedule.", name, missed, options.catchupWindow)
+		return false
+	}
+	logrus.Infof("Schedule %s was missed at %s while Schelly was down. Running catch-up %s task", name, missed, name)
+	scheduleCatchupCounter.WithLabelValues(name).Inc()
+	err = setScheduleLastFire(name, now)
+	if err != nil {
+		logrus.Warnf("Couldn't store last fire time for schedule %s. err=%s", name, err)
+	}
+	return true
+}
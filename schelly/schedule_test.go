@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	s, err := parseCronSchedule("59 59 23 * * * *", time.UTC)
+	assert.Nil(t, err, "err")
+	ref := time.Date(2006, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2006, 1, 1, 23, 59, 59, 0, time.UTC), s.Next(ref), "next")
+
+	_, err = parseCronSchedule("59 59 23 * * * 2020", time.UTC)
+	assert.NotNil(t, err, "year")
+}
+
+func TestMissedScheduleTime(t *testing.T) {
+	s, _ := parseCronSchedule("0 0 23 * * *", time.UTC)
+	lastFire := time.Date(2006, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	_, catchup := missedScheduleTime(s, lastFire, time.Date(2006, 1, 2, 22, 0, 0, 0, time.UTC), 24*time.Hour)
+	assert.False(t, catchup, "not missed yet")
+
+	missed, catchup := missedScheduleTime(s, lastFire, time.Date(2006, 1, 3, 8, 0, 0, 0, time.UTC), 24*time.Hour)
+	assert.True(t, catchup, "missed inside window")
+	assert.Equal(t, time.Date(2006, 1, 2, 23, 0, 0, 0, time.UTC), missed, "missed")
+
+	missed, catchup = missedScheduleTime(s, lastFire, time.Date(2006, 1, 5, 8, 0, 0, 0, time.UTC), 24*time.Hour)
+	assert.True(t, catchup, "latest missed fire inside window")
+	assert.Equal(t, time.Date(2006, 1, 4, 23, 0, 0, 0, time.UTC), missed, "latest missed")
+
+	_, catchup = missedScheduleTime(s, lastFire, time.Date(2006, 1, 5, 8, 0, 0, 0, time.UTC), 6*time.Hour)
+	assert.False(t, catchup, "missed outside window")
+}
+
+func TestCheckMissedScheduleDisabled(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.catchupWindow = 72 * time.Hour
+	err := setScheduleLastFire("backup", time.Now().Add(-48*time.Hour))
+	assert.Nil(t, err, "err")
+
+	_, catchup := missedScheduleTime(noSchedule{}, time.Now().Add(-48*time.Hour), time.Now(), options.catchupWindow)
+	assert.False(t, catchup, "never fires")
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	assert.False(t, checkMissedSchedule("backup", noSchedule{}), "no catch-up for schedule 'none'")
+	for _, e := range hook.AllEntries() {
+		assert.NotEqual(t, logrus.WarnLevel, e.Level, e.Message)
+	}
+}
+
+func TestScheduleLastFire(t *testing.T) {
+	initDB()
+	_, found, err := getScheduleLastFire("test")
+	assert.Nil(t, err, "err")
+	assert.False(t, found, "found")
+
+	ft := time.Date(2006, 1, 2, 23, 0, 0, 0, time.UTC)
+	err = setScheduleLastFire("test", ft)
+	assert.Nil(t, err, "err")
+	err = setScheduleLastFire("test", ft.Add(time.Hour))
+	assert.Nil(t, err, "err")
+	lastFire, found, err := getScheduleLastFire("test")
+	assert.Nil(t, err, "err")
+	assert.True(t, found, "found")
+	assert.True(t, ft.Add(time.Hour).Equal(lastFire), "lastFire")
+}
+
+func TestSchedulePause(t *testing.T) {
+	initDB()
+	err := setSchedulePaused("retention", true, "incident")
+	assert.Nil(t, err, "err")
+	assert.True(t, isSchedulePaused("retention"), "retention paused")
+	assert.False(t, isSchedulePaused("backup"), "backup not paused")
+
+	ran := false
+	unlessPaused("retention", func() { ran = true })
+	assert.False(t, ran, "paused task")
+	unlessPaused("backup", func() { ran = true })
+	assert.True(t, ran, "not paused task")
+
+	err = setSchedulePaused("all", true, "")
+	assert.Nil(t, err, "err")
+	assert.True(t, isSchedulePaused("backup"), "backup paused")
+	pauses, _ := getSchedulePauses()
+	assert.Equal(t, "", pauses["retention"].Reason, "reason replaced")
+
+	err = setSchedulePaused("all", false, "")
+	assert.Nil(t, err, "err")
+	assert.False(t, isSchedulePaused("backup"), "backup resumed")
+	assert.False(t, isSchedulePaused("retention"), "retention resumed")
+}
+
+func TestSplayDelay(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	options.splay = 0
+	assert.Equal(t, time.Duration(0), splayDelay("backup"), "disabled")
+
+	options.splay = 10 * time.Minute
+	options.splayMode = "deterministic"
+	options.backupName = "db1"
+	d1 := splayDelay("backup")
+	assert.Equal(t, d1, splayDelay("backup"), "stable")
+	assert.True(t, d1 >= 0 && d1 < options.splay, "inside splay")
+	options.backupName = "db2"
+	assert.NotEqual(t, d1, splayDelay("backup"), "per backup name")
+
+	options.splayMode = "random"
+	for i := 0; i < 10; i++ {
+		d := splayDelay("retention")
+		assert.True(t, d >= 0 && d < options.splay, "random inside splay")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+//catalogStorage is the database engine of the backup catalog. The data access functions in db.go are shared
+//by all engines. Their statements are written with '?' placeholders in sqlite syntax and each engine adapts them
+type catalogStorage interface {
+	//engine name used in logs
+	name() string
+	open() (*sql.DB, error)
+	//returns the statement named 'name' adapted to the engine
+	statement(name string, query string) string
+	//returns the current schema version. 0 means no migration was applied yet
+	schemaVersion(db0 *sql.DB) (int, error)
+	createSchemaVersionTable(db0 *sql.DB) error
+	migrationStatements(m migration) []string
+	//takes a copy of the catalog before migrating it from 'version'
+	backupBeforeMigration(version int) error
+	//runs an insert statement and returns the generated id
+	insertID(stmt *sql.Stmt, args ...interface{}) (int64, error)
+	//returns an insert statement for columns that keeps the existing row when the primary key already exists
+	insertIgnore(table string, columns []string) string
+	//takes a consistent snapshot of the catalog into a file named 'prefix' plus an extension. returns the file name
+	snapshot(db0 *sql.DB, prefix string) (string, error)
+}
+
+var storage catalogStorage = sqliteStorage{}
+
+//returns the storage for a catalog url. empty means sqlite in the data dir
+func newStorage(catalogURL string, dataDir string) (catalogStorage, error) {
+	if catalogURL == "" {
+		return sqliteStorage{file: fmt.Sprintf("%s/sqlite.db", dataDir)}, nil
+	}
+	if strings.HasPrefix(catalogURL, "postgres://") || strings.HasPrefix(catalogURL, "postgresql://") {
+		return postgresStorage{url: catalogURL}, nil
+	}
+	return nil, fmt.Errorf("Unsupported catalog url '%s'. Use a postgres:// url or leave it empty for sqlite", catalogURL)
+}
+
+type sqliteStorage struct {
+	file string
+}
+
+func (s sqliteStorage) name() string {
+	return "sqlite"
+}
+
+func (s sqliteStorage) open() (*sql.DB, error) {
+	return sql.Open("sqlite3", s.file)
+}
+
+func (s sqliteStorage) statement(name string, query string) string {
+	return query
+}
+
+func (s sqliteStorage) schemaVersion(db0 *sql.DB) (int, error) {
+	count := 0
+	err := db0.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_version'").Scan(&count)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	version := 0
+	err = db0.QueryRow("SELECT COALESCE(MAX(version),0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+func (s sqliteStorage) createSchemaVersionTable(db0 *sql.DB) error {
+	_, err := db0.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL, description TEXT NOT NULL, applied_at TIMESTAMP NOT NULL, PRIMARY KEY(`version`))")
+	return err
+}
+
+func (s sqliteStorage) migrationStatements(m migration) []string {
+	return m.sqlite
+}
+
+func (s sqliteStorage) backupBeforeMigration(version int) error {
+	fi, err := os.Stat(s.file)
+	if err != nil || fi.Size() == 0 {
+		return nil
+	}
+	backupFile := fmt.Sprintf("%s.v%d-%s.bak", s.file, version, time.Now().Format("20060102150405"))
+	err = copyFile(s.file, backupFile)
+	if err != nil {
+		return fmt.Errorf("Couldn't backup database before migration. err=%s", err)
+	}
+	logrus.Infof("Database backed up to %s before migration", backupFile)
+	return nil
+}
+
+func (s sqliteStorage) insertID(stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s sqliteStorage) insertIgnore(table string, columns []string) string {
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) values(%s)", table, strings.Join(columns, ","), strings.TrimSuffix(strings.Repeat("?,", len(columns)), ","))
+}
+
+//snapshot uses the sqlite online backup API, so it is consistent while Schelly keeps writing to the catalog
+func (s sqliteStorage) snapshot(db0 *sql.DB, prefix string) (string, error) {
+	file := prefix + ".db"
+	dest, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return "", err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	srcConn, err := db0.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer destConn.Close()
+
+	err = destConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			_, err = b.Step(-1)
+			if err != nil {
+				b.Close()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+	if err != nil {
+		os.Remove(file)
+		return "", err
+	}
+	return file, nil
+}
+
+type postgresStorage struct {
+	url string
+}
+
+//statements that use sqlite only syntax
+var postgresStatements = map[string]string{
+	"setScheduleLastFire":     "INSERT INTO schedule_state (name, last_fire) values(?,?) ON CONFLICT (name) DO UPDATE SET last_fire=EXCLUDED.last_fire",
+	"setBackupTask":           "INSERT INTO backup_task (name, backup_id, status, start_time, request) values(?,?,?,?,?) ON CONFLICT (name) DO UPDATE SET backup_id=EXCLUDED.backup_id, status=EXCLUDED.status, start_time=EXCLUDED.start_time, request=EXCLUDED.request",
+	"pauseSchedule":           "INSERT INTO schedule_pause (scope, paused_at, reason) values(?,?,?) ON CONFLICT (scope) DO UPDATE SET paused_at=EXCLUDED.paused_at, reason=EXCLUDED.reason",
+	"createChain":             "INSERT INTO backup_chain (id, status, start_time) values(?,'running',?) ON CONFLICT (id) DO NOTHING",
+	"saveChainMember":         "INSERT INTO backup_chain_member (chain_id, member, role, backup_id, status, start_time, end_time, message) values(?,?,?,?,?,?,?,?) ON CONFLICT (chain_id, member) DO UPDATE SET role=EXCLUDED.role, backup_id=EXCLUDED.backup_id, status=EXCLUDED.status, start_time=EXCLUDED.start_time, end_time=EXCLUDED.end_time, message=EXCLUDED.message",
+	"saveGroupMember":         "INSERT INTO backup_group_member (group_id, provider_url, backup_id, data_id, status, size, message) values(?,?,?,?,?,?,?) ON CONFLICT (group_id, provider_url) DO UPDATE SET backup_id=EXCLUDED.backup_id, data_id=EXCLUDED.data_id, status=EXCLUDED.status, size=EXCLUDED.size, message=EXCLUDED.message",
+	"createLeaderLease":       "INSERT INTO leader_lease (name, holder, expires_at) values(?,?,?) ON CONFLICT (name) DO NOTHING",
+	"setBackupLabel":          "INSERT INTO backup_label (backup_id, name, value) values(?,?,?) ON CONFLICT (backup_id, name) DO UPDATE SET value=EXCLUDED.value",
+	"addBackupLabel":          "INSERT INTO backup_label (backup_id, name, value) values(?,?,?) ON CONFLICT (backup_id, name) DO NOTHING",
+	"addBackupTag":            "INSERT INTO backup_tag (backup_id, tag) values(?,?) ON CONFLICT (backup_id, tag) DO NOTHING",
+	"createMaintenanceWindow": "INSERT INTO maintenance_window (scope, start_time, end_time, reason) values(?,?,?,?) RETURNING id",
+	"createBackupHold":        "INSERT INTO backup_hold (backup_id, selector, reason, created_by, created_at) values(?,?,?,?,?) RETURNING id",
+	"setBackupExpiry":         "INSERT INTO backup_expiry (backup_id, expires_at, exclude_from_tiers) values(?,?,?) ON CONFLICT (backup_id) DO UPDATE SET expires_at=EXCLUDED.expires_at, exclude_from_tiers=EXCLUDED.exclude_from_tiers",
+}
+
+func (s postgresStorage) name() string {
+	return "postgres"
+}
+
+func (s postgresStorage) open() (*sql.DB, error) {
+	return sql.Open("postgres", s.url)
+}
+
+func (s postgresStorage) statement(name string, query string) string {
+	q, ok := postgresStatements[name]
+	if !ok {
+		q = query
+	}
+	return rebind(q)
+}
+
+func (s postgresStorage) schemaVersion(db0 *sql.DB) (int, error) {
+	count := 0
+	err := db0.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=current_schema() AND table_name='schema_version'").Scan(&count)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	version := 0
+	err = db0.QueryRow("SELECT COALESCE(MAX(version),0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+func (s postgresStorage) createSchemaVersionTable(db0 *sql.DB) error {
+	_, err := db0.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL, description TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL, PRIMARY KEY(version))")
+	return err
+}
+
+func (s postgresStorage) migrationStatements(m migration) []string {
+	return m.postgres
+}
+
+func (s postgresStorage) backupBeforeMigration(version int) error {
+	logrus.Infof("Migrating postgres catalog from version %d. Make sure you have a recent backup of the database (ex.: pg_dump)", version)
+	return nil
+}
+
+func (s postgresStorage) insertID(stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	var id int64
+	err := stmt.QueryRow(args...).Scan(&id)
+	return id, err
+}
+
+func (s postgresStorage) insertIgnore(table string, columns []string) string {
+	return rebind(fmt.Sprintf("INSERT INTO %s (%s) values(%s) ON CONFLICT DO NOTHING", table, strings.Join(columns, ","), strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")))
+}
+
+//snapshot writes the NDJSON catalog export. use the database own tools (ex.: pg_dump) for full backups
+func (s postgresStorage) snapshot(db0 *sql.DB, prefix string) (string, error) {
+	file := prefix + ".ndjson"
+	return file, exportCatalogFile(file)
+}
+
+//rebind replaces '?' placeholders by postgres '$n' placeholders. '?' inside quoted strings is kept
+func rebind(query string) string {
+	var sb strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		if c == '\'' {
+			quoted = !quoted
+		}
+		if c == '?' && !quoted {
+			n++
+			sb.WriteString(fmt.Sprintf("$%d", n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
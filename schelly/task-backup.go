@@ -2,10 +2,11 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 //METRICS
@@ -54,6 +55,15 @@ var overallBackupWarnCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	"status",
 })
 
+var backupOverlapCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_backup_overlap_total",
+	Help: "Total backup triggers that happened while another backup was running",
+}, []string{
+	"policy",
+	// skipped, queued, cancelled or cancel-error
+	"decision",
+})
+
 var runningBackupTask = false
 
 func initBackup() {
@@ -63,14 +73,19 @@ func initBackup() {
 	prometheus.MustRegister(backupMaterializedCounter)
 	prometheus.MustRegister(backupTagCounter)
 	prometheus.MustRegister(overallBackupWarnCounter)
+	prometheus.MustRegister(backupOverlapCounter)
 }
 
-func runBackupTask() {
+//runBackupTask triggers a new backup, retrying until the grace time. returns the response of the last trigger
+func runBackupTask() ResponseWebhook {
+	if !checkWindow("backup") {
+		return ResponseWebhook{}
+	}
 	if runningBackupTask {
 		logrus.Debug("runBackupTask already running. skipping new task creation")
 		backupTasksCounter.WithLabelValues("skipped").Inc()
 		overallBackupWarnCounter.WithLabelValues("warning").Inc()
-		return
+		return ResponseWebhook{}
 	} else {
 		runningBackupTask = true
 		backupTasksCounter.WithLabelValues("run").Inc()
@@ -78,8 +93,10 @@ func runBackupTask() {
 
 	start := time.Now()
 
+	var resp ResponseWebhook
 	for runningBackupTask {
-		_, err := triggerNewBackup()
+		var err error
+		resp, err = triggerNewBackup(actorCron)
 		elapsed := time.Now().Sub(start)
 		if err != nil {
 			if elapsed.Seconds() < options.graceTimeSeconds {
@@ -93,15 +110,21 @@ func runBackupTask() {
 				backupTriggerCounter.WithLabelValues("error").Inc()
 				overallBackupWarnCounter.WithLabelValues("error").Inc()
 			}
+		} else if resp.Status == "skipped" || resp.Status == "queued" || resp.Status == "aborted" {
+			logrus.Infof("Backup task done without triggering a new backup. status=%s elapsed=%s", resp.Status, elapsed)
+			runningBackupTask = false
+			backupTriggerCounter.WithLabelValues(resp.Status).Inc()
 		} else {
 			logrus.Infof("Backup task done. elapsed=%s", elapsed)
 			runningBackupTask = false
 			backupTriggerCounter.WithLabelValues("success").Inc()
 		}
 	}
+	return resp
 }
 
-func triggerNewBackup() (ResponseWebhook, error) {
+//triggerNewBackup asks the backup provider for a new backup. actor is recorded in the audit log as who created it
+func triggerNewBackup(actor string) (ResponseWebhook, error) {
 	start := time.Now()
 	logrus.Info("")
 	logrus.Info(">>>> BACKUP TASK")
@@ -110,23 +133,45 @@ func triggerNewBackup() (ResponseWebhook, error) {
 
 	backupID, backupStatus, backupDate, err := getCurrentTaskStatus()
 	if err != nil {
-		logrus.Warnf("Couldn't get current task id from file. err=%s", err)
+		logrus.Warnf("Couldn't get current task id from catalog. err=%s", err)
 	} else {
 		if backupStatus == "running" {
-			logrus.Infof("Another backup task %s is still running (%s). Skipping backup.", backupID, time.Now().Sub(backupDate))
-			overallBackupWarnCounter.WithLabelValues("warning").Inc()
-			return ResponseWebhook{}, nil
+			resp, err0 := handleBackupOverlap(backupID, backupDate, actor)
+			if err0 != nil || resp.Status != "" {
+				return resp, err0
+			}
 		}
 	}
 
-	logrus.Debugf("Invoking POST '%s' so that a new backup will be created", options.webhookURL)
+	var preHook *HookExecution
+	if options.preBackupHook != "" {
+		he := runHook("pre-backup", options.preBackupHook, "", "")
+		preHook = &he
+		if he.Status != "success" && options.preBackupHookPolicy == "abort" {
+			recordHookExecution(he)
+			overallBackupWarnCounter.WithLabelValues("error").Inc()
+			logrus.Warnf("Pre-backup hook failed. Aborting backup")
+			return ResponseWebhook{Status: "aborted", Message: "pre-backup hook failed. " + he.Message}, nil
+		}
+	}
+
+	logrus.Debugf("Invoking POST '%s' so that a new backup will be created", strings.Join(options.webhookURLs, ","))
 	startPostTime := time.Now()
 
-	resp, err1 := createWebhookBackup()
+	resp, err1 := createBackup()
+	if preHook != nil {
+		preHook.BackupID = resp.ID
+		recordHookExecution(*preHook)
+	}
 	if err1 != nil {
 		overallBackupWarnCounter.WithLabelValues("error").Inc()
 		return resp, fmt.Errorf("Couldn't invoke webhook for backup creation. err=%s", err1)
-	} else if resp.Status == "running" {
+	}
+	if resp.ID != "" {
+		recordAudit(AuditEvent{Actor: actor, Action: "create", ObjectType: "backup", ObjectID: resp.ID, After: resp.Status, Reason: resp.Message})
+		saveProviderLabels(resp)
+	}
+	if resp.Status == "running" {
 		logrus.Infof("Backup invoked successfuly. Starting to check for completion from time to time. id=%s; status=%s message=%s", resp.ID, resp.Status, resp.Message)
 		setCurrentTaskStatus(resp.ID, resp.Status, startPostTime)
 	} else {
@@ -140,6 +185,65 @@ func triggerNewBackup() (ResponseWebhook, error) {
 	return resp, nil
 }
 
+//decides what to do with a new backup trigger while backupID is still running, according to the overlap policy.
+//returns an empty status when the new backup should be created right away
+func handleBackupOverlap(backupID string, backupDate time.Time, actor string) (ResponseWebhook, error) {
+	policy := options.overlapPolicy
+	elapsed := time.Now().Sub(backupDate)
+	overallBackupWarnCounter.WithLabelValues("warning").Inc()
+
+	if policy == "queue" {
+		if isBackupQueued() {
+			logrus.Infof("Another backup task %s is still running (%s) and a follow-up backup is already queued. Skipping backup.", backupID, elapsed)
+			backupOverlapCounter.WithLabelValues(policy, "skipped").Inc()
+			return ResponseWebhook{ID: backupID, Status: "skipped", Message: "a follow-up backup is already queued"}, nil
+		}
+		err := setBackupQueued(true)
+		if err != nil {
+			backupOverlapCounter.WithLabelValues(policy, "queue-error").Inc()
+			return ResponseWebhook{}, fmt.Errorf("Couldn't queue follow-up backup. err=%s", err)
+		}
+		logrus.Infof("Another backup task %s is still running (%s). Queued a follow-up backup to start when it finishes.", backupID, elapsed)
+		backupOverlapCounter.WithLabelValues(policy, "queued").Inc()
+		return ResponseWebhook{ID: backupID, Status: "queued", Message: "backup will start when the running backup finishes"}, nil
+
+	} else if policy == "cancel" {
+		//as when checking the grace time, a running backup is only cancelled after the grace time
+		if elapsed.Seconds() < options.graceTimeSeconds {
+			logrus.Infof("Another backup task %s is still running (%s) within the grace time. Skipping backup.", backupID, elapsed)
+			backupOverlapCounter.WithLabelValues(policy, "skipped").Inc()
+			return ResponseWebhook{ID: backupID, Status: "skipped", Message: "the running backup didn't exceed the grace time"}, nil
+		}
+		if backupID == graceTimeHeldBackup {
+			logrus.Infof("Another backup task %s is still running (%s) and can't be cancelled. Skipping backup.", backupID, elapsed)
+			backupOverlapCounter.WithLabelValues(policy, "skipped").Inc()
+			return ResponseWebhook{ID: backupID, Status: "skipped", Message: "the running backup is held and can't be cancelled"}, nil
+		}
+		logrus.Infof("Another backup task %s is still running (%s). Cancelling it before starting a new backup.", backupID, elapsed)
+		err := deleteBackup(backupID, actor)
+		if _, held := err.(*holdError); held {
+			//as when checking the grace time, let it finish instead of retrying the cancellation
+			logrus.Warnf("Running backup %s can't be cancelled. Skipping backup. err=%s", backupID, err)
+			graceTimeHeldBackup = backupID
+			backupOverlapCounter.WithLabelValues(policy, "skipped").Inc()
+			return ResponseWebhook{ID: backupID, Status: "skipped", Message: err.Error()}, nil
+		}
+		if err != nil {
+			backupOverlapCounter.WithLabelValues(policy, "cancel-error").Inc()
+			return ResponseWebhook{}, fmt.Errorf("Couldn't cancel running backup %s. err=%s", backupID, err)
+		}
+		backupOverlapCounter.WithLabelValues(policy, "cancelled").Inc()
+		backupMaterializedCounter.WithLabelValues("cancelled").Inc()
+		setCurrentTaskStatus(backupID, "cancelled", backupDate)
+		backupFinished(backupID, "cancelled")
+		return ResponseWebhook{}, nil
+	}
+
+	logrus.Infof("Another backup task %s is still running (%s). Skipping backup.", backupID, elapsed)
+	backupOverlapCounter.WithLabelValues(policy, "skipped").Inc()
+	return ResponseWebhook{ID: backupID, Status: "skipped", Message: "another backup is still running"}, nil
+}
+
 func tagAllBackups() error {
 	logrus.Debugf("Tagging backups")
 
@@ -150,102 +254,92 @@ func tagAllBackups() error {
 		return fmt.Errorf("Error begining db transaction. err=%s", err)
 	}
 
-	//check last backup
+	//check last backup. backups excluded from tiers are never tagged
 	logrus.Debug("Checking for backups available")
-	backups, err1 := getMaterializedBackups(1, "", "available", false)
+	backups, err1 := getMaterializedBackups(0, "", "available", false)
 	if err1 != nil {
 		tx.Rollback()
-		return fmt.Errorf("Error getting last backup. err=%s", err)
-	} else if len(backups) == 0 {
+		return fmt.Errorf("Error getting last backup. err=%s", err1)
+	}
+	expiries, err1 := getBackupExpiries()
+	if err1 != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error getting backups excluded from tiers. err=%s", err1)
+	}
+	var lastBackup *MaterializedBackup
+	for i, b := range backups {
+		if !expiries[b.ID].ExcludeFromTiers {
+			lastBackup = &backups[i]
+			break
+		}
+	}
+	if lastBackup == nil {
 		logrus.Warnf("No backups found. Skipping tagging.")
 		tx.Rollback()
 		return nil
 	}
-	lastBackup := backups[0]
 
-	logrus.Debug("Clearing all backup tags")
-	res, err0 := clearTagsAndReferenceMaterializedBackup(tx)
-	if err0 != nil {
+	tagsBefore, err1 := getTagsMaterializedBackups(tx)
+	if err1 != nil {
 		tx.Rollback()
-		return fmt.Errorf("Error clearing tags. err=%s", err0)
+		return fmt.Errorf("Error getting backup tags. err=%s", err1)
 	}
-	logrus.Debugf("%d rows affected", mu(res.RowsAffected())[0])
 
-	//minutely
-	logrus.Debugf("Marking reference + minutely tags")
-	res, err = markReferencesMinutelyMaterializedBackup(tx, options.minutelyParams[1])
-	if err != nil {
+	logrus.Debug("Clearing all backup tags")
+	res, err0 := clearBackupTags(tx)
+	if err0 != nil {
 		tx.Rollback()
-		return fmt.Errorf("Error marking reference+minutely tags. err=%s", err)
+		return fmt.Errorf("Error clearing tags. err=%s", err0)
 	}
 	logrus.Debugf("%d rows affected", mu(res.RowsAffected())[0])
 
-	//hourly
-	logrus.Debugf("Marking hourly tags")
-	res, err = markTagMaterializedBackup(tx, "hourly", "minutely", "%Y-%m-%dT%H:0:0.000", "%M", options.hourlyParams[1])
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("Error marking hourly tags. err=%s", err)
+	//tiers are ordered from the finest to the coarsest, so the parent of each tier is marked before it
+	for _, tier := range retentionTiers() {
+		logrus.Debugf("Marking %s tags", tier.name)
+		res, err = markTierMaterializedBackups(tx, tier)
+		if err != nil {
+			tx.Rollback()
+			backupTagCounter.WithLabelValues("error").Inc()
+			return fmt.Errorf("Error marking %s tags. err=%s", tier.name, err)
+		}
+		tc, _ := res.RowsAffected()
+		logrus.Debugf("%d rows affected", tc)
 	}
-	logrus.Debugf("%d rows affected", mu(res.RowsAffected())[0])
 
-	//daily
-	logrus.Debugf("Marking daily tags")
-	res, err = markTagMaterializedBackup(tx, "daily", "hourly", "%Y-%m-%w-%dT0:0:0.000", "%H", options.dailyParams[1])
+	logrus.Debug("Tagging last backup with all tags")
+	res, err = setAllTagsMaterializedBackup(tx, lastBackup.ID)
 	if err != nil {
 		tx.Rollback()
 		backupTagCounter.WithLabelValues("error").Inc()
-		return fmt.Errorf("Error marking daily tags. err=%s", err)
+		return fmt.Errorf("Error tagging last backup. err=%s", err)
 	}
 	tc, _ := res.RowsAffected()
 	logrus.Debugf("%d rows affected", tc)
 
-	//weekly
-	logrus.Debugf("Marking weekly tags")
-	res, err = markTagMaterializedBackup(tx, "weekly", "daily", "%Y-%m-%W-0T0:0:0.000", "%w", options.weeklyParams[1])
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues("error").Inc()
-		return fmt.Errorf("Error marking weekly tags. err=%s", err)
-	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
-
-	//monthly
-	logrus.Debugf("Marking monthly tags")
-	ref := options.monthlyParams[1]
-	if ref == "L" {
-		ref = "31"
-	}
-	res, err = markTagMaterializedBackup(tx, "monthly", "daily", "%Y-%m-0T0:0:0.000", "%d", ref)
+	logrus.Debug("Recording tag changes in audit log")
+	tagsAfter, err := getTagsMaterializedBackups(tx)
 	if err != nil {
 		tx.Rollback()
 		backupTagCounter.WithLabelValues("error").Inc()
-		return fmt.Errorf("Error marking monthly tags. err=%s", err)
+		return fmt.Errorf("Error getting backup tags. err=%s", err)
 	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
-
-	//yearly
-	logrus.Debugf("Marking yearly tags")
-	res, err = markTagMaterializedBackup(tx, "yearly", "monthly", "%Y-0-0T0:0:0.000", "%m", options.yearlyParams[1])
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues("error").Inc()
-		return fmt.Errorf("Error marking yearly tags. err=%s", err)
+	for id := range tagsBefore {
+		if _, ok := tagsAfter[id]; !ok {
+			tagsAfter[id] = []string{}
+		}
 	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
-
-	logrus.Debug("Tagging last backup with all tags")
-	res, err = setAllTagsMaterializedBackup(tx, lastBackup.ID)
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues("error").Inc()
-		return fmt.Errorf("Error tagging last backup. err=%s", err)
+	for id, after := range tagsAfter {
+		before := strings.Join(tagsBefore[id], ",")
+		if before == strings.Join(after, ",") {
+			continue
+		}
+		err = createAuditEvent(tx, AuditEvent{Actor: actorCron, Action: "tags", ObjectType: "backup", ObjectID: id, Before: before, After: strings.Join(after, ","), Reason: "retention tagging"})
+		if err != nil {
+			tx.Rollback()
+			backupTagCounter.WithLabelValues("error").Inc()
+			return fmt.Errorf("Error recording tag changes. err=%s", err)
+		}
 	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
 
 	logrus.Debug("Commiting transaction")
 	err = tx.Commit()
@@ -262,11 +356,11 @@ func checkBackupTask() {
 	logrus.Debug("checkBackupTask")
 	backupID, backupStatus, backupDate, err := getCurrentTaskStatus()
 	if err != nil {
-		logrus.Debugf("Couldn't load task status file. Ignoring. err=%s", err)
+		logrus.Debugf("Couldn't load backup task status. Ignoring. err=%s", err)
 		overallBackupWarnCounter.WithLabelValues("warning").Inc()
 	}
 	if backupStatus == "running" {
-		resp, err := getWebhookBackupInfo(backupID)
+		resp, err := getBackupInfo(backupID)
 		if err != nil {
 			logrus.Warnf("Couldn't get backup %s info from webhook. err=%s", backupID, err)
 			checkGraceTime()
@@ -282,6 +376,8 @@ func checkBackupTask() {
 					overallBackupWarnCounter.WithLabelValues("error").Inc()
 				} else {
 					logrus.Debugf("Materialized backup reference saved to database successfuly. id=%s", mid)
+					recordAudit(AuditEvent{Actor: actorCron, Action: "status", ObjectType: "backup", ObjectID: mid, Before: backupStatus, After: resp.Status, Reason: "backup finished on provider. " + resp.Message})
+					saveProviderLabels(resp)
 					setCurrentTaskStatus(backupID, resp.Status, backupDate)
 					backupMaterializedCounter.WithLabelValues("success").Inc()
 					if resp.SizeMB != 0 {
@@ -293,28 +389,110 @@ func checkBackupTask() {
 						overallBackupWarnCounter.WithLabelValues("error").Inc()
 					}
 					avoidRetentionLock.Unlock()
+					backupFinished(backupID, resp.Status)
 				}
 			}
 			checkGraceTime()
 		}
 	}
+	checkQueuedBackup()
+}
+
+//saves the labels returned by the backup provider. labels already set on the backup are kept
+func saveProviderLabels(resp ResponseWebhook) {
+	if len(resp.Labels) == 0 {
+		return
+	}
+	labels := labelValues(resp.Labels)
+	err := validateLabels(labels, false)
+	if err != nil {
+		logrus.Warnf("Ignoring invalid labels returned by the backup provider for backup %s. err=%s", resp.ID, err)
+		return
+	}
+	_, err = setBackupLabels(resp.ID, labels, false, actorCron, "labels from backup provider")
+	if err != nil {
+		logrus.Errorf("Couldn't save labels of backup %s. err=%s", resp.ID, err)
+	}
+}
+
+//backupFinished is called when a backup started by this instance is done (available, cancelled, error...)
+func backupFinished(backupID string, status string) {
+	if options.postBackupHook != "" {
+		recordHookExecution(runHook("post-backup", options.postBackupHook, backupID, status))
+	}
+	onChainBackupFinished(backupID, status)
+}
+
+//starts the follow-up backup queued by the 'queue' overlap policy once the running backup is done
+func checkQueuedBackup() {
+	if !isBackupQueued() {
+		return
+	}
+	_, backupStatus, _, _ := getCurrentTaskStatus()
+	if backupStatus == "running" {
+		return
+	}
+	if isSchedulePaused("backup") {
+		logrus.Debugf("Scheduling of backups is paused. Holding queued backup")
+		return
+	}
+	logrus.Infof("Running backup finished. Starting queued backup")
+	q, _ := getQueuedBackup()
+	err := setBackupQueued(false)
+	if err != nil {
+		logrus.Errorf("Couldn't clear queued backup. err=%s", err)
+		overallBackupWarnCounter.WithLabelValues("error").Inc()
+		return
+	}
+	go func() {
+		resp := runBackupTask()
+		if q.ChainID != "" {
+			joinChainWithTrigger(q.ChainID, q.Upstream, resp)
+		}
+		if resp.Status != "running" {
+			return
+		}
+		if len(q.Labels) > 0 {
+			_, err := setBackupLabels(resp.ID, q.Labels, true, q.Actor, "labels from queued backup trigger")
+			if err != nil {
+				logrus.Errorf("Couldn't save labels of queued backup %s. err=%s", resp.ID, err)
+			}
+		}
+		if q.ExpiresIn > 0 || q.ExcludeFromTiers {
+			_, err := setExpiry(resp.ID, q.ExpiresIn, q.ExcludeFromTiers, q.Actor)
+			if err != nil {
+				logrus.Errorf("Couldn't save expiry of queued backup %s. err=%s", resp.ID, err)
+			}
+		}
+	}()
 }
 
+//running backup whose grace time cancellation was refused by a hold
+var graceTimeHeldBackup = ""
+
 func checkGraceTime() {
 	logrus.Debugf("Verifying if current backup is taking too long. If it exceeds graceTime, cancel it on the backend server")
 	backupID, backupStatus, backupDate, err := getCurrentTaskStatus()
-	if backupStatus == "running" {
+	if backupStatus == "running" && backupID != graceTimeHeldBackup {
 		if time.Now().Sub(backupDate).Seconds() > options.graceTimeSeconds {
 			logrus.Warnf("Grace time for backup %s exceeded. Cancelling backup...", backupID)
-			err = deleteWebhookBackup(backupID)
-			if err != nil {
+			err = deleteBackup(backupID, actorCron)
+			if _, held := err.(*holdError); held {
+				//the backup can't be cancelled. let it finish instead of retrying on every check
+				logrus.Warnf("Running backup %s can't be cancelled. Waiting for it to finish. err=%s", backupID, err)
+				graceTimeHeldBackup = backupID
+			} else if err != nil {
 				logrus.Errorf("Couldn't cancel running backup %s task on webhook. err=%s", backupID, err)
+				recordAudit(AuditEvent{Actor: actorCron, Action: "status", ObjectType: "backup", ObjectID: backupID, Before: backupStatus, After: "error", Reason: "grace time exceeded and cancellation failed"})
 				backupMaterializedCounter.WithLabelValues("error").Inc()
 				setCurrentTaskStatus(backupID, "error", backupDate)
+				backupFinished(backupID, "error")
 			} else {
 				logrus.Infof("Running backup task %s cancelled on webhook successfuly", backupID)
+				recordAudit(AuditEvent{Actor: actorCron, Action: "status", ObjectType: "backup", ObjectID: backupID, Before: backupStatus, After: "cancelled", Reason: "grace time exceeded"})
 				backupMaterializedCounter.WithLabelValues("cancelled").Inc()
 				setCurrentTaskStatus(backupID, "cancelled", backupDate)
+				backupFinished(backupID, "cancelled")
 			}
 			overallBackupWarnCounter.WithLabelValues("error").Inc()
 		}
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,97 +19,97 @@ func TestBackupTagging(t *testing.T) {
 
 	bid := strconv.Itoa(rand.Int())
 	ti, _ := time.Parse(time.RFC3339, "2006-01-01T15:04:05Z")
-	_, err0 := createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 := createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-01T15:04:45Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-01T15:05:01Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-01T16:15:41Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-01T16:45:41Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-01T23:15:31Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-31T10:15:27Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-01-31T20:35:57Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-02-15T13:55:27Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-02-16T17:35:17Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-02-16T18:35:17Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-02-29T08:15:17Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-03-28T09:35:19Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-03-29T04:25:49Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-03-29T19:25:49Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-03-30T21:45:35Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-12-29T11:25:15Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-12-30T16:54:05Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	bid = strconv.Itoa(rand.Int())
 	ti, _ = time.Parse(time.RFC3339, "2006-12-31T23:54:05Z")
-	_, err0 = createMaterializedBackup(bid, "available", ti, ti, "any", 0)
+	_, err0 = createMaterializedBackup(bid, bid, "available", ti, ti, "any", 0)
 	assert.Nil(t, err0, "err")
 
 	initMainOptions()
@@ -170,17 +172,107 @@ func TestBackupTagging(t *testing.T) {
 
 }
 
+func TestBackupOverlapPolicy(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			deleted = r.URL.Path
+			w.WriteHeader(200)
+			return
+		}
+		w.WriteHeader(202)
+		w.Write([]byte(`{"id":"new","status":"running"}`))
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	setBackupQueued(false)
+
+	options.overlapPolicy = "skip"
+	setCurrentTaskStatus("abc", "running", time.Now())
+	resp, err := triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "skipped", resp.Status, "skip")
+
+	options.overlapPolicy = "queue"
+	resp, err = triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "queued", resp.Status, "queue")
+	assert.True(t, isBackupQueued(), "queued")
+	resp, err = triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "skipped", resp.Status, "queue only once")
+	setBackupQueued(false)
+
+	options.overlapPolicy = "cancel"
+	options.graceTimeSeconds = 3600
+	resp, err = triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "skipped", resp.Status, "not cancelled within grace time")
+	assert.Equal(t, "", deleted, "not cancelled within grace time")
+	setCurrentTaskStatus("abc", "running", time.Now().Add(-2*time.Hour))
+	resp, err = triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "/abc", deleted, "cancelled")
+	assert.Equal(t, "new", resp.ID, "cancel")
+	backupID, backupStatus, _, _ := getCurrentTaskStatus()
+	assert.Equal(t, "new", backupID, "backupID")
+	assert.Equal(t, "running", backupStatus, "backupStatus")
+}
+
+func TestBackupOverlapCancelHeld(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	defer func() { graceTimeHeldBackup = "" }()
+	initTestDB(t)
+	deleted := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			deleted = r.URL.Path
+		}
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.overlapPolicy = "cancel"
+	options.graceTimeSeconds = 60
+	options.wormPeriod = 24 * time.Hour
+	setBackupQueued(false)
+	setCurrentTaskStatus("held", "running", time.Now().Add(-2*time.Hour))
+
+	resp, err := triggerNewBackup(actorCron)
+	assert.Nil(t, err, "not retried")
+	assert.Equal(t, "skipped", resp.Status, "held backup not cancelled")
+	assert.Contains(t, resp.Message, "worm", "message")
+	assert.Equal(t, "", deleted, "provider not called")
+
+	resp, err = triggerNewBackup(actorCron)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, "skipped", resp.Status, "still running")
+	events, _ := getAuditEvents(AuditFilter{Action: "delete-blocked", Limit: 10})
+	assert.Equal(t, 1, len(events), "refusal audited once")
+}
+
 func assertTags(t *testing.T, backup MaterializedBackup, minutely bool, hourly bool, daily bool, weekly bool, monthly bool, yearly bool) {
-	assert.Equal(t, minutely, backup.Minutely == 1, "minutely")
-	assert.Equal(t, hourly, backup.Hourly == 1, "hourly")
-	assert.Equal(t, daily, backup.Daily == 1, "daily")
-	assert.Equal(t, weekly, backup.Weekly == 1, "weekly")
-	assert.Equal(t, monthly, backup.Monthly == 1, "monthly")
-	assert.Equal(t, yearly, backup.Yearly == 1, "yearly")
+	assert.Equal(t, minutely, hasTag(backup, "minutely"), "minutely")
+	assert.Equal(t, hourly, hasTag(backup, "hourly"), "hourly")
+	assert.Equal(t, daily, hasTag(backup, "daily"), "daily")
+	assert.Equal(t, weekly, hasTag(backup, "weekly"), "weekly")
+	assert.Equal(t, monthly, hasTag(backup, "monthly"), "monthly")
+	assert.Equal(t, yearly, hasTag(backup, "yearly"), "yearly")
+}
+
+func hasTag(backup MaterializedBackup, tag string) bool {
+	for _, t := range backup.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 func initMainOptions() {
-	options = &Options{}
+	options = &Options{dataDir: options.dataDir}
 
 	// backupName 		= "",
 	// backupCron 		= "",
@@ -191,40 +283,13 @@ func initMainOptions() {
 	// webhookDeleteBody = "",
 	// graceTimeSeconds = "",
 	// dataDir 		= "",
-	options.minutelyParams = []string{"2", "59"}
-	options.hourlyParams = []string{"3", "59"}
-	options.dailyParams = []string{"3", "23"}
-	options.weeklyParams = []string{"4", "7"}
-	options.monthlyParams = []string{"5", "L"}
-	options.yearlyParams = []string{"2", "12"}
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "2@59", "hourly": "3@59", "daily": "3@23", "weekly": "4@7", "monthly": "5@L", "yearly": "2@12"}, "")
 }
 
 func showAllBackups() {
 	backups, _ := getMaterializedBackups(0, "", "", false)
 	for _, b := range backups {
-		info := fmt.Sprintf("%s ", b.StartTime)
-		if b.Reference == 1 {
-			info += "Reference "
-		}
-		if b.Minutely == 1 {
-			info += "Minutely "
-		}
-		if b.Hourly == 1 {
-			info += "Hourly "
-		}
-		if b.Daily == 1 {
-			info += "Daily "
-		}
-		if b.Weekly == 1 {
-			info += "Weekly "
-		}
-		if b.Monthly == 1 {
-			info += "Monthly "
-		}
-		if b.Yearly == 1 {
-			info += "Yearly "
-		}
-		logrus.Debugf("%s", info)
+		logrus.Debugf("%s %s", b.StartTime, strings.Join(b.Tags, " "))
 	}
 }
 
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 //METRICS
@@ -27,6 +31,13 @@ var retentionBackupsRetriesCounter = prometheus.NewCounter(prometheus.CounterOpt
 	Help: "Total retention backup delete retries",
 })
 
+var retentionGuardCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_retention_guard_total",
+	Help: "Total retention runs stopped or limited by a safety guard",
+}, []string{
+	"guard",
+})
+
 var runningTask = false
 
 //avoid doing webhook operations in parallel
@@ -36,75 +47,175 @@ func initRetention() {
 	prometheus.MustRegister(retentionTasksCounter)
 	prometheus.MustRegister(retentionBackupsDeleteCounter)
 	prometheus.MustRegister(retentionBackupsRetriesCounter)
+	prometheus.MustRegister(retentionGuardCounter)
+}
+
+//RetentionRunResult outcome of a retention run
+type RetentionRunResult struct {
+	Elected int `json:"elected"`
+	Deleted int `json:"deleted"`
+	//moved to trash, when --retention-trash-period is set
+	Trashed  int `json:"trashed"`
+	Deferred int `json:"deferred"`
+	//guard that stopped the run, if any
+	Blocked string `json:"blocked,omitempty"`
+	Message string `json:"message,omitempty"`
 }
 
 func runRetentionTask() {
+	if !checkWindow("retention") {
+		return
+	}
 	if runningTask {
 		logrus.Debug("runRetentionTask already running. skipping new task creation")
 		return
 	} else {
 		runningTask = true
 	}
-	triggerRetentionTask()
+	triggerRetentionTask(actorCron, false)
 	runningTask = false
 }
 
-func triggerRetentionTask() {
+//triggerRetentionTask deletes the backups elected by the retention rules, subject to the safety guards.
+//confirmed allows a run that would delete more than --retention-max-delete-percent of the available backups
+func triggerRetentionTask(actor string, confirmed bool) RetentionRunResult {
 	start := time.Now()
 	logrus.Info("")
 	logrus.Info(">>>> BACKUP RETENTION MANAGEMENT")
 	retentionTasksCounter.Inc()
 
 	avoidRetentionLock.Lock()
+	defer avoidRetentionLock.Unlock()
 
 	tagAllBackups()
 
-	logrus.Debugf("Retention policy: minutely=%s, hourly=%s, daily=%s, weekly=%s, monthly=%s, yearly=%s", options.minutelyParams[0], options.hourlyParams[0], options.dailyParams[0], options.weeklyParams[0], options.monthlyParams[0], options.yearlyParams[0])
-
-	electedBackups := make([]MaterializedBackup, 0)
-	electedBackups = appendElectedForTag("", "0", electedBackups)
-	electedBackups = appendElectedForTag("minutely", options.minutelyParams[0], electedBackups)
-	electedBackups = appendElectedForTag("hourly", options.hourlyParams[0], electedBackups)
-	electedBackups = appendElectedForTag("daily", options.dailyParams[0], electedBackups)
-	electedBackups = appendElectedForTag("weekly", options.weeklyParams[0], electedBackups)
-	electedBackups = appendElectedForTag("monthly", options.monthlyParams[0], electedBackups)
-	electedBackups = appendElectedForTag("yearly", options.yearlyParams[0], electedBackups)
-	logrus.Infof("%d backups elected for deletion", len(electedBackups))
-
-	for _, backup := range electedBackups {
-		logrus.Debugf("Deleting backup '%s'...", backup.ID)
-		res, err := setStatusMaterializedBackup(backup.ID, "deleting")
-		ra, _ := res.RowsAffected()
+	policy := make([]string, 0)
+	for _, t := range retentionTiers() {
+		policy = append(policy, t.name+"="+t.params[0])
+	}
+	if options.retentionKeepWithin > 0 {
+		policy = append(policy, "keep-within="+options.retentionKeepWithin.String())
+	}
+	logrus.Debugf("Retention policy: %s", strings.Join(policy, ", "))
+
+	result := RetentionRunResult{}
+	available, err := getMaterializedBackups(0, "", "available", false)
+	if err != nil {
+		logrus.Errorf("Couldn't query available backups. Skipping retention. err=%s", err)
+		result.Message = err.Error()
+		return result
+	}
+	if options.retentionMaxBackupAge > 0 && (len(available) == 0 || time.Now().Sub(available[0].StartTime) > options.retentionMaxBackupAge) {
+		result.Blocked = "max-backup-age"
+		result.Message = fmt.Sprintf("the newest available backup is older than %s. backups may be failing", options.retentionMaxBackupAge)
+		logrus.Warnf("Skipping retention: %s", result.Message)
+		retentionGuardCounter.WithLabelValues(result.Blocked).Inc()
+		return result
+	}
+
+	election := electBackups()
+	for id, rule := range election.kept {
+		logrus.Debugf("Keeping backup '%s'. %s", id, rule)
+	}
+	result.Elected = len(election.backups)
+	logrus.Infof("%d backups elected for deletion", len(election.backups))
+
+	//oldest first, so that guards spare the newest backups
+	elected := election.backups
+	sort.SliceStable(elected, func(i, j int) bool {
+		return elected[i].StartTime.Before(elected[j].StartTime)
+	})
+
+	if options.retentionMinAvailable > 0 && len(available)-len(elected) < options.retentionMinAvailable {
+		keep := len(available) - options.retentionMinAvailable
+		if keep < 0 {
+			keep = 0
+		}
+		logrus.Warnf("Deleting %d backups would leave less than %d available backups. Deleting only %d of them", len(elected), options.retentionMinAvailable, keep)
+		retentionGuardCounter.WithLabelValues("min-available").Inc()
+		result.Deferred = result.Deferred + len(elected) - keep
+		elected = elected[:keep]
+	}
+
+	if options.retentionMaxDeletePercent > 0 && len(available) > 0 && len(elected)*100 > options.retentionMaxDeletePercent*len(available) {
+		message := fmt.Sprintf("%d of %d available backups would be deleted, more than %d%%", len(elected), len(available), options.retentionMaxDeletePercent)
+		if !confirmed {
+			result.Blocked = "max-delete-percent"
+			result.Message = message + ". confirm the run with POST /retention/run"
+			logrus.Warnf("Skipping retention: %s", result.Message)
+			retentionGuardCounter.WithLabelValues(result.Blocked).Inc()
+			result.Deferred = result.Deferred + len(elected)
+			return result
+		}
+		logrus.Warnf("Retention confirmed by %s: %s", actor, message)
+		recordAudit(AuditEvent{Actor: actor, Action: "confirm", ObjectType: "retention", ObjectID: options.backupName, After: strconv.Itoa(len(elected)), Reason: message})
+	}
+
+	if options.retentionMaxDeletes > 0 && len(elected) > options.retentionMaxDeletes {
+		logrus.Infof("Deleting only the %d oldest of %d elected backups. The others are left for the next retention runs", options.retentionMaxDeletes, len(elected))
+		retentionGuardCounter.WithLabelValues("max-deletes").Inc()
+		result.Deferred = result.Deferred + len(elected) - options.retentionMaxDeletes
+		elected = elected[:options.retentionMaxDeletes]
+	}
+
+	if options.retentionTrashPeriod > 0 {
+		for _, backup := range elected {
+			ok, err := trashBackup(backup.ID, actor, election.reasons[backup.ID])
+			if err != nil {
+				logrus.Errorf("Couldn't move backup '%s' to trash. err=%s", backup.ID, err)
+			} else if ok {
+				result.Trashed++
+			}
+		}
+		logrus.Infof("%d backups moved to trash. They will be deleted after %s", result.Trashed, options.retentionTrashPeriod)
+		updateStorageUsage()
+		return result
+	}
+
+	backupIDs := make([]string, 0)
+	for _, backup := range elected {
+		res, err := setStatusMaterializedBackup(backup.ID, "deleting", actor, election.reasons[backup.ID])
 		if err != nil {
 			logrus.Errorf("Couldn't set status of backup '%s' to 'deleting'. Skipping backup deletion. err=%s", backup.ID, err)
 			retentionBackupsDeleteCounter.WithLabelValues("error").Inc()
-		} else if ra != 1 {
+		} else if ra, _ := res.RowsAffected(); ra != 1 {
 			logrus.Errorf("Strange number of affected rows while setting status of backup '%s' to 'deleting'. Skipping backup deletion. rowsAffected=%d", backup.ID, ra)
 			retentionBackupsDeleteCounter.WithLabelValues("error").Inc()
 		} else {
-			performBackupDelete(backup.ID)
-			//give some breath to backed webhook
-			// time.Sleep(1000 * time.Millisecond)
+			backupIDs = append(backupIDs, backup.ID)
 		}
 	}
+	result.Deleted = deleteBackups(backupIDs, actor, result.Deferred)
 
+	updateStorageUsage()
 	elapsed := time.Now().Sub(start)
 	logrus.Infof("Retention management task done. elapsed=%s", elapsed)
-	avoidRetentionLock.Unlock()
+	return result
 }
 
-func performBackupDelete(backupID string) {
-	err := deleteWebhookBackup(backupID)
-	if err != nil {
+//performBackupDelete deletes a backup on the provider and updates its status
+func performBackupDelete(backupID string, actor string) error {
+	return finishBackupDelete(backupID, actor, deleteBackup(backupID, actor))
+}
+
+//finishBackupDelete updates the status of a backup after its delete on the provider returned err
+func finishBackupDelete(backupID string, actor string, err error) error {
+	if he, held := err.(*holdError); held {
+		_, err0 := setStatusMaterializedBackup(backupID, "available", actor, fmt.Sprintf("delete refused. %s", he.reason))
+		if err0 != nil {
+			logrus.Warnf("Could not set backup %s status back to 'available'. err=%s", backupID, err0)
+		}
+		retentionBackupsDeleteCounter.WithLabelValues("blocked").Inc()
+	} else if err != nil {
 		logrus.Warnf("Could not delete backup '%s' using webhook. err=%s", backupID, err)
-		_, err0 := setStatusMaterializedBackup(backupID, "delete-error")
+		_, err0 := setStatusMaterializedBackup(backupID, "delete-error", actor, fmt.Sprintf("delete on provider failed. err=%s", err))
 		if err0 != nil {
 			logrus.Warnf("Could not set backup %s status to 'delete-error'. err=%s", backupID, err0)
 		}
 		retentionBackupsDeleteCounter.WithLabelValues("error").Inc()
 	} else {
 		logrus.Infof("Backup '%s' deleted successfuly", backupID)
-		_, err0 := setStatusMaterializedBackup(backupID, "deleted")
+		_, err0 := setStatusMaterializedBackup(backupID, "deleted", actor, "deleted on provider")
 		if err0 != nil {
 			logrus.Warnf("Could not set backup %s status to 'deleted'. err=%s", backupID, err0)
 			retentionBackupsDeleteCounter.WithLabelValues("error").Inc()
@@ -112,35 +223,152 @@ func performBackupDelete(backupID string) {
 			retentionBackupsDeleteCounter.WithLabelValues("success").Inc()
 		}
 	}
+	return err
 }
 
 func retryDeleteErrors() {
+	if desc, blocked := activeWindow("retention", time.Now()); blocked {
+		logrus.Infof("Not retrying webhook delete for backups with 'delete-error' tag because of %s", desc)
+		return
+	}
 	logrus.Debugf("Retrying webhook delete for backups with 'delete-error' tag")
-	backups, err := getMaterializedBackups(10, "", "delete-error", true)
+	backups, err := getMaterializedBackups(0, "", "delete-error", false)
 	if err != nil {
 		logrus.Errorf("Couldn't query backups tagged as 'delete-error'. err=%s", err)
 	} else if len(backups) > 0 {
-		logrus.Infof("%d backups tagged with 'backup-error' randomly gotten (limiting to 10). retrying to delete them on webhook", len(backups))
+		logrus.Infof("%d backups tagged with 'delete-error'. retrying to delete them on webhook", len(backups))
+		avoidRetentionLock.Lock()
+		defer avoidRetentionLock.Unlock()
+		backupIDs := make([]string, 0)
 		for _, backup := range backups {
 			retentionBackupsRetriesCounter.Inc()
-			performBackupDelete(backup.ID)
+			backupIDs = append(backupIDs, backup.ID)
 		}
+		deleted := deleteBackups(backupIDs, actorCron, 0)
+		logrus.Infof("%d of %d backups with 'delete-error' deleted", deleted, len(backups))
 	} else {
 		logrus.Debugf("No backups tagged with 'delete-error'")
 	}
 }
 
-func appendElectedForTag(tag string, retentionCount string, appendTo []MaterializedBackup) []MaterializedBackup {
-	ret, err0 := strconv.Atoi(retentionCount)
-	if err0 != nil {
-		logrus.Errorf("%s: Invalid retention parameter: err=%s", tag, err0)
-		return appendTo
+//retentionElection the backups elected for deletion by a retention run, the reason of each election and the rule that kept each of the other available backups
+type retentionElection struct {
+	backups []MaterializedBackup
+	reasons map[string]string
+	kept    map[string]string
+	//backups kept by the retention count of their tier. the storage quota doesn't delete them
+	minimum map[string]bool
+	//backups under legal hold or WORM period, with the reason
+	held map[string]string
+	//expired backups and backups excluded from tiers. tier rules don't apply to them
+	byExpiry map[string]bool
+}
+
+func newRetentionElection() *retentionElection {
+	return &retentionElection{backups: make([]MaterializedBackup, 0), reasons: make(map[string]string), kept: make(map[string]string), minimum: make(map[string]bool), held: make(map[string]string), byExpiry: make(map[string]bool)}
+}
+
+//electBackups evaluates the retention rules of every tier and the storage quota
+func electBackups() *retentionElection {
+	e := newRetentionElection()
+	available, err := getMaterializedBackups(0, "", "available", false)
+	if err == nil {
+		e.held, err = heldBackups(available)
+	}
+	expiries := map[string]BackupExpiry{}
+	if err == nil {
+		expiries, err = getBackupExpiries()
+	}
+	if err != nil {
+		//without knowing the holds and the backups excluded from tiers, nothing can be deleted
+		logrus.Errorf("Couldn't verify backup holds and expiries. Electing no backups for deletion. err=%s", err)
+		for _, b := range available {
+			e.kept[b.ID] = "hold: couldn't verify holds and expiries"
+		}
+		return e
+	}
+	appendElectedForExpiry(available, expiries, e)
+	appendElectedForTag(retentionTier{}, e)
+	for _, t := range retentionTiers() {
+		appendElectedForTag(t, e)
+	}
+	appendElectedForQuota(e)
+	return e
+}
+
+//appends the backups whose coarsest tier is tier (untagged backups for the zero tier) that are not kept by its retention count,
+//by its maximum age or by --retention-keep-within to the election
+func appendElectedForTag(tier retentionTier, e *retentionElection) {
+	name := tier.name
+	if name == "" {
+		name = "untagged"
+	}
+	mbackups, err := getExclusiveTagAvailableMaterializedBackups(tier.name, 0, math.MaxInt32)
+	if err != nil {
+		logrus.Errorf("%s: Error querying backups for deletion. err=%s", name, err)
+		return
+	}
+	now := time.Now()
+	elected := 0
+	candidates := make([]MaterializedBackup, 0)
+	for _, b := range mbackups {
+		if !e.byExpiry[b.ID] {
+			candidates = append(candidates, b)
+		}
+	}
+	for i, b := range candidates {
+		age := now.Sub(b.StartTime)
+		if i < tier.count {
+			e.kept[b.ID] = fmt.Sprintf("%s: among the %d most recent of them", name, tier.count)
+			e.minimum[b.ID] = true
+		} else if reason, held := e.held[b.ID]; held {
+			e.kept[b.ID] = reason
+		} else if tier.maxAge > 0 && age < tier.maxAge {
+			e.kept[b.ID] = fmt.Sprintf("%s: newer than %s", name, tier.maxAge)
+		} else if options.retentionKeepWithin > 0 && age < options.retentionKeepWithin {
+			e.kept[b.ID] = fmt.Sprintf("keep-within: newer than %s", options.retentionKeepWithin)
+		} else {
+			if tier.name == "" {
+				e.reasons[b.ID] = "retention: backup has no retention tags"
+			} else if tier.maxAge > 0 {
+				e.reasons[b.ID] = fmt.Sprintf("retention: only tagged '%s', not among the %d most recent of them and older than %s", tier.name, tier.count, tier.maxAge)
+			} else {
+				e.reasons[b.ID] = fmt.Sprintf("retention: only tagged '%s' and not among the %d most recent of them", tier.name, tier.count)
+			}
+			e.backups = append(e.backups, b)
+			elected++
+		}
 	}
-	mbackups, err := getExclusiveTagAvailableMaterializedBackups(tag, ret, 10)
+	logrus.Debugf("%s: %d backups elected for deletion", name, elected)
+}
+
+//RetentionDecision what the next retention run would do with an available backup and why
+type RetentionDecision struct {
+	ID        string    `json:"id"`
+	StartTime time.Time `json:"start_time"`
+	Tags      []string  `json:"tags"`
+	Action    string    `json:"action"`
+	Rule      string    `json:"rule"`
+}
+
+//getRetentionPlan evaluates the retention rules against the current tags without deleting anything
+func getRetentionPlan() ([]RetentionDecision, error) {
+	available, err := getMaterializedBackups(0, "", "available", false)
 	if err != nil {
-		logrus.Errorf("%s: Error querying backups for deletion. err=%s", tag, err)
-		return appendTo
+		return nil, err
+	}
+	election := electBackups()
+	plan := make([]RetentionDecision, 0)
+	for _, b := range available {
+		d := RetentionDecision{ID: b.ID, StartTime: localTime(b.StartTime), Tags: getTags(b)}
+		if reason, ok := election.reasons[b.ID]; ok {
+			d.Action = "delete"
+			d.Rule = reason
+		} else {
+			d.Action = "keep"
+			d.Rule = election.kept[b.ID]
+		}
+		plan = append(plan, d)
 	}
-	logrus.Debugf("%s: %d backups elected for deletion (limited to 10)", tag, len(mbackups))
-	return append(appendTo, mbackups...)
+	return plan, nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetention(t *testing.T) {
+	count, maxAge, err := parseRetention("7")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 7, count, "count")
+	assert.Equal(t, time.Duration(0), maxAge, "maxAge")
+
+	count, maxAge, err = parseRetention("14d")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 0, count, "count")
+	assert.Equal(t, 14*24*time.Hour, maxAge, "days")
+
+	count, maxAge, err = parseRetention("3+2w")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 3, count, "count")
+	assert.Equal(t, 14*24*time.Hour, maxAge, "weeks")
+
+	_, maxAge, err = parseRetention("36h")
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 36*time.Hour, maxAge, "go duration")
+
+	for _, r := range []string{"x", "-1", "3+xd", "-2d"} {
+		_, _, err = parseRetention(r)
+		assert.NotNilf(t, err, "invalid retention %s", r)
+	}
+}
+
+//backups are left untagged, so that all of them are evaluated by the rules of the untagged tier
+func TestAgeBasedRetention(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.location = time.UTC
+
+	now := time.Now().UTC()
+	ids := make([]string, 0)
+	for _, days := range []int{0, 2, 5, 10} {
+		ti := now.Add(-time.Duration(days) * 24 * time.Hour)
+		id := ti.Format(time.RFC3339)
+		ids = append(ids, id)
+		_, err := createMaterializedBackup(id, id, "available", ti, ti, "", 1)
+		assert.Nil(t, err, "err")
+	}
+
+	e := newRetentionElection()
+	appendElectedForTag(retentionTier{count: 1, maxAge: 3 * 24 * time.Hour}, e)
+	assert.Equal(t, 2, len(e.backups), "elected")
+	assert.Equal(t, ids[2], e.backups[0].ID, "5 days old")
+	assert.Equal(t, ids[3], e.backups[1].ID, "10 days old")
+	assert.Equal(t, "untagged: among the 1 most recent of them", e.kept[ids[0]], "count rule")
+	assert.Equal(t, "untagged: newer than 72h0m0s", e.kept[ids[1]], "age rule")
+
+	options.retentionKeepWithin = 7 * 24 * time.Hour
+	plan, err := getRetentionPlan()
+	assert.Nil(t, err, "err")
+	decisions := make(map[string]RetentionDecision)
+	for _, d := range plan {
+		decisions[d.ID] = d
+	}
+	assert.Equal(t, 4, len(decisions), "plan")
+	assert.Equal(t, "keep", decisions[ids[2]].Action, "5 days old")
+	assert.Equal(t, "keep-within: newer than 168h0m0s", decisions[ids[2]].Rule, "keep-within rule")
+	assert.Equal(t, "delete", decisions[ids[3]].Action, "10 days old")
+	assert.Equal(t, "retention: backup has no retention tags", decisions[ids[3]].Rule, "untagged")
+}
+
+func TestRetentionGuards(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "0", "hourly": "0", "daily": "0", "weekly": "0", "monthly": "0", "yearly": "0"}, "")
+
+	now := time.Now()
+	ids := make([]string, 0)
+	for i := 1; i <= 5; i++ {
+		ti := now.Add(-time.Duration(i) * time.Hour)
+		id := ti.UTC().Format("20060102150405")
+		ids = append(ids, id)
+		_, err := createMaterializedBackup(id, id, "available", ti, ti, "", 1)
+		assert.Nil(t, err, "err")
+	}
+
+	options.retentionMaxBackupAge = 30 * time.Minute
+	result := triggerRetentionTask(actorCron, false)
+	assert.Equal(t, "max-backup-age", result.Blocked, "newest backup too old")
+	assert.Equal(t, 0, len(deleted), "nothing deleted")
+
+	options.retentionMaxBackupAge = 2 * time.Hour
+	options.retentionMinAvailable = 2
+	options.retentionMaxDeletePercent = 50
+	result = triggerRetentionTask(actorCron, false)
+	assert.Equal(t, "max-delete-percent", result.Blocked, "3 of 5 needs confirmation")
+	assert.Equal(t, 5, result.Deferred, "2 deferred by min-available plus the 3 blocked")
+	assert.Equal(t, 0, len(deleted), "nothing deleted")
+
+	options.retentionMaxDeletes = 2
+	result = triggerRetentionTask("api:ops", true)
+	assert.Equal(t, "", result.Blocked, "confirmed")
+	assert.Equal(t, 5, result.Elected, "elected")
+	assert.Equal(t, 2, result.Deleted, "max deletes")
+	assert.Equal(t, 3, result.Deferred, "deferred")
+	assert.Equal(t, []string{"/" + ids[4], "/" + ids[3]}, deleted, "oldest first")
+
+	events, _ := getAuditEvents(AuditFilter{Action: "confirm", Limit: 10})
+	assert.Equal(t, 1, len(events), "confirmation audited")
+	assert.Equal(t, "api:ops", events[0].Actor, "actor")
+
+	//the 3 remaining backups are the minimum plus one
+	options.retentionMaxDeletePercent = 0
+	result = triggerRetentionTask(actorCron, false)
+	assert.Equal(t, 1, result.Deleted, "min available")
+	available, _ := getMaterializedBackups(0, "", "available", false)
+	assert.Equal(t, 2, len(available), "min available")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//retentionTier a retention tag. Backups are grouped by the tier period and, in each group, the backup tagged with the
+//parent tier that is nearest to the reference position is tagged with the tier
+type retentionTier struct {
+	name   string
+	parent string
+	//retention config and reference position
+	params []string
+	//the newest 'count' backups and the ones newer than maxAge are kept
+	count  int
+	maxAge time.Duration
+	//approximate period, used to order tiers from the finest to the coarsest
+	period time.Duration
+	//built-in tiers group by strftime patterns
+	groupBy  string
+	position string
+	//custom tiers group every 'multiple' periods of their parent, which must be a built-in tier
+	multiple int
+}
+
+//built-in tiers. defaultConfig and lastReference are used to create the tier from its --retention-[name] flag
+var builtinTiers = []struct {
+	retentionTier
+	defaultConfig string
+	lastReference string
+}{
+	{retentionTier{name: "minutely", period: time.Minute, groupBy: "%Y-%m-%dT%H:%M:0.000", position: "%S"}, "0", "59"},
+	{retentionTier{name: "hourly", parent: "minutely", period: time.Hour, groupBy: "%Y-%m-%dT%H:0:0.000", position: "%M"}, "1", "59"},
+	{retentionTier{name: "daily", parent: "hourly", period: 24 * time.Hour, groupBy: "%Y-%m-%w-%dT0:0:0.000", position: "%H"}, "4@L", "23"},
+	{retentionTier{name: "weekly", parent: "daily", period: 7 * 24 * time.Hour, groupBy: "%Y-%m-%W-0T0:0:0.000", position: "%w"}, "3@L", "7"},
+	{retentionTier{name: "monthly", parent: "daily", period: 30 * 24 * time.Hour, groupBy: "%Y-%m-0T0:0:0.000", position: "%d"}, "3@L", "L"},
+	{retentionTier{name: "yearly", parent: "monthly", period: 365 * 24 * time.Hour, groupBy: "%Y-0-0T0:0:0.000", position: "%m"}, "2@L", "12"},
+}
+
+var tierNameRegex = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,31}$")
+
+//newRetentionTiers creates the built-in tiers with their retention configs (default when missing) and the custom tiers
+//defined by customTiers, a comma separated list of [name]=[multiple]*[built-in tier]:[retention config]. Ex.: quarterly=3*monthly:4@L
+func newRetentionTiers(configs map[string]string, customTiers string) ([]retentionTier, error) {
+	tiers := make([]retentionTier, 0)
+	for _, b := range builtinTiers {
+		config, ok := configs[b.name]
+		if !ok {
+			config = b.defaultConfig
+		}
+		t := b.retentionTier
+		t.params = retentionParams(config, b.lastReference)
+		tiers = append(tiers, t)
+	}
+
+	for _, spec := range strings.Split(customTiers, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		t, err := parseCustomTier(spec, tiers)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, t)
+	}
+
+	for i, t := range tiers {
+		count, maxAge, err := parseRetention(t.params[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retention for tier '%s'. err=%s", t.name, err)
+		}
+		tiers[i].count = count
+		tiers[i].maxAge = maxAge
+	}
+
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i].period < tiers[j].period
+	})
+	return tiers, nil
+}
+
+func parseCustomTier(spec string, tiers []retentionTier) (retentionTier, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return retentionTier{}, fmt.Errorf("Invalid tier '%s'. Use [name]=[multiple]*[built-in tier]:[retention]", spec)
+	}
+	name := strings.TrimSpace(parts[0])
+	if !tierNameRegex.MatchString(name) || name == "reference" {
+		return retentionTier{}, fmt.Errorf("Invalid tier name '%s'", name)
+	}
+	for _, t := range tiers {
+		if t.name == name {
+			return retentionTier{}, fmt.Errorf("Tier '%s' defined twice", name)
+		}
+	}
+	config := ""
+	def := parts[1]
+	if i := strings.Index(def, ":"); i >= 0 {
+		config = def[i+1:]
+		def = def[:i]
+	}
+	mp := strings.SplitN(def, "*", 2)
+	if len(mp) != 2 {
+		return retentionTier{}, fmt.Errorf("Invalid tier '%s'. Use [name]=[multiple]*[built-in tier]:[retention]", spec)
+	}
+	multiple, err := strconv.Atoi(strings.TrimSpace(mp[0]))
+	if err != nil || multiple < 2 {
+		return retentionTier{}, fmt.Errorf("Invalid multiple for tier '%s'. It must be at least 2", name)
+	}
+	parent := strings.TrimSpace(mp[1])
+	for _, b := range builtinTiers {
+		if b.name == parent {
+			return retentionTier{
+				name:     name,
+				parent:   parent,
+				params:   retentionParams(config, strconv.Itoa(multiple-1)),
+				period:   time.Duration(multiple) * b.period,
+				multiple: multiple,
+			}, nil
+		}
+	}
+	return retentionTier{}, fmt.Errorf("Tier '%s' must be a multiple of a built-in tier (minutely, hourly, daily, weekly, monthly or yearly)", name)
+}
+
+//parseRetention parses the retention part of a retention config: a count ('7'), a maximum age ('14d') or both ('7+14d')
+func parseRetention(retention string) (int, time.Duration, error) {
+	count := 0
+	maxAge := time.Duration(0)
+	for _, part := range strings.Split(retention, "+") {
+		part = strings.TrimSpace(part)
+		if n, err := strconv.Atoi(part); err == nil {
+			if n < 0 {
+				return 0, 0, fmt.Errorf("Retention count must not be negative")
+			}
+			count = n
+			continue
+		}
+		age, err := parseAge(part)
+		if err != nil {
+			return 0, 0, fmt.Errorf("'%s' is neither a retention count nor a duration", part)
+		}
+		maxAge = age
+	}
+	return count, maxAge, nil
+}
+
+//parseAge parses a duration that may also be expressed in days ('14d') or weeks ('2w')
+func parseAge(value string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("Invalid duration '%s'", value)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid duration '%s'", value)
+	}
+	return d, nil
+}
+
+//retentionTiers returns the configured tiers, ordered from the finest to the coarsest
+func retentionTiers() []retentionTier {
+	if len(options.retentionTiers) == 0 {
+		tiers, _ := newRetentionTiers(nil, "")
+		return tiers
+	}
+	return options.retentionTiers
+}
+
+//getRetentionTier returns the configured tier with name
+func getRetentionTier(name string) (retentionTier, bool) {
+	for _, t := range retentionTiers() {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return retentionTier{}, false
+}
+
+//tierParams returns the retention params of a configured tier
+func tierParams(name string) []string {
+	t, _ := getRetentionTier(name)
+	return t.params
+}
+
+//group and position of a backup started at t (local time) in this tier
+func (t retentionTier) locate(st time.Time) (string, int) {
+	if t.multiple == 0 {
+		value, _ := strconv.Atoi(formatStrftime(t.position, st))
+		return formatStrftime(t.groupBy, st), value
+	}
+	index := periodIndex(t.parent, st)
+	return strconv.FormatInt(index/int64(t.multiple), 10), int(index % int64(t.multiple))
+}
+
+//periodIndex returns the sequential number of the built-in tier period that contains the wall clock time t
+func periodIndex(tier string, t time.Time) int64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Unix()
+	switch tier {
+	case "minutely":
+		return wall / 60
+	case "hourly":
+		return wall / 3600
+	case "daily":
+		return wall / 86400
+	case "weekly":
+		//1970-01-01 is a thursday. weeks start on monday
+		return (wall/86400 + 3) / 7
+	case "monthly":
+		return int64(t.Year())*12 + int64(t.Month()) - 1
+	default:
+		return int64(t.Year())
+	}
+}
+
+//sorts tags in tier order, with 'reference' first
+func sortTags(tags []string) {
+	order := map[string]int{"reference": -1}
+	for i, t := range retentionTiers() {
+		order[t.name] = i
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return order[tags[i]] < order[tags[j]]
+	})
+}
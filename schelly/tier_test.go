@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRetentionTiers(t *testing.T) {
+	tiers, err := newRetentionTiers(map[string]string{"daily": "7"}, "quarterly=3*monthly:4@L, every-6h=6*hourly")
+	assert.Nil(t, err, "err")
+	names := make([]string, 0)
+	for _, tier := range tiers {
+		names = append(names, tier.name)
+	}
+	assert.Equal(t, []string{"minutely", "hourly", "every-6h", "daily", "weekly", "monthly", "quarterly", "yearly"}, names, "ordered by period")
+	assert.Equal(t, []string{"7", "23"}, tiers[3].params, "daily")
+	assert.Equal(t, []string{"4", "2"}, tiers[6].params, "quarterly last reference")
+	assert.Equal(t, []string{"0", "5"}, tiers[2].params, "every-6h default")
+
+	for _, spec := range []string{"quarterly", "quarterly=3*secondly", "quarterly=1*monthly", "daily=2*daily", "Bad=2*daily", "reference=2*daily", "q=3*monthly:x@L"} {
+		_, err = newRetentionTiers(nil, spec)
+		assert.NotNilf(t, err, "invalid tier %s", spec)
+	}
+	_, err = newRetentionTiers(map[string]string{"daily": "a@1"}, "")
+	assert.NotNil(t, err, "invalid count")
+}
+
+func TestRetentionTierLocate(t *testing.T) {
+	tiers, _ := newRetentionTiers(nil, "quarterly=3*monthly,biweekly=2*weekly")
+	quarterly, biweekly := retentionTier{}, retentionTier{}
+	for _, tier := range tiers {
+		if tier.name == "quarterly" {
+			quarterly = tier
+		}
+		if tier.name == "biweekly" {
+			biweekly = tier
+		}
+	}
+
+	ti, _ := time.Parse(time.RFC3339, "2006-03-31T10:00:00Z")
+	g1, p1 := quarterly.locate(ti)
+	ti, _ = time.Parse(time.RFC3339, "2006-01-01T00:00:00Z")
+	g2, p2 := quarterly.locate(ti)
+	ti, _ = time.Parse(time.RFC3339, "2006-04-01T00:00:00Z")
+	g3, p3 := quarterly.locate(ti)
+	assert.Equal(t, g1, g2, "same quarter")
+	assert.NotEqual(t, g1, g3, "next quarter")
+	assert.Equal(t, 2, p1, "last month of quarter")
+	assert.Equal(t, 0, p2, "first month of quarter")
+	assert.Equal(t, 0, p3, "first month of next quarter")
+
+	//2006-01-02 and 2006-01-08 are monday and sunday of the same week
+	ti, _ = time.Parse(time.RFC3339, "2006-01-02T00:00:00Z")
+	g1, _ = biweekly.locate(ti)
+	ti, _ = time.Parse(time.RFC3339, "2006-01-08T23:00:00Z")
+	g2, _ = biweekly.locate(ti)
+	assert.Equal(t, g1, g2, "same week")
+}
+
+func TestCustomTierTagging(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"daily": "0@23", "monthly": "0@L"}, "quarterly=3*monthly:1@L")
+
+	for _, ts := range []string{"2006-01-31T23:00:00Z", "2006-02-28T23:00:00Z", "2006-03-31T23:00:00Z", "2006-04-30T23:00:00Z"} {
+		ti, _ := time.Parse(time.RFC3339, ts)
+		_, err := createMaterializedBackup(ts, ts, "available", ti, ti, "", 1)
+		assert.Nil(t, err, "err")
+	}
+	err := tagAllBackups()
+	assert.Nil(t, err, "err")
+
+	backups, err := getMaterializedBackups(0, "quarterly", "", false)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 2, len(backups), "one per quarter")
+	ids := []string{backups[0].ID, backups[1].ID}
+	assert.Contains(t, ids, "2006-03-31T23:00:00Z", "last month of first quarter")
+	assert.Contains(t, ids, "2006-04-30T23:00:00Z", "only month of second quarter")
+
+	b, _ := getMaterializedBackup("2006-03-31T23:00:00Z")
+	assert.True(t, hasTag(b, "quarterly"), "tags of backup")
+	assert.True(t, hasTag(b, "monthly"), "tags of backup")
+}
+
+func TestTierReferenceSkipsDeletedBackups(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "1@30"}, "")
+
+	for id, ts := range map[string]string{"deleted": "2006-01-01T10:00:30Z", "available": "2006-01-01T10:00:10Z", "last": "2006-01-02T10:00:00Z"} {
+		ti, _ := time.Parse(time.RFC3339, ts)
+		_, err := createMaterializedBackup(id, id, "available", ti, ti, "", 1)
+		assert.Nil(t, err, "err")
+	}
+	_, err := setStatusMaterializedBackup("deleted", "deleted", actorSystem, "test")
+	assert.Nil(t, err, "err")
+	err = tagAllBackups()
+	assert.Nil(t, err, "err")
+
+	tags, _ := getBackupTags("available")
+	assert.Contains(t, tags, "minutely", "available backup tagged although a deleted backup is nearer to the reference")
+	tags, _ = getBackupTags("deleted")
+	assert.Equal(t, 0, len(tags), "deleted backup not tagged")
+}
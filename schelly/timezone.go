@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+//localSchedule evaluates a cron schedule against the wall clock of a timezone. Each wall clock time
+//fires only once, so an hour repeated when daylight saving ends doesn't trigger a schedule twice and
+//a time skipped when daylight saving starts fires right after the gap
+type localSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (s localSchedule) Next(t time.Time) time.Time {
+	lt := t.In(s.location)
+	w := time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), lt.Second(), lt.Nanosecond(), time.UTC)
+	for {
+		w = s.schedule.Next(w)
+		if w.IsZero() {
+			return w
+		}
+		n := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, s.location)
+		if n.Hour() != w.Hour() || n.Minute() != w.Minute() {
+			//w is inside a daylight saving gap. use the offset from before the gap so it fires right after it
+			_, offset := n.Add(-12 * time.Hour).Zone()
+			n = time.Unix(w.Unix()-int64(offset), 0).In(s.location)
+		}
+		if n.After(t) {
+			return n
+		}
+	}
+}
+
+//localTime returns t in the timezone configured for Schelly
+func localTime(t time.Time) time.Time {
+	if options.location == nil {
+		return t
+	}
+	return t.In(options.location)
+}
+
+//formatStrftime formats t using the strftime directives used by Schelly (%Y %m %d %H %M %S %w %W %j)
+func formatStrftime(format string, t time.Time) string {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			sb.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			sb.WriteString(fmt.Sprintf("%04d", t.Year()))
+		case 'm':
+			sb.WriteString(fmt.Sprintf("%02d", int(t.Month())))
+		case 'd':
+			sb.WriteString(fmt.Sprintf("%02d", t.Day()))
+		case 'H':
+			sb.WriteString(fmt.Sprintf("%02d", t.Hour()))
+		case 'M':
+			sb.WriteString(fmt.Sprintf("%02d", t.Minute()))
+		case 'S':
+			sb.WriteString(fmt.Sprintf("%02d", t.Second()))
+		case 'w':
+			sb.WriteString(fmt.Sprintf("%d", int(t.Weekday())))
+		case 'W':
+			//week of year, with weeks starting on monday
+			sb.WriteString(fmt.Sprintf("%02d", (t.YearDay()-1+7-(int(t.Weekday())+6)%7)/7))
+		case 'j':
+			sb.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(format[i])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatStrftime(t *testing.T) {
+	ti := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	assert.Equal(t, "2006-01-02T15:04:05", formatStrftime("%Y-%m-%dT%H:%M:%S", ti), "datetime")
+	assert.Equal(t, "1 01 002 %", formatStrftime("%w %W %j %%", ti), "weekday, week of year, day of year")
+	assert.Equal(t, "00", formatStrftime("%W", time.Date(2006, 1, 1, 0, 0, 0, 0, time.UTC)), "sunday before first monday")
+}
+
+func TestLocalStrftime(t *testing.T) {
+	saoPaulo, _ := time.LoadLocation("America/Sao_Paulo")
+	defer func(loc *time.Location) { options.location = loc }(options.location)
+
+	//a daily backup at 23h in UTC-3 is already next day in UTC
+	ti := time.Date(2006, 1, 1, 23, 0, 0, 0, saoPaulo)
+	options.location = time.UTC
+	assert.Equal(t, "2006-01-02", formatStrftime("%Y-%m-%d", localTime(ti)), "utc day")
+
+	options.location = saoPaulo
+	assert.Equal(t, "2006-01-01", formatStrftime("%Y-%m-%d", localTime(ti.UTC())), "local day")
+}
+
+func TestLocalScheduleDaylightSaving(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+
+	//02:30 doesn't exist when daylight saving starts. it fires right after the gap
+	s, _ := parseCronSchedule("0 30 2 * * *", ny)
+	next := s.Next(time.Date(2019, 3, 10, 0, 0, 0, 0, ny))
+	assert.Equal(t, time.Date(2019, 3, 10, 3, 30, 0, 0, ny), next, "spring forward")
+
+	//01:30 happens twice when daylight saving ends. it fires only once
+	s, _ = parseCronSchedule("0 30 1 * * *", ny)
+	first := s.Next(time.Date(2019, 11, 3, 0, 0, 0, 0, ny))
+	second := s.Next(first)
+	assert.Equal(t, 24*time.Hour+time.Hour, second.Sub(first), "fall back")
+	assert.Equal(t, 4, second.Day(), "fall back day")
+}
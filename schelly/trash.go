@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var trashGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "schelly_retention_trash_backups",
+	Help: "Backups with status 'pending-delete' waiting for the end of the trash period",
+})
+
+//TrashedBackup a backup elected by retention that will be deleted on the provider after DeleteAfter
+type TrashedBackup struct {
+	BackupID    string    `json:"backup_id"`
+	DeleteAfter time.Time `json:"delete_after"`
+	Reason      string    `json:"reason"`
+}
+
+func initTrash() {
+	prometheus.MustRegister(trashGauge)
+}
+
+//trashBackup moves an available backup to the trash (status 'pending-delete') until the trash period ends
+func trashBackup(backupID string, actor string, reason string) (bool, error) {
+	deleteAfter := time.Now().Add(options.retentionTrashPeriod)
+	ok, err := changeStatusMaterializedBackup(backupID, "available", "pending-delete", &deleteAfter, actor, reason)
+	if ok {
+		trashGauge.Inc()
+	}
+	return ok, err
+}
+
+//restoreFromTrash cancels the deletion of a backup with status 'pending-delete'. returns false if the backup isn't in the trash
+func restoreFromTrash(backupID string, actor string, reason string) (bool, error) {
+	if reason == "" {
+		reason = "restored from trash"
+	}
+	ok, err := changeStatusMaterializedBackup(backupID, "pending-delete", "available", nil, actor, reason)
+	if ok {
+		logrus.Infof("Backup '%s' restored from trash by %s", backupID, actor)
+		trashGauge.Dec()
+	}
+	return ok, err
+}
+
+//emptyTrash deletes on the provider the backups whose trash period ended
+func emptyTrash() {
+	if desc, blocked := activeWindow("retention", time.Now()); blocked {
+		logrus.Debugf("Not emptying trash because of %s", desc)
+		return
+	}
+	avoidRetentionLock.Lock()
+	defer avoidRetentionLock.Unlock()
+
+	trash, err := getBackupTrash()
+	if err != nil {
+		logrus.Errorf("Couldn't query trash. err=%s", err)
+		return
+	}
+	trashGauge.Set(float64(len(trash)))
+	now := time.Now()
+	backupIDs := make([]string, 0)
+	for _, t := range trash {
+		if t.DeleteAfter.After(now) {
+			continue
+		}
+		ok, err := changeStatusMaterializedBackup(t.BackupID, "pending-delete", "deleting", nil, actorCron, fmt.Sprintf("trash period ended. %s", t.Reason))
+		if err != nil {
+			logrus.Errorf("Couldn't set status of backup '%s' to 'deleting'. Skipping backup deletion. err=%s", t.BackupID, err)
+			retentionBackupsDeleteCounter.WithLabelValues("error").Inc()
+		} else if ok {
+			backupIDs = append(backupIDs, t.BackupID)
+			trashGauge.Dec()
+		}
+	}
+	if len(backupIDs) == 0 {
+		return
+	}
+	logrus.Infof("Trash period of %d backups ended. Deleting them", len(backupIDs))
+	deleted := deleteBackups(backupIDs, actorCron, 0)
+	logrus.Infof("%d of %d backups deleted from trash", deleted, len(backupIDs))
+}
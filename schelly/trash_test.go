@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionTrash(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	deleted := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	options.webhookURL = server.URL
+	options.retentionTiers, _ = newRetentionTiers(map[string]string{"minutely": "0", "hourly": "0", "daily": "0", "weekly": "0", "monthly": "0", "yearly": "0"}, "")
+	options.retentionTrashPeriod = time.Hour
+
+	for _, id := range []string{"t1", "t2"} {
+		_, err := createMaterializedBackup(id, id, "available", time.Now(), time.Now(), "", 1)
+		assert.Nil(t, err, "err")
+	}
+	result := triggerRetentionTask(actorCron, false)
+	assert.Equal(t, 2, result.Trashed, "trashed")
+	assert.Equal(t, 0, len(deleted), "not deleted on provider")
+	trash, _ := getBackupTrash()
+	assert.Equal(t, 2, len(trash), "trash")
+	assert.True(t, trash[0].DeleteAfter.After(time.Now().Add(59*time.Minute)), "delete after")
+
+	emptyTrash()
+	assert.Equal(t, 0, len(deleted), "trash period not ended")
+
+	req := httptest.NewRequest("POST", "/backups/t1/restore-from-trash", nil)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "restored")
+	b, _ := getMaterializedBackup("t1")
+	assert.Equal(t, "available", b.Status, "restored")
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups/t1/restore-from-trash", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code, "not in trash")
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/backups/none/restore-from-trash", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "not found")
+
+	//trash period of t2 ended
+	_, err := changeStatusMaterializedBackup("t2", "pending-delete", "pending-delete", &time.Time{}, actorCron, "")
+	assert.Nil(t, err, "err")
+	emptyTrash()
+	assert.Equal(t, []string{"/t2"}, deleted, "deleted after trash period")
+	b, _ = getMaterializedBackup("t2")
+	assert.Equal(t, "deleted", b.Status, "deleted")
+	trash, _ = getBackupTrash()
+	assert.Equal(t, 0, len(trash), "trash emptied")
+}
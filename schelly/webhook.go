@@ -9,8 +9,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 //METRICS
@@ -32,14 +32,14 @@ func initWebhook() {
 	prometheus.MustRegister(invocationHist)
 }
 
-func getWebhookBackupInfo(backupID string) (ResponseWebhook, error) {
+func getWebhookBackupInfo(webhookURL string, backupID string) (ResponseWebhook, error) {
 	logrus.Debugf("getWebhookBackupInfo %s - waiting lock", backupID)
 	webhookLock.Lock()
 	defer webhookLock.Unlock()
 	logrus.Debugf("getWebhookBackupInfo %s - acquired lock", backupID)
-	logrus.Debug(fmt.Sprintf("%s/%s", options.webhookURL, backupID))
+	logrus.Debug(fmt.Sprintf("%s/%s", webhookURL, backupID))
 	start := time.Now()
-	resp, data, err := getHTTP(fmt.Sprintf("%s/%s", options.webhookURL, backupID))
+	resp, data, err := getHTTP(fmt.Sprintf("%s/%s", webhookURL, backupID))
 	if err != nil {
 		logrus.Errorf("Webhook GET backup status invocation failed. err=%s", err)
 		invocationHist.WithLabelValues("info", "error").Observe(float64(time.Since(start).Seconds()))
@@ -57,19 +57,43 @@ func getWebhookBackupInfo(backupID string) (ResponseWebhook, error) {
 			return respData, nil
 		}
 	} else {
-		logrus.Warnf("Webhook status != 200 resp=%s", resp)
+		logrus.Warnf("Webhook status != 200 resp=%v", resp)
 		invocationHist.WithLabelValues("info", "error").Observe(float64(time.Since(start).Seconds()))
 		return ResponseWebhook{}, fmt.Errorf("Couldn't get backup info")
 	}
 }
 
-func createWebhookBackup() (ResponseWebhook, error) {
+func createWebhookBackup(webhookURL string) (ResponseWebhook, error) {
 	logrus.Debugf("createWebhookBackup - waiting lock")
 	webhookLock.Lock()
 	defer webhookLock.Unlock()
 	logrus.Debugf("createWebhookBackup - acquired lock")
+	return postWebhookBackup(webhookURL)
+}
+
+//createWebhookBackups asks all providers of a consistency group for a new backup at the same time
+func createWebhookBackups(webhookURLs []string) ([]ResponseWebhook, []error) {
+	logrus.Debugf("createWebhookBackups - waiting lock")
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	logrus.Debugf("createWebhookBackups - acquired lock")
+	resps := make([]ResponseWebhook, len(webhookURLs))
+	errs := make([]error, len(webhookURLs))
+	var wg sync.WaitGroup
+	for i, url := range webhookURLs {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			resps[i], errs[i] = postWebhookBackup(url)
+		}(i, url)
+	}
+	wg.Wait()
+	return resps, errs
+}
+
+func postWebhookBackup(webhookURL string) (ResponseWebhook, error) {
 	start := time.Now()
-	resp, data, err := postHTTP(options.webhookURL, options.webhookCreateBody)
+	resp, data, err := postHTTP(webhookURL, options.webhookCreateBody)
 	if err != nil {
 		logrus.Errorf("Webhook POST new backup invocation failed. err=%s", err)
 		invocationHist.WithLabelValues("create", "error").Observe(float64(time.Since(start).Seconds()))
@@ -87,19 +111,25 @@ func createWebhookBackup() (ResponseWebhook, error) {
 			return respData, nil
 		}
 	} else {
-		logrus.Warnf("Webhook status != 202. resp=%s", resp)
+		logrus.Warnf("Webhook status != 202. resp=%v", resp)
 		invocationHist.WithLabelValues("create", "error").Observe(float64(time.Since(start).Seconds()))
 		return ResponseWebhook{}, fmt.Errorf("Failed to create backup. response")
 	}
 }
 
-func deleteWebhookBackup(backupID string) error {
+//deleteWebhookBackup deletes a backup on a provider. every delete goes through here, so that backups under legal hold or WORM period are never deleted.
+//lock is webhookLock, except for the parallel retention delete workers, which are bounded by their own semaphore
+func deleteWebhookBackup(webhookURL string, backupID string, actor string, lock sync.Locker) error {
+	err := checkDeleteAllowed(backupID, actor)
+	if err != nil {
+		return err
+	}
 	logrus.Debugf("deleteWebhookBackup %s - waiting lock", backupID)
-	webhookLock.Lock()
-	defer webhookLock.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
 	logrus.Debugf("deleteWebhookBackup %s - acquired lock", backupID)
 	start := time.Now()
-	resp, _, err := deleteHTTP(fmt.Sprintf("%s/%s", options.webhookURL, backupID))
+	resp, _, err := deleteHTTP(fmt.Sprintf("%s/%s", webhookURL, backupID))
 	if err != nil {
 		logrus.Errorf("Webhook DELETE backup invocation failed. err=%s", err)
 		invocationHist.WithLabelValues("delete", "error").Observe(float64(time.Since(start).Seconds()))
@@ -114,7 +144,7 @@ func deleteWebhookBackup(backupID string) error {
 		invocationHist.WithLabelValues("delete", "success").Observe(float64(time.Since(start).Seconds()))
 		return nil
 	} else {
-		logrus.Warnf("Webhook status != 200. resp=%s", resp)
+		logrus.Warnf("Webhook status != 200. resp=%v", resp)
 		invocationHist.WithLabelValues("delete", "error").Observe(float64(time.Since(start).Seconds()))
 		return fmt.Errorf("Webhook status != 200. resp=%v", resp)
 	}
@@ -134,14 +164,14 @@ func postHTTP(url string, data string) (http.Response, []byte, error) {
 	client := &http.Client{
 		Timeout: time.Second * 10,
 	}
-	logrus.Debugf("POST request=%s", req)
+	logrus.Debugf("POST request=%v", req)
 	response, err1 := client.Do(req)
 	if err1 != nil {
 		logrus.Errorf("HTTP request invocation failed. err=%s", err1)
 		return http.Response{}, []byte{}, err1
 	}
 
-	logrus.Debugf("Response: %s", response)
+	logrus.Debugf("Response: %v", response)
 	datar, _ := ioutil.ReadAll(response.Body)
 	logrus.Debugf("Response body: %s", datar)
 	return *response, datar, nil
@@ -160,14 +190,14 @@ func getHTTP(url string) (http.Response, []byte, error) {
 	client := &http.Client{
 		Timeout: time.Second * 10,
 	}
-	logrus.Debugf("GET request=%s", req)
+	logrus.Debugf("GET request=%v", req)
 	response, err1 := client.Do(req)
 	if err1 != nil {
 		logrus.Errorf("HTTP request invocation failed. err=%s", err1)
 		return http.Response{}, []byte{}, err1
 	}
 
-	logrus.Debugf("Response: %s", response)
+	logrus.Debugf("Response: %v", response)
 	datar, _ := ioutil.ReadAll(response.Body)
 	logrus.Debugf("Response body: %s", datar)
 	return *response, datar, nil
@@ -186,14 +216,14 @@ func deleteHTTP(url string) (http.Response, []byte, error) {
 	client := &http.Client{
 		Timeout: time.Second * 10,
 	}
-	logrus.Debugf("DELETE request=%s", req)
+	logrus.Debugf("DELETE request=%v", req)
 	response, err1 := client.Do(req)
 	if err1 != nil {
 		logrus.Errorf("HTTP request invocation failed. err=%s", err1)
 		return http.Response{}, []byte{}, err1
 	}
 
-	logrus.Debugf("Response: %s", response)
+	logrus.Debugf("Response: %v", response)
 	datar, _ := ioutil.ReadAll(response.Body)
 	logrus.Debugf("Response body: %s", datar)
 	return *response, datar, nil
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var windowBlockedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "schelly_window_blocked_total",
+	Help: "Total scheduled tasks that fell inside a blackout or maintenance window",
+}, []string{
+	// backup or retention
+	"scope",
+	// skipped, deferred or resumed
+	"decision",
+})
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+//blackoutWindow a period in which backups or retention deletes are forbidden
+type blackoutWindow struct {
+	spec     string
+	days     [7]bool
+	start    int
+	end      int
+	schedule cron.Schedule
+	duration time.Duration
+	location *time.Location
+}
+
+//MaintenanceWindow ad hoc window opened through the REST API
+type MaintenanceWindow struct {
+	ID        int       `json:"id"`
+	Scope     string    `json:"scope"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Reason    string    `json:"reason"`
+}
+
+func initWindow() {
+	prometheus.MustRegister(windowBlockedCounter)
+}
+
+//parseBlackoutWindows parses a ';' separated list of windows. Each window is either
+//'[days] HH:MM-HH:MM [timezone]' (ex.: 'mon-fri 09:00-18:00 America/Sao_Paulo') or
+//'[cron string]|[duration]' (ex.: '0 0 2 * * SUN|4h')
+func parseBlackoutWindows(specs string, location *time.Location) ([]blackoutWindow, error) {
+	windows := make([]blackoutWindow, 0)
+	for _, spec := range strings.Split(specs, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		w, err := parseBlackoutWindow(spec, location)
+		if err != nil {
+			return []blackoutWindow{}, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseBlackoutWindow(spec string, location *time.Location) (blackoutWindow, error) {
+	w := blackoutWindow{spec: spec, location: location}
+
+	if strings.Contains(spec, "|") {
+		parts := strings.SplitN(spec, "|", 2)
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || d <= 0 {
+			return w, fmt.Errorf("Invalid duration in window '%s'", spec)
+		}
+		s, err := parseCronSchedule(parts[0], location)
+		if err != nil {
+			return w, fmt.Errorf("Invalid cron string in window '%s'. err=%s", spec, err)
+		}
+		w.schedule = s
+		w.duration = d
+		return w, nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 3 {
+		return w, fmt.Errorf("Invalid window '%s'", spec)
+	}
+	days := "*"
+	if !strings.Contains(fields[0], ":") {
+		days = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return w, fmt.Errorf("Time range missing in window '%s'", spec)
+	}
+	if len(fields) == 2 {
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return w, fmt.Errorf("Invalid timezone in window '%s'. err=%s", spec, err)
+		}
+		w.location = loc
+	}
+
+	err := parseWeekdays(days, &w.days)
+	if err != nil {
+		return w, fmt.Errorf("Invalid days in window '%s'. err=%s", spec, err)
+	}
+
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("Invalid time range in window '%s'", spec)
+	}
+	w.start, err = parseClock(times[0])
+	if err != nil {
+		return w, fmt.Errorf("Invalid start time in window '%s'. err=%s", spec, err)
+	}
+	w.end, err = parseClock(times[1])
+	if err != nil {
+		return w, fmt.Errorf("Invalid end time in window '%s'. err=%s", spec, err)
+	}
+	return w, nil
+}
+
+func parseWeekdays(days string, result *[7]bool) error {
+	if days == "*" {
+		for i := range result {
+			result[i] = true
+		}
+		return nil
+	}
+	for _, r := range strings.Split(strings.ToLower(days), ",") {
+		limits := strings.Split(r, "-")
+		from := weekdayIndex(limits[0])
+		to := from
+		if len(limits) == 2 {
+			to = weekdayIndex(limits[1])
+		}
+		if from == -1 || to == -1 || len(limits) > 2 {
+			return fmt.Errorf("Invalid weekday range '%s'", r)
+		}
+		for i := from; ; i = (i + 1) % 7 {
+			result[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func weekdayIndex(day string) int {
+	for i, d := range weekdays {
+		if d == day {
+			return i
+		}
+	}
+	return -1
+}
+
+//returns minutes since midnight for HH:MM
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w blackoutWindow) contains(t time.Time) bool {
+	if w.schedule != nil {
+		return !w.schedule.Next(t.Add(-w.duration)).After(t)
+	}
+	lt := t.In(w.location)
+	minute := lt.Hour()*60 + lt.Minute()
+	day := int(lt.Weekday())
+	if w.start <= w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	//window crosses midnight. it belongs to the day it starts
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+//activeWindow returns a description of the blackout or maintenance window that forbids tasks of scope ('backup' or 'retention') at time t
+func activeWindow(scope string, t time.Time) (string, bool) {
+	windows := options.backupWindows
+	if scope == "retention" {
+		windows = options.retentionWindows
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return fmt.Sprintf("blackout window '%s'", w.spec), true
+		}
+	}
+	mws, err := getActiveMaintenanceWindows(t)
+	if err != nil {
+		logrus.Warnf("Couldn't query maintenance windows. err=%s", err)
+		return "", false
+	}
+	for _, mw := range mws {
+		if mw.Scope == "all" || mw.Scope == scope {
+			return fmt.Sprintf("maintenance window %d until %s (%s)", mw.ID, localTime(mw.EndTime), mw.Reason), true
+		}
+	}
+	return "", false
+}
+
+//checkWindow returns true if a scheduled task of scope may run now. If it is inside a window, the task is skipped or deferred
+//to the end of the window according to the window policy
+func checkWindow(scope string) bool {
+	desc, blocked := activeWindow(scope, time.Now())
+	if !blocked {
+		return true
+	}
+	if options.windowPolicy == "defer" {
+		logrus.Infof("Scheduled %s task is inside %s. Deferring it until the window ends", scope, desc)
+		windowBlockedCounter.WithLabelValues(scope, "deferred").Inc()
+		setTaskDeferred(scope, true)
+	} else {
+		logrus.Infof("Scheduled %s task is inside %s. Skipping it", scope, desc)
+		windowBlockedCounter.WithLabelValues(scope, "skipped").Inc()
+	}
+	return false
+}
+
+//deferred tasks are kept in schedule_state (as 'deferred-backup' and 'deferred-retention') so that they
+//still run when the window ends after Schelly is restarted
+func setTaskDeferred(scope string, deferred bool) {
+	var err error
+	if deferred {
+		err = setScheduleLastFire("deferred-"+scope, time.Now())
+	} else {
+		err = deleteScheduleState("deferred-" + scope)
+	}
+	if err != nil {
+		logrus.Warnf("Couldn't store deferred state of %s task. err=%s", scope, err)
+	}
+}
+
+func isTaskDeferred(scope string) bool {
+	_, deferred, err := getScheduleLastFire("deferred-" + scope)
+	if err != nil {
+		logrus.Warnf("Couldn't get deferred state of %s task. err=%s", scope, err)
+		return false
+	}
+	return deferred
+}
+
+//runs tasks deferred by a window after the window ends
+func checkDeferredTasks() {
+	if isTaskDeferred("backup") && !isSchedulePaused("backup") {
+		if _, blocked := activeWindow("backup", time.Now()); !blocked {
+			logrus.Infof("Window ended. Running deferred backup task")
+			setTaskDeferred("backup", false)
+			windowBlockedCounter.WithLabelValues("backup", "resumed").Inc()
+			runBackupTask()
+		}
+	}
+	if isTaskDeferred("retention") && !isSchedulePaused("retention") {
+		if _, blocked := activeWindow("retention", time.Now()); !blocked {
+			logrus.Infof("Window ended. Running deferred retention task")
+			setTaskDeferred("retention", false)
+			windowBlockedCounter.WithLabelValues("retention", "resumed").Inc()
+			runRetentionTask()
+		}
+	}
+}
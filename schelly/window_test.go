@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlackoutWindowWeekdays(t *testing.T) {
+	ws, err := parseBlackoutWindows("mon-fri 09:00-18:00; sat 22:00-02:00", time.UTC)
+	assert.Nil(t, err, "err")
+	assert.Equal(t, 2, len(ws), "windows")
+
+	//2019-03-04 is a monday
+	assert.True(t, ws[0].contains(time.Date(2019, 3, 4, 9, 0, 0, 0, time.UTC)), "monday start")
+	assert.False(t, ws[0].contains(time.Date(2019, 3, 4, 18, 0, 0, 0, time.UTC)), "monday end")
+	assert.False(t, ws[0].contains(time.Date(2019, 3, 3, 10, 0, 0, 0, time.UTC)), "sunday")
+	assert.True(t, ws[1].contains(time.Date(2019, 3, 9, 23, 0, 0, 0, time.UTC)), "saturday night")
+	assert.True(t, ws[1].contains(time.Date(2019, 3, 10, 1, 0, 0, 0, time.UTC)), "sunday early morning")
+	assert.False(t, ws[1].contains(time.Date(2019, 3, 11, 1, 0, 0, 0, time.UTC)), "monday early morning")
+}
+
+func TestBlackoutWindowTimezone(t *testing.T) {
+	ws, err := parseBlackoutWindows("* 09:00-18:00 America/Sao_Paulo", time.UTC)
+	assert.Nil(t, err, "err")
+	assert.False(t, ws[0].contains(time.Date(2019, 3, 4, 10, 0, 0, 0, time.UTC)), "7h in Sao Paulo")
+	assert.True(t, ws[0].contains(time.Date(2019, 3, 4, 13, 0, 0, 0, time.UTC)), "10h in Sao Paulo")
+}
+
+func TestBlackoutWindowCron(t *testing.T) {
+	ws, err := parseBlackoutWindows("0 0 2 * * SUN|4h", time.UTC)
+	assert.Nil(t, err, "err")
+	assert.True(t, ws[0].contains(time.Date(2019, 3, 10, 2, 0, 0, 0, time.UTC)), "start")
+	assert.True(t, ws[0].contains(time.Date(2019, 3, 10, 5, 59, 0, 0, time.UTC)), "inside")
+	assert.False(t, ws[0].contains(time.Date(2019, 3, 10, 6, 0, 0, 0, time.UTC)), "end")
+	assert.False(t, ws[0].contains(time.Date(2019, 3, 11, 3, 0, 0, 0, time.UTC)), "monday")
+}
+
+func TestBlackoutWindowInvalid(t *testing.T) {
+	_, err := parseBlackoutWindows("xyz 09:00-18:00", time.UTC)
+	assert.NotNil(t, err, "days")
+	_, err = parseBlackoutWindows("mon 09:00", time.UTC)
+	assert.NotNil(t, err, "range")
+	_, err = parseBlackoutWindows("0 0 2 * * SUN|abc", time.UTC)
+	assert.NotNil(t, err, "duration")
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	initDB()
+	options.backupWindows = []blackoutWindow{}
+	options.retentionWindows = []blackoutWindow{}
+	now := time.Now()
+	id, err := createMaintenanceWindow("retention", now, now.Add(2*time.Hour), "provider maintenance")
+	assert.Nil(t, err, "err")
+
+	_, blocked := activeWindow("retention", now.Add(time.Minute))
+	assert.True(t, blocked, "retention blocked")
+	_, blocked = activeWindow("backup", now.Add(time.Minute))
+	assert.False(t, blocked, "backup allowed")
+	_, blocked = activeWindow("retention", now.Add(3*time.Hour))
+	assert.False(t, blocked, "after window")
+
+	count, err := endMaintenanceWindow(id, now.Add(time.Minute))
+	assert.Nil(t, err, "err")
+	assert.Equal(t, int64(1), count, "closed")
+	_, blocked = activeWindow("retention", now.Add(2*time.Minute))
+	assert.False(t, blocked, "closed window")
+}
+
+func TestDeferredTaskSurvivesRestart(t *testing.T) {
+	defer func(o Options) { *options = o }(*options)
+	initTestDB(t)
+	options.backupWindows = []blackoutWindow{}
+	options.retentionWindows = []blackoutWindow{}
+	options.windowPolicy = "defer"
+	now := time.Now()
+	id, err := createMaintenanceWindow("retention", now.Add(-time.Minute), now.Add(time.Hour), "provider maintenance")
+	assert.Nil(t, err, "err")
+
+	assert.False(t, checkWindow("retention"), "retention deferred")
+	assert.True(t, isTaskDeferred("retention"), "deferred")
+	assert.False(t, isTaskDeferred("backup"), "backup not deferred")
+
+	//restart
+	initDB()
+	checkDeferredTasks()
+	assert.True(t, isTaskDeferred("retention"), "still deferred inside the window")
+
+	_, err = endMaintenanceWindow(id, time.Now())
+	assert.Nil(t, err, "err")
+	checkDeferredTasks()
+	assert.False(t, isTaskDeferred("retention"), "deferred task ran after the window")
+}
@@ -12,12 +12,47 @@ schelly \
     --webhook-create-body="$WEBHOOK_CREATE_BODY" \
     --webhook-delete-body="$WEBHOOK_DELETE_BODY" \
     --webhook-grace-time=$WEBHOOK_GRACE_TIME \
+    --backup-overlap-policy=$BACKUP_OVERLAP_POLICY \
+    --catchup-window=$CATCHUP_WINDOW \
+    --timezone=$TIMEZONE \
+    --backup-blackout-windows="$BACKUP_BLACKOUT_WINDOWS" \
+    --retention-blackout-windows="$RETENTION_BLACKOUT_WINDOWS" \
+    --blackout-window-policy=$BLACKOUT_WINDOW_POLICY \
+    --schedule-splay=$SCHEDULE_SPLAY \
+    --schedule-splay-mode=$SCHEDULE_SPLAY_MODE \
+    --chain-downstream-urls="$CHAIN_DOWNSTREAM_URLS" \
+    --chain-timeout=$CHAIN_TIMEOUT \
+    --chain-failure-policy=$CHAIN_FAILURE_POLICY \
+    --pre-backup-hook="$PRE_BACKUP_HOOK" \
+    --post-backup-hook="$POST_BACKUP_HOOK" \
+    --pre-backup-hook-failure=$PRE_BACKUP_HOOK_FAILURE \
+    --hook-timeout=$HOOK_TIMEOUT \
     --retention-minutely=$RETENTION_MINUTELY \
     --retention-hourly=$RETENTION_HOURLY \
     --retention-daily=$RETENTION_DAILY \
     --retention-weekly=$RETENTION_WEEKLY \
     --retention-monthly=$RETENTION_MONTHLY \
     --retention-yearly=$RETENTION_YEARLY \
+    --retention-tiers="$RETENTION_TIERS" \
+    --retention-keep-within=$RETENTION_KEEP_WITHIN \
+    --retention-quota=$RETENTION_QUOTA \
+    --retention-min-available=$RETENTION_MIN_AVAILABLE \
+    --retention-max-backup-age=$RETENTION_MAX_BACKUP_AGE \
+    --retention-max-deletes=$RETENTION_MAX_DELETES \
+    --retention-max-delete-percent=$RETENTION_MAX_DELETE_PERCENT \
+    --retention-delete-concurrency=$RETENTION_DELETE_CONCURRENCY \
+    --retention-delete-rate=$RETENTION_DELETE_RATE \
+    --retention-trash-period=$RETENTION_TRASH_PERIOD \
+    --worm-period=$WORM_PERIOD \
     --data-dir="$DATA_DIR" \
+    --catalog-url="$CATALOG_URL" \
+    --leader-lease=$LEADER_LEASE \
+    --instance-id="$INSTANCE_ID" \
+    --catalog-snapshot-cron="$CATALOG_SNAPSHOT_CRON" \
+    --catalog-snapshot-dir="$CATALOG_SNAPSHOT_DIR" \
+    --catalog-snapshot-retention=$CATALOG_SNAPSHOT_RETENTION \
+    --catalog-compaction-cron="$CATALOG_COMPACTION_CRON" \
+    --purge-deleted-days=$PURGE_DELETED_DAYS \
+    --purge-mode=$PURGE_MODE \
     --log-level=$LOG_LEVEL
 